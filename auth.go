@@ -0,0 +1,94 @@
+package Bithose
+
+import (
+	"crypto/tls"
+	"github.com/JonathanRosado/Bithose/auth"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"net/http"
+	"strings"
+)
+
+var (
+	// TokenVerifier verifies the tokens subscribers present. Authentication is
+	// disabled while it is nil
+	TokenVerifier *auth.Verifier
+
+	// PublisherKeys holds the api keys allowed to publish. Anyone may publish
+	// anything while it is nil
+	PublisherKeys *auth.PublisherKeys
+
+	// publishStats counts the rejected publishes, which never reach the connection store
+	publishStats = connectionstore.NewStatistics()
+)
+
+// authenticate returns the claims of the request's token, taken from the
+// Authorization header or the token query parameter. A request without a token
+// but with a verified client certificate is authenticated as the certificate's
+// subject. The claims are nil if authentication is disabled.
+func authenticate(request *http.Request) (*auth.Claims, error) {
+	if TokenVerifier == nil {
+		return nil, nil
+	}
+	return authenticateToken(requestToken(request), request.TLS)
+}
+
+func authenticateToken(token string, state *tls.ConnectionState) (*auth.Claims, error) {
+	if token == "" {
+		if subject := ClientCertificateSubject(state); subject != "" {
+			return TokenVerifier.SubjectClaims(subject), nil
+		}
+	}
+	return TokenVerifier.Verify(token)
+}
+
+// ClientCertificateSubject returns the common name of the client certificate verified
+// on the connection, or an empty string if the client did not present one
+func ClientCertificateSubject(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+func requestToken(request *http.Request) string {
+	if token := bearerToken(request.Header.Get("Authorization")); token != "" {
+		return token
+	}
+	return request.URL.Query().Get("token")
+}
+
+// bearerToken returns the token of an Authorization header value of the
+// Bearer scheme
+func bearerToken(authorization string) string {
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+func unauthorized(writer http.ResponseWriter, err error) {
+	writer.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(writer, err.Error(), http.StatusUnauthorized)
+}
+
+// authorizePublish returns nil if the api key may publish a message with the label
+// pairs. Rejected publishes are counted in the statistics.
+func authorizePublish(apiKey string, pairs []connectionstore.LabelPair) error {
+	if PublisherKeys == nil {
+		return nil
+	}
+	err := PublisherKeys.Authorize(apiKey, pairs)
+	if err != nil {
+		publishStats.IncrementPublishRejected()
+	}
+	return err
+}
+
+// requestApiKey returns the api key of the request, taken from the X-Api-Key
+// header or the api_key query parameter
+func requestApiKey(request *http.Request) string {
+	if apiKey := request.Header.Get("X-Api-Key"); apiKey != "" {
+		return apiKey
+	}
+	return request.URL.Query().Get("api_key")
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"os"
+)
+
+// AnyValue in the allowlist of a label lets a key publish any value of the label
+const AnyValue = "*"
+
+var (
+	MissingApiKeyErr   = errors.New("missing api key")
+	InvalidApiKeyErr   = errors.New("invalid api key")
+	LabelNotAllowedErr = errors.New("label not allowed for api key")
+)
+
+// PublisherKeys holds the api keys allowed to publish. Every key has an allowlist
+// mapping the label names it may publish to the values it may publish them with.
+type PublisherKeys struct {
+	keys map[string]map[string]map[interface{}]struct{}
+}
+
+// NewPublisherKeys returns the publisher keys for the allowlists, which map every key
+// to its label names and their allowed values
+func NewPublisherKeys(allowlists map[string]map[string][]interface{}) (*PublisherKeys, error) {
+	keys := map[string]map[string]map[interface{}]struct{}{}
+	for key, labels := range allowlists {
+		if key == "" {
+			return nil, errors.New("api keys can not be empty")
+		}
+		keys[key] = map[string]map[interface{}]struct{}{}
+		for name, values := range labels {
+			keys[key][name] = map[interface{}]struct{}{}
+			for _, value := range values {
+				normalized, ok := connectionstore.NormalizeLabelValue(value)
+				if !ok {
+					return nil, fmt.Errorf("invalid value %v allowed for label %s", value, name)
+				}
+				keys[key][name][normalized] = struct{}{}
+			}
+		}
+	}
+	return &PublisherKeys{keys: keys}, nil
+}
+
+// LoadPublisherKeys reads the allowlists from a JSON file of the form
+// {"<key>": {"<label name>": [<value>, ...]}}
+func LoadPublisherKeys(path string) (*PublisherKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var allowlists map[string]map[string][]interface{}
+	if err := json.Unmarshal(data, &allowlists); err != nil {
+		return nil, err
+	}
+	return NewPublisherKeys(allowlists)
+}
+
+// Authorize returns nil if the key may publish a message with the label pairs, that
+// is if the allowlist of the key has every one of the labels with its value
+func (p *PublisherKeys) Authorize(key string, pairs []connectionstore.LabelPair) error {
+	if key == "" {
+		return MissingApiKeyErr
+	}
+	labels, ok := p.keys[key]
+	if !ok {
+		return InvalidApiKeyErr
+	}
+
+	for _, pair := range pairs {
+		values, ok := labels[pair.Name]
+		if !ok {
+			return fmt.Errorf("%w: %s", LabelNotAllowedErr, pair.Name)
+		}
+		if _, ok := values[AnyValue]; ok {
+			continue
+		}
+		value, ok := connectionstore.NormalizeLabelValue(pair.Value)
+		if !ok {
+			return fmt.Errorf("%w: %s", LabelNotAllowedErr, pair.Name)
+		}
+		if _, ok := values[value]; !ok {
+			return fmt.Errorf("%w: %s=%v", LabelNotAllowedErr, pair.Name, pair.Value)
+		}
+	}
+	return nil
+}
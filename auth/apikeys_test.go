@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"errors"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublisherKeys_Authorize(t *testing.T) {
+	keys, err := NewPublisherKeys(map[string]map[string][]interface{}{
+		"backend": {
+			"channel": {"chats", "news"},
+			"uid":     {AnyValue},
+			"level":   {1, 2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := []connectionstore.LabelPair{
+		{Name: "channel", Value: "chats"},
+		{Name: "uid", Value: "42"},
+		{Name: "level", Value: 2.0},
+	}
+	if err := keys.Authorize("backend", allowed); err != nil {
+		t.Errorf("labels should be allowed but got %v", err)
+	}
+
+	tests := []struct {
+		apiKey string
+		pairs  []connectionstore.LabelPair
+		err    error
+	}{
+		{"", allowed, MissingApiKeyErr},
+		{"browser", allowed, InvalidApiKeyErr},
+		{"backend", []connectionstore.LabelPair{{Name: "channel", Value: "admin"}}, LabelNotAllowedErr},
+		{"backend", []connectionstore.LabelPair{{Name: "room", Value: "chats"}}, LabelNotAllowedErr},
+		{"backend", []connectionstore.LabelPair{{Name: "level", Value: 3}}, LabelNotAllowedErr},
+	}
+	for _, test := range tests {
+		if err := keys.Authorize(test.apiKey, test.pairs); !errors.Is(err, test.err) {
+			t.Errorf("expected %v for %q %v but got %v", test.err, test.apiKey, test.pairs, err)
+		}
+	}
+}
+
+func TestLoadPublisherKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	err := os.WriteFile(path, []byte(`{"backend": {"channel": ["chats"], "uid": ["*"]}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadPublisherKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Authorize("backend", []connectionstore.LabelPair{{Name: "channel", Value: "chats"}}); err != nil {
+		t.Error(err)
+	}
+
+	err = os.WriteFile(path, []byte(`{"backend": {"channel": [["chats"]]}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPublisherKeys(path); err == nil {
+		t.Error("invalid allowed values should be rejected")
+	}
+}
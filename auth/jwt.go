@@ -0,0 +1,209 @@
+/*
+Package auth verifies the JSON Web Tokens subscribers present and turns their claims
+into label constraints. A token may pin labels, either through its labels claim, an
+object of label names and values, or through its subject when the Verifier has a
+SubjectLabel. Every subscription made with the token only accepts messages carrying
+the pinned labels, whatever criteria the client asks for.
+
+Publishers authenticate with api keys instead, each restricted to the labels in its
+allowlist (see PublisherKeys).
+*/
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	MissingTokenErr         = errors.New("missing token")
+	MalformedTokenErr       = errors.New("malformed token")
+	UnsupportedAlgorithmErr = errors.New("unsupported token algorithm")
+	InvalidSignatureErr     = errors.New("invalid token signature")
+	ExpiredTokenErr         = errors.New("token has expired")
+	TokenNotValidYetErr     = errors.New("token is not valid yet")
+	InvalidLabelClaimErr    = errors.New("invalid labels claim")
+	InvalidPublicKeyErr     = errors.New("invalid RSA public key")
+)
+
+// Verifier checks the signature and validity of tokens. HS256 tokens are verified
+// with the HMAC secret and RS256 tokens with the RSA public key; an algorithm
+// without a key is rejected.
+type Verifier struct {
+	HmacSecret   []byte
+	RsaPublicKey *rsa.PublicKey
+	// SubjectLabel, if set, pins the label of that name to the token's subject
+	SubjectLabel string
+}
+
+// Claims are the claims of a verified token
+type Claims struct {
+	Subject   string                 `json:"sub"`
+	ExpiresAt int64                  `json:"exp"`
+	NotBefore int64                  `json:"nbf"`
+	Labels    map[string]interface{} `json:"labels"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+}
+
+// ParseRsaPublicKey parses a PEM encoded PKIX or PKCS #1 RSA public key
+func ParseRsaPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, InvalidPublicKeyErr
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, InvalidPublicKeyErr
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, InvalidPublicKeyErr
+	}
+	return rsaKey, nil
+}
+
+// Verify returns the claims of the token if its signature is valid and it has not
+// expired. The subject label, if any, is added to the labels of the claims.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	if token == "" {
+		return nil, MissingTokenErr
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, MalformedTokenErr
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, MalformedTokenErr
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, MalformedTokenErr
+	}
+	if err := v.verifySignature(h.Algorithm, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, MalformedTokenErr
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, ExpiredTokenErr
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, TokenNotValidYetErr
+	}
+
+	for name, value := range claims.Labels {
+		if _, ok := connectionstore.NormalizeLabelValue(value); !ok || name == "" {
+			return nil, InvalidLabelClaimErr
+		}
+	}
+	v.pinSubject(&claims)
+
+	return &claims, nil
+}
+
+// SubjectClaims returns the claims of a subject authenticated by other means than a
+// token, such as a verified client certificate. The subject label, if any, is pinned
+// like it is for tokens.
+func (v *Verifier) SubjectClaims(subject string) *Claims {
+	claims := &Claims{Subject: subject}
+	v.pinSubject(claims)
+	return claims
+}
+
+func (v *Verifier) pinSubject(claims *Claims) {
+	if v.SubjectLabel != "" && claims.Subject != "" {
+		if claims.Labels == nil {
+			claims.Labels = map[string]interface{}{}
+		}
+		claims.Labels[v.SubjectLabel] = claims.Subject
+	}
+}
+
+func (v *Verifier) verifySignature(algorithm string, signed string, signature []byte) error {
+	switch algorithm {
+	case "HS256":
+		if len(v.HmacSecret) == 0 {
+			return UnsupportedAlgorithmErr
+		}
+		mac := hmac.New(sha256.New, v.HmacSecret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return InvalidSignatureErr
+		}
+		return nil
+	case "RS256":
+		if v.RsaPublicKey == nil {
+			return UnsupportedAlgorithmErr
+		}
+		hash := sha256.Sum256([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(v.RsaPublicKey, crypto.SHA256, hash[:], signature); err != nil {
+			return InvalidSignatureErr
+		}
+		return nil
+	}
+	return UnsupportedAlgorithmErr
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Constrain returns the criteria with an equality criterion for every pinned label.
+// Criteria the client gave on a pinned label are replaced, so they can not widen
+// what the subscription accepts. Nil claims leave the criteria untouched.
+func (c *Claims) Constrain(criteria []connectionstore.LabelAcceptanceCriterion) []connectionstore.LabelAcceptanceCriterion {
+	if c == nil || len(c.Labels) == 0 {
+		return criteria
+	}
+
+	constrained := []connectionstore.LabelAcceptanceCriterion{}
+	for _, criterion := range criteria {
+		if _, pinned := c.Labels[criterion.LabelPair.Name]; !pinned {
+			constrained = append(constrained, criterion)
+		}
+	}
+
+	names := make([]string, 0, len(c.Labels))
+	for name := range c.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		constrained = append(constrained, connectionstore.LabelAcceptanceCriterion{
+			LabelPair: connectionstore.LabelPair{
+				Name:  name,
+				Value: c.Labels[name],
+			},
+			Operator: "==",
+		})
+	}
+	return constrained
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"testing"
+	"time"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func hs256Token(t *testing.T, secret string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rs256Token(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifier_HS256(t *testing.T) {
+	v := &Verifier{HmacSecret: []byte("secret"), SubjectLabel: "uid"}
+
+	claims, err := v.Verify(hs256Token(t, "secret", map[string]interface{}{
+		"sub":    "42",
+		"exp":    time.Now().Add(time.Minute).Unix(),
+		"labels": map[string]interface{}{"tenant": "acme"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Labels["uid"] != "42" || claims.Labels["tenant"] != "acme" {
+		t.Errorf("unexpected labels %v", claims.Labels)
+	}
+
+	if _, err := v.Verify(hs256Token(t, "other secret", map[string]interface{}{"sub": "42"})); err != InvalidSignatureErr {
+		t.Errorf("expected InvalidSignatureErr but got %v", err)
+	}
+	if _, err := v.Verify(hs256Token(t, "secret", map[string]interface{}{
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})); err != ExpiredTokenErr {
+		t.Errorf("expected ExpiredTokenErr but got %v", err)
+	}
+	if _, err := v.Verify(hs256Token(t, "secret", map[string]interface{}{
+		"nbf": time.Now().Add(time.Minute).Unix(),
+	})); err != TokenNotValidYetErr {
+		t.Errorf("expected TokenNotValidYetErr but got %v", err)
+	}
+	if _, err := v.Verify(hs256Token(t, "secret", map[string]interface{}{
+		"labels": map[string]interface{}{"tenant": []string{"acme"}},
+	})); err != InvalidLabelClaimErr {
+		t.Errorf("expected InvalidLabelClaimErr but got %v", err)
+	}
+	if _, err := v.Verify(""); err != MissingTokenErr {
+		t.Errorf("expected MissingTokenErr but got %v", err)
+	}
+	if _, err := v.Verify("not.a token"); err != MalformedTokenErr {
+		t.Errorf("expected MalformedTokenErr but got %v", err)
+	}
+}
+
+func TestVerifier_RS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ParseRsaPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Verifier{RsaPublicKey: publicKey}
+	claims, err := v.Verify(rs256Token(t, key, map[string]interface{}{"sub": "42"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" {
+		t.Errorf("expected subject 42 but got %v", claims.Subject)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(rs256Token(t, otherKey, map[string]interface{}{"sub": "42"})); err != InvalidSignatureErr {
+		t.Errorf("expected InvalidSignatureErr but got %v", err)
+	}
+
+	// an algorithm without a key is rejected, so an HS256 token can not be signed
+	// with the public key
+	if _, err := v.Verify(hs256Token(t, string(der), map[string]interface{}{"sub": "42"})); err != UnsupportedAlgorithmErr {
+		t.Errorf("expected UnsupportedAlgorithmErr but got %v", err)
+	}
+}
+
+func TestVerifier_RejectsNoneAlgorithm(t *testing.T) {
+	v := &Verifier{HmacSecret: []byte("secret")}
+	token := encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, map[string]string{"sub": "42"}) + "."
+	if _, err := v.Verify(token); err != UnsupportedAlgorithmErr {
+		t.Errorf("expected UnsupportedAlgorithmErr but got %v", err)
+	}
+}
+
+func TestClaims_Constrain(t *testing.T) {
+	claims := &Claims{Labels: map[string]interface{}{"uid": "42"}}
+	constrained := claims.Constrain([]connectionstore.LabelAcceptanceCriterion{
+		{LabelPair: connectionstore.LabelPair{Name: "uid", Value: "7"}, Operator: "=="},
+		{LabelPair: connectionstore.LabelPair{Name: "price", Value: 3}, Operator: ">="},
+	})
+
+	connection := connectionstore.NewConnection(nil, constrained)
+	accepts, _ := connection.AcceptsLabels([]connectionstore.LabelPair{{Name: "uid", Value: "42"}, {Name: "price", Value: 5}})
+	if !accepts {
+		t.Error("pinned label should be accepted")
+	}
+	accepts, _ = connection.AcceptsLabels([]connectionstore.LabelPair{{Name: "uid", Value: "7"}, {Name: "price", Value: 5}})
+	if accepts {
+		t.Error("criteria of the client on a pinned label should be replaced")
+	}
+
+	var noClaims *Claims
+	if len(noClaims.Constrain(constrained)) != len(constrained) {
+		t.Error("nil claims should leave the criteria untouched")
+	}
+}
@@ -0,0 +1,55 @@
+package Bithose
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"github.com/JonathanRosado/Bithose/auth"
+	"testing"
+)
+
+func testToken(claims string) string {
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func enableTestAuth(t *testing.T) {
+	TokenVerifier = &auth.Verifier{HmacSecret: []byte("secret"), SubjectLabel: "uid"}
+	t.Cleanup(func() {
+		TokenVerifier = nil
+	})
+}
+
+func TestAuthenticate_ClientCertificateSubject(t *testing.T) {
+	enableTestAuth(t)
+	state := &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "42"}}}},
+	}
+
+	claims, err := authenticateToken("", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" || claims.Labels["uid"] != "42" {
+		t.Errorf("expected the certificate subject to be pinned, got %+v", claims)
+	}
+
+	// a token takes precedence over the certificate
+	claims, err = authenticateToken(testToken(`{"sub":"7"}`), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Labels["uid"] != "7" {
+		t.Errorf("expected the token subject to be pinned, got %+v", claims)
+	}
+
+	if _, err := authenticateToken("", &tls.ConnectionState{}); err != auth.MissingTokenErr {
+		t.Errorf("expected MissingTokenErr without a verified certificate, got %v", err)
+	}
+}
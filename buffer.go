@@ -0,0 +1,55 @@
+package Bithose
+
+import (
+	"errors"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// MessageBufferSize is the number of messages buffered for each subscription
+	// when the client does not ask for a size
+	MessageBufferSize = 256
+
+	// MaxMessageBufferSize is the largest buffer a client may ask for
+	MaxMessageBufferSize = 4096
+
+	InvalidBufferSizeErr = errors.New("buffer_size must be a positive integer")
+
+	// bufferStats counts the messages that expired in the buffers of the
+	// subscriptions, after they left the connection store
+	bufferStats = connectionstore.NewStatistics()
+)
+
+// dropExpired returns true if the json encoded message expired while it waited in
+// the buffer of a subscription, in which case it must not be delivered
+func dropExpired(message []byte) bool {
+	return connectionstore.DropExpired(message, bufferStats)
+}
+
+// bufferSize returns the buffer size for a subscription given the size requested
+// by the client, where 0 means no preference. Requests above MaxMessageBufferSize
+// are capped.
+func bufferSize(requested int) int {
+	if requested <= 0 {
+		return MessageBufferSize
+	}
+	if requested > MaxMessageBufferSize {
+		return MaxMessageBufferSize
+	}
+	return requested
+}
+
+// queryBufferSize reads the optional buffer_size query parameter
+func queryBufferSize(request *http.Request) (int, error) {
+	rawSize := request.URL.Query().Get("buffer_size")
+	if rawSize == "" {
+		return bufferSize(0), nil
+	}
+	size, err := strconv.Atoi(rawSize)
+	if err != nil || size <= 0 {
+		return 0, InvalidBufferSizeErr
+	}
+	return bufferSize(size), nil
+}
@@ -1,66 +1,319 @@
 package client
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"github.com/JonathanRosado/Bithose"
 	"github.com/JonathanRosado/Bithose/connectionstore"
 	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Connection struct {
 	u    url.URL
 	conn *websocket.Conn
+
+	// pongTimeout is zero unless the connection watches for a dead server
+	pongTimeout time.Duration
+	stop        chan struct{}
+	stopOnce    *sync.Once
+
+	// writeMtx is held while a frame is written, and requestMtx while a request
+	// waits for its response, so that responses answer the request waiting
+	writeMtx   *sync.Mutex
+	requestMtx *sync.Mutex
+
+	// frames are read by whichever of Listen and a request waiting for its response
+	// gets to it first, and kept for the one they are for. mtx guards what follows,
+	// and read is signaled whenever a frame was read
+	mtx       *sync.Mutex
+	read      *sync.Cond
+	reading   bool
+	readErr   error
+	messages  []*connectionstore.Message
+	responses map[string][][]byte
 }
 
+// Connect connects to the server at host, either a host:port pair or a ws:// or
+// wss:// URL
 func Connect(host string) (*Connection, error) {
-	var u = url.URL{
-		Scheme: "ws",
-		Host:   host,
-		Path:   "/",
+	return ConnectWithOptions(host, Options{})
+}
+
+// ConnectWithToken connects presenting the token in the Authorization header, for
+// servers that authenticate subscribers
+func ConnectWithToken(host string, token string) (*Connection, error) {
+	return ConnectWithOptions(host, Options{Token: token})
+}
+
+// Options configure the connection made by ConnectWithOptions
+type Options struct {
+	// Token is presented in the Authorization header
+	Token string
+	// TLSConfig is used for wss:// connections, e.g. to trust a private CA or to
+	// present a client certificate. A host:port pair is dialed with wss:// when set
+	TLSConfig *tls.Config
+	// PingInterval, if set, is how often the server is pinged
+	PingInterval time.Duration
+	// PongTimeout, if set, is how long the server may go without answering a ping,
+	// pinging or sending anything before Listen fails with ErrServerNotResponding.
+	// It defaults to twice the PingInterval. The server's own pings keep the
+	// connection alive too, so a PongTimeout longer than the server's ping
+	// interval works without a PingInterval
+	PongTimeout time.Duration
+}
+
+func ConnectWithOptions(host string, options Options) (*Connection, error) {
+	u, err := connectionURL(host, options.TLSConfig != nil)
+	if err != nil {
+		return nil, err
 	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	header := http.Header{}
+	if options.Token != "" {
+		header.Set("Authorization", "Bearer "+options.Token)
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = options.TLSConfig
+
+	conn, _, err := dialer.Dial(u.String(), header)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Connection{
-		u:    u,
-		conn: conn,
-	}, nil
+	c := &Connection{
+		u:           *u,
+		conn:        conn,
+		pongTimeout: options.PongTimeout,
+		stop:        make(chan struct{}),
+		stopOnce:    &sync.Once{},
+		writeMtx:    &sync.Mutex{},
+		requestMtx:  &sync.Mutex{},
+		mtx:         &sync.Mutex{},
+		responses:   map[string][][]byte{},
+	}
+	c.read = sync.NewCond(c.mtx)
+	if c.pongTimeout == 0 {
+		c.pongTimeout = 2 * options.PingInterval
+	}
+
+	// pings are answered while Listen reads, and like pongs show the server is alive
+	conn.SetPingHandler(func(data string) error {
+		c.extendReadDeadline()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(pingWriteTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return err
+	})
+	conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+	c.extendReadDeadline()
+	if options.PingInterval > 0 {
+		go c.ping(options.PingInterval)
+	}
+
+	return c, nil
+}
+
+// pingWriteTimeout bounds the write of a ping or pong
+var pingWriteTimeout = 10 * time.Second
+
+var ErrServerNotResponding = "server is not responding"
+
+func (c *Connection) extendReadDeadline() {
+	if c.pongTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.pongTimeout))
+	}
+}
+
+func (c *Connection) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+var ErrUnsupportedScheme = "unsupported scheme, expected ws:// or wss://"
+
+func connectionURL(host string, secure bool) (*url.URL, error) {
+	if !strings.Contains(host, "://") {
+		scheme := "ws"
+		if secure {
+			scheme = "wss"
+		}
+		return &url.URL{
+			Scheme: scheme,
+			Host:   host,
+			Path:   "/",
+		}, nil
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, errors.New(ErrUnsupportedScheme)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u, nil
 }
 
 func (c *Connection) Close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
 	c.conn.Close()
 }
 
+// Listen returns the next message. Responses to subscribe, unsubscribe and publish
+// requests are returned by the requests instead. It fails with ErrServerNotResponding
+// if the connection watches for a dead server and the server went silent for too long.
 func (c *Connection) Listen() (*connectionstore.Message, error) {
-	for {
-		var message connectionstore.Message
-		err := c.conn.ReadJSON(&message)
-		if err != nil {
-			return nil, err
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var message *connectionstore.Message
+	err := c.await(func() bool {
+		if len(c.messages) == 0 {
+			return false
 		}
+		message = c.messages[0]
+		c.messages = c.messages[1:]
+		return true
+	})
+	return message, err
+}
+
+// request sends the request and decodes the response of the given type into response
+func (c *Connection) request(responseType string, request interface{}, response interface{}) error {
+	c.requestMtx.Lock()
+	defer c.requestMtx.Unlock()
 
-		// If the receive a non-message, continue
-		if message.Body == nil {
+	if err := c.write(request); err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var data []byte
+	err := c.await(func() bool {
+		responses := c.responses[responseType]
+		if len(responses) == 0 {
+			return false
+		}
+		data = responses[0]
+		c.responses[responseType] = responses[1:]
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, response)
+}
+
+func (c *Connection) write(frame interface{}) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// await reads frames until take finds the one the caller waits for, or until reading
+// fails, which it then does for every caller. Only one caller reads at a time, the
+// others wait for it to keep what it read. The mutex must be held.
+func (c *Connection) await(take func() bool) error {
+	for !take() {
+		if c.readErr != nil {
+			return c.readErr
+		}
+		if c.reading {
+			c.read.Wait()
 			continue
 		}
 
-		return &message, nil
+		// pongs are only read while reading, so the server had until now to answer
+		c.reading = true
+		c.mtx.Unlock()
+		c.extendReadDeadline()
+		_, data, err := c.conn.ReadMessage()
+		c.mtx.Lock()
+		c.reading = false
+		c.read.Broadcast()
+
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && c.pongTimeout > 0 {
+			err = errors.New(ErrServerNotResponding)
+		}
+		if err != nil {
+			c.readErr = err
+			continue
+		}
+		c.extendReadDeadline()
+		if err := c.keep(data); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// keep keeps the frame for Listen or for the request it answers. Responses carry the
+// type of their request, and messages with no body are skipped. The mutex must be held.
+func (c *Connection) keep(data []byte) error {
+	var response struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return err
+	}
+	if response.Type != "" {
+		c.responses[response.Type] = append(c.responses[response.Type], data)
+		return nil
+	}
+	var message connectionstore.Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	if message.Body != nil {
+		c.messages = append(c.messages, &message)
+	}
+	return nil
 }
 
 type Message struct {
-	conn    *websocket.Conn
-	message *connectionstore.Message
+	connection *Connection
+	message    *connectionstore.Message
+	apiKey     string
 }
 
 func (c *Connection) Message(body interface{}) *Message {
 	return &Message{
-		conn: c.conn,
+		connection: c,
 		message: &connectionstore.Message{
 			LabelPairs: []connectionstore.LabelPair{},
 			Body:       body,
@@ -76,31 +329,64 @@ func (m *Message) Label(name string, value interface{}) *Message {
 	return m
 }
 
+// ApiKey sets the api key authorizing the message on servers that restrict publishing
+func (m *Message) ApiKey(apiKey string) *Message {
+	m.apiKey = apiKey
+	return m
+}
+
+// Retain makes the message the last value of its labels, which the server delivers
+// to every new subscription that accepts it. Retaining a message with an empty body
+// clears the value
+func (m *Message) Retain() *Message {
+	m.message.Retain = true
+	return m
+}
+
+// TTL makes the server drop the message instead of delivering it once ttl passed
+// since it was published
+func (m *Message) TTL(ttl time.Duration) *Message {
+	m.message.TTL = ttl.Seconds()
+	return m
+}
+
+// ExpiresAt makes the server drop the message instead of delivering it from t on
+func (m *Message) ExpiresAt(t time.Time) *Message {
+	m.message.ExpiresAt = &t
+	return m
+}
+
+// Send publishes the message and waits for the server to confirm it, returning the
+// error the server answered with if it refused the message
 func (m *Message) Send() error {
 	message := Bithose.IncomingMessage{
 		Type:    "message",
 		Message: *m.message,
+		ApiKey:  m.apiKey,
 	}
-	jsonMessage, err := json.Marshal(message)
-	if err != nil {
+	var response Bithose.SendMessageResponse
+	if err := m.connection.request("message", message, &response); err != nil {
 		return err
 	}
-	err = m.conn.WriteMessage(websocket.TextMessage, jsonMessage)
-	if err != nil {
-		return err
+	if response.Error != "" {
+		return errors.New(response.Error)
 	}
 	return nil
 }
 
 type Subscribe struct {
-	conn     *websocket.Conn
-	criteria []connectionstore.LabelAcceptanceCriterion
+	connection *Connection
+	criteria   []connectionstore.LabelAcceptanceCriterion
+	bufferSize int
+	sinceSeq   *int64
+	sinceEpoch string
+	sinceTime  *time.Time
 }
 
 func (c *Connection) Subscribe() *Subscribe {
 	return &Subscribe{
-		conn:     c.conn,
-		criteria: []connectionstore.LabelAcceptanceCriterion{},
+		connection: c,
+		criteria:   []connectionstore.LabelAcceptanceCriterion{},
 	}
 }
 
@@ -115,28 +401,75 @@ func (s *Subscribe) Criterion(name, operator string, value interface{}) *Subscri
 	return s
 }
 
+// BufferSize asks the server to buffer up to size messages for the subscription.
+// The server caps the size at its configured maximum.
+func (s *Subscribe) BufferSize(size int) *Subscribe {
+	s.bufferSize = size
+	return s
+}
+
+// SinceSeq asks the server to first replay the messages it kept that were published
+// after the one with the given epoch and sequence number, usually the Epoch and Seq
+// of the last message received before reconnecting
+func (s *Subscribe) SinceSeq(epoch string, seq int64) *Subscribe {
+	s.sinceEpoch = epoch
+	s.sinceSeq = &seq
+	return s
+}
+
+// SinceTime asks the server to first replay the messages it kept that were published
+// at or after t
+func (s *Subscribe) SinceTime(t time.Time) *Subscribe {
+	s.sinceTime = &t
+	return s
+}
+
 var ErrUnknownOperator = "unknown operator for criterion"
 
-func (s *Subscribe) Send() error {
+// Send subscribes and waits for the server to confirm it, returning the uuid of the
+// subscription to unsubscribe with. The error is the one the server answered with if
+// it refused the subscription, such as one it can not replay the messages since
+// SinceSeq or SinceTime for.
+func (s *Subscribe) Send() (string, error) {
 	// before sending, let's make sure there are no invalid operators
 	for _, c := range s.criteria {
 		op := c.Operator
 		if op != "<" && op != "<=" && op != ">" && op != ">=" && op != "==" {
-			return errors.New(ErrUnknownOperator)
+			return "", errors.New(ErrUnknownOperator)
 		}
 	}
 
 	message := Bithose.IncomingSubscribeRequest{
-		Type:     "subscribe",
-		Criteria: s.criteria,
+		Type:       "subscribe",
+		Criteria:   s.criteria,
+		BufferSize: s.bufferSize,
+		SinceSeq:   s.sinceSeq,
+		SinceEpoch: s.sinceEpoch,
+		SinceTime:  s.sinceTime,
 	}
-	jsonMessage, err := json.Marshal(message)
-	if err != nil {
-		return err
+	var response Bithose.SubscribeResponse
+	if err := s.connection.request("subscribe", message, &response); err != nil {
+		return "", err
 	}
-	err = s.conn.WriteMessage(websocket.TextMessage, jsonMessage)
-	if err != nil {
+	if response.Error != "" {
+		return "", errors.New(response.Error)
+	}
+	return response.Uuid, nil
+}
+
+// Unsubscribe removes the subscription with the given uuid and waits for the server
+// to confirm it. Only subscriptions made on this connection can be removed.
+func (c *Connection) Unsubscribe(uuid string) error {
+	message := Bithose.IncomingUnsubscribeRequest{
+		Type: "unsubscribe",
+		Uuid: uuid,
+	}
+	var response Bithose.UnsubscribeResponse
+	if err := c.request("unsubscribe", message, &response); err != nil {
 		return err
 	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
 	return nil
 }
@@ -1,8 +1,16 @@
 package client
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/JonathanRosado/Bithose"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 )
@@ -44,7 +52,7 @@ func TestSendMessage(t *testing.T) {
 		}
 	}()
 
-	err := conn.Subscribe().
+	_, err := conn.Subscribe().
 		Criterion("channel", "==", "wowzers").
 		Criterion("bugs", "<", 1).
 		Send()
@@ -69,3 +77,198 @@ func TestSendMessage(t *testing.T) {
 		t.Error("did not received message")
 	}
 }
+
+func TestUnsubscribe(t *testing.T) {
+	c, err := Connect("localhost:9483")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	uuid, err := c.Subscribe().
+		Criterion("channel", "==", "unsubscribe_me").
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid == "" {
+		t.Fatal("expected the uuid of the subscription")
+	}
+
+	if err := c.Unsubscribe(uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	// the subscription is gone, so unsubscribing again fails
+	if err := c.Unsubscribe(uuid); err == nil || err.Error() != Bithose.SubscriptionNotFoundErr.Error() {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestConnectWithOptions_Wss(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(Bithose.WsHandler))
+	defer server.Close()
+	address := "wss://" + strings.TrimPrefix(server.URL, "https://")
+
+	// the server certificate is not trusted by default
+	if c, err := Connect(address); err == nil {
+		c.Close()
+		t.Fatal("connecting should fail without trusting the server certificate")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	c, err := ConnectWithOptions(address, Options{TLSConfig: &tls.Config{RootCAs: pool}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	uuid, err := c.Subscribe().
+		Criterion("channel", "==", "wss").
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid == "" {
+		t.Error("expected the uuid of the subscription")
+	}
+
+	if _, err := Connect("http://" + server.Listener.Addr().String()); err == nil {
+		t.Error("only ws:// and wss:// URLs should be accepted")
+	}
+}
+
+func TestConnectWithOptions_DeadServer(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	hang := make(chan struct{})
+	defer close(hang)
+
+	// the server accepts the connection and then neither reads nor writes, so pings
+	// go unanswered
+	silent := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ws, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		<-hang
+	}))
+	defer silent.Close()
+
+	c, err := ConnectWithOptions(silent.Listener.Addr().String(), Options{PingInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	if _, err := c.Listen(); err == nil || err.Error() != ErrServerNotResponding {
+		t.Errorf("expected %v, got %v", ErrServerNotResponding, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("detecting the dead server took %v", elapsed)
+	}
+}
+
+func TestConnectWithOptions_LiveServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(Bithose.WsHandler))
+	defer server.Close()
+
+	// the server answers the pings while the client waits longer than the timeout
+	c, err := ConnectWithOptions(server.Listener.Addr().String(), Options{
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// pongs are read while listening
+	go c.Listen()
+	time.Sleep(300 * time.Millisecond)
+	if err := c.Message("alive").Label("channel", "ping_test").Send(); err != nil {
+		t.Fatalf("the connection should stay alive, got %v", err)
+	}
+}
+
+func TestSubscribe_SinceSeq(t *testing.T) {
+	c, err := Connect("localhost:9483")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Subscribe().Criterion("channel", "==", "resume_me").Send(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := c.Message(i).Label("channel", "resume_me").Send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var seqs []int64
+	var epoch string
+	for len(seqs) < 3 {
+		message, err := c.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, message.Seq)
+		epoch = message.Epoch
+	}
+
+	// a client that only saw the first message resumes after it
+	resumed, err := Connect("localhost:9483")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if _, err := resumed.Subscribe().Criterion("channel", "==", "resume_me").SinceSeq(epoch, seqs[0]).Send(); err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range seqs[1:] {
+		message, err := resumed.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Seq != seq {
+			t.Fatalf("expected seq %v, got %v", seq, message.Seq)
+		}
+	}
+
+	// a replay the server can not make fails the subscription
+	if _, err := resumed.Subscribe().Criterion("channel", "==", "resume_me").SinceSeq("restarted", seqs[0]).Send(); err == nil ||
+		err.Error() != connectionstore.UnknownSequenceErr.Error() {
+		t.Errorf("expected %v, got %v", connectionstore.UnknownSequenceErr, err)
+	}
+}
+
+func TestMessage_Retain(t *testing.T) {
+	c, err := Connect("localhost:9483")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Message("online").Label("presence", "client_retain").Retain().Send(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Message(nil).Label("presence", "client_retain").Retain().Send()
+
+	subscriber, err := Connect("localhost:9483")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	if _, err := subscriber.Subscribe().Criterion("presence", "==", "client_retain").Send(); err != nil {
+		t.Fatal(err)
+	}
+	message, err := subscriber.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Body != "online" || !message.Retain {
+		t.Errorf("expected the retained message, got %+v", message)
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Package cluster lets several Bithose nodes share their subscribers. Every node runs a
+Store wrapping its local connection store. Messages published on a node are delivered
+locally and forwarded over HTTP to the peers that have a matching subscription, which
+deliver them to their own subscribers without forwarding them any further.
+
+Nodes find each other from a static peer list and periodically fetch each other's
+subscription summary: the equality label of every subscription (see
+connectionstore.Connection.EqualityLabel) and whether any subscription has no equality
+criterion at all, in which case the node wants every message.
+
+Nodes share a secret, sent as a bearer token on every request between them. The
+cluster endpoints refuse requests without it, so that only peers can deliver messages
+to the local subscribers.
+*/
+package cluster
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	UuidLib "github.com/google/uuid"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// SummaryInterval is how often the summary of every peer is fetched
+	SummaryInterval = time.Second
+
+	// ForwardQueueSize is the number of messages queued for each peer. Messages
+	// published while the queue is full are not forwarded to the peer
+	ForwardQueueSize = 1024
+
+	UnauthorizedPeerErr  = errors.New("request is not from a peer of the cluster")
+	ReplayUnsupportedErr = errors.New("resuming with since_seq or since_time is not supported in a cluster")
+)
+
+// labelKey identifies a normalized label name and value pair
+type labelKey struct {
+	name  string
+	value interface{}
+}
+
+// Summary describes the subscriptions and statistics of a node
+type Summary struct {
+	NodeId string `json:"node_id"`
+	// Labels holds the equality label of every subscription
+	Labels []connectionstore.LabelPair `json:"labels"`
+	// All is true if any subscription has no equality label, in which case
+	// every message has to be forwarded to the node
+	All   bool         `json:"all"`
+	Stats SummaryStats `json:"stats"`
+}
+
+type SummaryStats struct {
+	TotalConnections     int `json:"total_connections"`
+	TotalMessagesSent    int `json:"total_messages_sent"`
+	TotalMessagesTimeout int `json:"total_messages_timeout"`
+}
+
+// Store is a connectionstore.ConnectionStore that forwards the messages published on
+// this node to its peers.
+type Store struct {
+	local  connectionstore.ConnectionStore
+	nodeId string
+	secret string
+	peers  []*peer
+
+	mtx *sync.RWMutex
+	// subscriptions holds the equality label of every local connection, or nil for
+	// connections without one
+	subscriptions map[string]*labelKey
+
+	stop chan struct{}
+}
+
+// NewStore wraps the local store and starts exchanging summaries with the peers.
+// Peer addresses are host:port pairs or base URLs of the peers' HTTP servers. The
+// list may include this node, which recognizes itself by its node id. Every node must
+// be given the same secret, without which the cluster endpoints refuse every request.
+func NewStore(local connectionstore.ConnectionStore, peerAddresses []string, secret string) *Store {
+	s := &Store{
+		local:         local,
+		nodeId:        UuidLib.New().String(),
+		secret:        secret,
+		mtx:           &sync.RWMutex{},
+		subscriptions: map[string]*labelKey{},
+		stop:          make(chan struct{}),
+	}
+
+	for _, address := range peerAddresses {
+		p := newPeer(address, secret)
+		s.peers = append(s.peers, p)
+		go p.forward(s.stop)
+		go p.refreshSummary(s.nodeId, s.stop)
+	}
+
+	return s
+}
+
+// Close stops forwarding messages and fetching summaries
+func (s *Store) Close() {
+	close(s.stop)
+}
+
+func (s *Store) AddConnection(connection *connectionstore.Connection) (string, error) {
+	uuid, err := s.local.AddConnection(connection)
+	if err != nil {
+		return uuid, err
+	}
+
+	var key *labelKey
+	if label, ok := connection.EqualityLabel(); ok {
+		key = &labelKey{name: label.Name, value: label.Value}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.subscriptions[uuid] = key
+	return uuid, nil
+}
+
+func (s *Store) RemoveConnection(uuid string) {
+	s.local.RemoveConnection(uuid)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.subscriptions, uuid)
+}
+
+func (s *Store) GetConnection(uuid string) (connection *connectionstore.Connection, exists bool) {
+	return s.local.GetConnection(uuid)
+}
+
+// SendMessage delivers the message to the local subscribers and queues it for every
+// peer that may have a matching subscription. The returned counts are local.
+func (s *Store) SendMessage(message connectionstore.Message) (numOfSent int, numOfTimeouts int, err error) {
+	numOfSent, numOfTimeouts, err = s.local.SendMessage(message)
+
+	for _, p := range s.peers {
+		if p.wants(message) {
+			p.enqueue(message)
+		}
+	}
+
+	return numOfSent, numOfTimeouts, err
+}
+
+// Replay refuses every replay: a node only receives the messages its subscribers
+// wanted when they were published, so it can not tell what a resuming subscriber
+// missed
+func (s *Store) Replay(from connectionstore.ReplayPosition, criteria []connectionstore.LabelAcceptanceCriterion, fn func(connectionstore.Message) bool) error {
+	return ReplayUnsupportedErr
+}
+
+// Stats returns the statistics of this node plus the last counters reported by every
+// peer. Windowed statistics only cover this node.
+func (s *Store) Stats() *connectionstore.Statistics {
+	stats := connectionstore.NewStatistics()
+	stats.Add(s.local.Stats())
+	for _, p := range s.peers {
+		summary, ok := p.getSummary()
+		if !ok || summary.NodeId == s.nodeId {
+			continue
+		}
+		stats.TotalConnections += summary.Stats.TotalConnections
+		stats.TotalMessagesSent += summary.Stats.TotalMessagesSent
+		stats.TotalMessagesTimeout += summary.Stats.TotalMessagesTimeout
+	}
+	return stats
+}
+
+// Summary returns the summary of this node. Connections the local store dropped on
+// its own are pruned along the way.
+func (s *Store) Summary() Summary {
+	summary := Summary{
+		NodeId: s.nodeId,
+		Labels: []connectionstore.LabelPair{},
+	}
+
+	s.mtx.Lock()
+	seen := map[labelKey]struct{}{}
+	for uuid, key := range s.subscriptions {
+		if _, exists := s.local.GetConnection(uuid); !exists {
+			delete(s.subscriptions, uuid)
+			continue
+		}
+		if key == nil {
+			summary.All = true
+			continue
+		}
+		if _, ok := seen[*key]; ok {
+			continue
+		}
+		seen[*key] = struct{}{}
+		summary.Labels = append(summary.Labels, connectionstore.LabelPair{Name: key.name, Value: key.value})
+	}
+	s.mtx.Unlock()
+
+	localStats := connectionstore.NewStatistics()
+	localStats.Add(s.local.Stats())
+	summary.Stats = SummaryStats{
+		TotalConnections:     localStats.TotalConnections,
+		TotalMessagesSent:    localStats.TotalMessagesSent,
+		TotalMessagesTimeout: localStats.TotalMessagesTimeout,
+	}
+
+	return summary
+}
+
+// authorizePeer returns false, replying with a 401, unless the request carries the
+// cluster secret
+func (s *Store) authorizePeer(writer http.ResponseWriter, request *http.Request) bool {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if s.secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.secret)) != 1 {
+		http.Error(writer, UnauthorizedPeerErr.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// SummaryHandler serves the summary of this node to its peers
+func (s *Store) SummaryHandler(writer http.ResponseWriter, request *http.Request) {
+	if !s.authorizePeer(writer, request) {
+		return
+	}
+
+	jsonData, err := json.Marshal(s.Summary())
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsonData)
+}
+
+// MessageHandler receives a message forwarded by a peer and delivers it to the local
+// subscribers only
+func (s *Store) MessageHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizePeer(writer, request) {
+		return
+	}
+
+	var message connectionstore.Message
+	err := json.NewDecoder(request.Body).Decode(&message)
+	if err != nil {
+		http.Error(writer, "malformed payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// sequence numbers are per node, the peer's can not be resumed from here
+	message.Seq = 0
+	message.Epoch = ""
+
+	_, _, err = s.local.SendMessage(message)
+	if err != nil {
+		log.Println(err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
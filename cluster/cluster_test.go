@@ -0,0 +1,215 @@
+package cluster
+
+import (
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "s3cr3t"
+
+type testNode struct {
+	store  *Store
+	server *httptest.Server
+}
+
+// startNodes starts n nodes on localhost, every one of them with all the nodes,
+// itself included, as peers
+func startNodes(t *testing.T, n int) []*testNode {
+	SummaryInterval = 10 * time.Millisecond
+
+	// the listeners are created first, so that every node knows the addresses
+	// of all the nodes before any of them serves a request
+	nodes := make([]*testNode, n)
+	var addresses []string
+	for i := range nodes {
+		nodes[i] = &testNode{server: httptest.NewUnstartedServer(nil)}
+		addresses = append(addresses, nodes[i].server.Listener.Addr().String())
+	}
+	for _, node := range nodes {
+		node.store = NewStore(connectionstore.NewShardedStore(1), addresses, testSecret)
+		mux := http.NewServeMux()
+		mux.HandleFunc(SummaryPath, node.store.SummaryHandler)
+		mux.HandleFunc(MessagePath, node.store.MessageHandler)
+		node.server.Config.Handler = mux
+		node.server.Start()
+	}
+
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.store.Close()
+			node.server.Close()
+		}
+	})
+	return nodes
+}
+
+func channelCriteria(channel string) []connectionstore.LabelAcceptanceCriterion {
+	return []connectionstore.LabelAcceptanceCriterion{
+		{
+			LabelPair: connectionstore.LabelPair{Name: "channel", Value: channel},
+			Operator:  "==",
+		},
+	}
+}
+
+// waitFor polls the condition until it holds or a second passes
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the cluster")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// summariesFetched returns true once every node knows the summary of every peer and
+// the summaries list the given number of subscriptions on the cluster
+func summariesFetched(nodes []*testNode, connections int) func() bool {
+	return func() bool {
+		for _, node := range nodes {
+			if node.store.Stats().TotalConnections != connections {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestStore_ForwardsToMatchingPeers(t *testing.T) {
+	nodes := startNodes(t, 3)
+
+	chA := make(chan []byte, 10)
+	nodes[1].store.AddConnection(connectionstore.NewConnection(chA, channelCriteria("a")))
+	chB := make(chan []byte, 10)
+	nodes[2].store.AddConnection(connectionstore.NewConnection(chB, channelCriteria("b")))
+	waitFor(t, summariesFetched(nodes, 2))
+
+	_, _, err := nodes[0].store.SendMessage(connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "a"}},
+		Timestamp:  time.Now(),
+		Body:       "hello there",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-chA:
+	case <-time.After(time.Second):
+		t.Fatal("message should be forwarded to the peer subscribed to it")
+	}
+
+	if nodes[0].store.peers[2].wants(connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "a"}},
+	}) {
+		t.Error("message should not be forwarded to a peer without a matching subscription")
+	}
+	select {
+	case <-chB:
+		t.Error("message should not be delivered to a non matching subscription")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStore_DoesNotForwardToItself(t *testing.T) {
+	nodes := startNodes(t, 2)
+
+	ch := make(chan []byte, 10)
+	nodes[0].store.AddConnection(connectionstore.NewConnection(ch, nil))
+	waitFor(t, summariesFetched(nodes, 1))
+
+	numOfSent, _, err := nodes[0].store.SendMessage(connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "a"}},
+		Timestamp:  time.Now(),
+		Body:       "hello there",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numOfSent != 1 {
+		t.Errorf("numOfSent should be 1 but got %d", numOfSent)
+	}
+
+	<-ch
+	select {
+	case <-ch:
+		t.Error("message should be delivered only once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStore_ClusterWideStats(t *testing.T) {
+	nodes := startNodes(t, 3)
+
+	for i, node := range nodes {
+		for j := 0; j <= i; j++ {
+			node.store.AddConnection(connectionstore.NewConnection(make(chan []byte, 10), channelCriteria("a")))
+		}
+	}
+	waitFor(t, summariesFetched(nodes, 6))
+
+	uuid, _ := nodes[0].store.AddConnection(connectionstore.NewConnection(make(chan []byte, 10), nil))
+	if got := nodes[0].store.Stats().TotalConnections; got != 7 {
+		t.Errorf("local connections should be counted right away, expected 7 but got %d", got)
+	}
+	waitFor(t, summariesFetched(nodes, 7))
+
+	nodes[0].store.RemoveConnection(uuid)
+	waitFor(t, summariesFetched(nodes, 6))
+}
+
+func TestStore_RefusesRequestsWithoutTheSecret(t *testing.T) {
+	nodes := startNodes(t, 1)
+
+	ch := make(chan []byte, 10)
+	nodes[0].store.AddConnection(connectionstore.NewConnection(ch, nil))
+
+	body := `{"label_pairs":[{"name":"channel","value":"a"}],"body":"spoofed"}`
+	for _, token := range []string{"", "Bearer wrong"} {
+		request, _ := http.NewRequest("POST", nodes[0].server.URL+MessagePath, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			request.Header.Set("Authorization", token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("message with authorization %q should get a 401 but got %d", token, response.StatusCode)
+		}
+
+		request, _ = http.NewRequest("GET", nodes[0].server.URL+SummaryPath, nil)
+		if token != "" {
+			request.Header.Set("Authorization", token)
+		}
+		response, err = http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("summary with authorization %q should get a 401 but got %d", token, response.StatusCode)
+		}
+	}
+
+	select {
+	case <-ch:
+		t.Error("message without the secret should not be delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStore_RefusesReplay(t *testing.T) {
+	nodes := startNodes(t, 1)
+	err := nodes[0].store.Replay(connectionstore.ReplayPosition{Time: time.Now()}, nil, nil)
+	if err != ReplayUnsupportedErr {
+		t.Errorf("expected ReplayUnsupportedErr, got %v", err)
+	}
+}
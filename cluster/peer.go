@@ -0,0 +1,195 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SummaryPath = "/cluster/summary"
+	MessagePath = "/cluster/message"
+)
+
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+// peer is another node of the cluster. Its summary is refreshed every SummaryInterval
+// and the messages it wants are forwarded to it by a single goroutine, in order.
+type peer struct {
+	url string
+	// secret authenticates this node to the peer
+	secret string
+
+	mtx     *sync.RWMutex
+	summary *Summary
+	labels  map[labelKey]struct{}
+
+	messages chan connectionstore.Message
+}
+
+func newPeer(address string, secret string) *peer {
+	url := strings.TrimSpace(address)
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	return &peer{
+		url:      strings.TrimSuffix(url, "/"),
+		secret:   secret,
+		mtx:      &sync.RWMutex{},
+		messages: make(chan connectionstore.Message, ForwardQueueSize),
+	}
+}
+
+// wants returns true if the peer may have a subscription accepting the message. Nothing
+// is wanted until the first summary of the peer is fetched, since the peer may turn
+// out to be this node.
+func (p *peer) wants(message connectionstore.Message) bool {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if p.summary == nil {
+		return false
+	}
+	if p.summary.All {
+		return true
+	}
+	for _, pair := range message.LabelPairs {
+		value, ok := connectionstore.NormalizeLabelValue(pair.Value)
+		if !ok {
+			continue
+		}
+		if _, ok := p.labels[labelKey{name: pair.Name, value: value}]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue drops the message if the peer's queue is full
+func (p *peer) enqueue(message connectionstore.Message) {
+	select {
+	case p.messages <- message:
+	default:
+		log.Println("cluster: forward queue of", p.url, "is full, dropping message")
+	}
+}
+
+func (p *peer) forward(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case message := <-p.messages:
+			if err := p.send(message); err != nil {
+				log.Println("cluster:", err)
+			}
+		}
+	}
+}
+
+func (p *peer) send(message connectionstore.Message) error {
+	jsonMsg, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", p.url+MessagePath, bytes.NewReader(jsonMsg))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := p.do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("forwarding to %s failed with status %d", p.url, response.StatusCode)
+	}
+	return nil
+}
+
+func (p *peer) refreshSummary(nodeId string, stop chan struct{}) {
+	ticker := time.NewTicker(SummaryInterval)
+	defer ticker.Stop()
+
+	for {
+		summary, err := p.fetchSummary()
+		if err != nil {
+			log.Println("cluster:", err)
+		} else {
+			p.setSummary(nodeId, summary)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *peer) fetchSummary() (*Summary, error) {
+	request, err := http.NewRequest("GET", p.url+SummaryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := p.do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the summary of %s failed with status %d", p.url, response.StatusCode)
+	}
+
+	var summary Summary
+	if err := json.NewDecoder(response.Body).Decode(&summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// setSummary stores the summary of the peer. A peer that turns out to be this node
+// is given an empty summary so that nothing is forwarded to it.
+func (p *peer) setSummary(nodeId string, summary *Summary) {
+	labels := map[labelKey]struct{}{}
+	if summary.NodeId == nodeId {
+		summary.Labels = nil
+		summary.All = false
+	}
+	for _, pair := range summary.Labels {
+		if value, ok := connectionstore.NormalizeLabelValue(pair.Value); ok {
+			labels[labelKey{name: pair.Name, value: value}] = struct{}{}
+		}
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.summary = summary
+	p.labels = labels
+}
+
+func (p *peer) getSummary() (Summary, bool) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if p.summary == nil {
+		return Summary{}, false
+	}
+	return *p.summary, true
+}
+
+// do sends the request with the cluster secret
+func (p *peer) do(request *http.Request) (*http.Response, error) {
+	request.Header.Set("Authorization", "Bearer "+p.secret)
+	return httpClient.Do(request)
+}
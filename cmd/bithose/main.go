@@ -1,23 +1,230 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"github.com/JonathanRosado/Bithose"
+	"github.com/JonathanRosado/Bithose/auth"
+	"github.com/JonathanRosado/Bithose/cluster"
+	"github.com/JonathanRosado/Bithose/config"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"github.com/JonathanRosado/Bithose/messagelog"
+	"github.com/JonathanRosado/Bithose/redisstore"
+	"github.com/JonathanRosado/Bithose/rpc"
+	"github.com/JonathanRosado/Bithose/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
-var (
-	hostname string
-)
+func main() {
+	cfg, options, err := config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-func init() {
-	flag.StringVar(&hostname, "hostname", ":9483", "hostname for the bithose server to "+
-		"run on [:9483]")
-}
+	if options.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg.Apply()
+
+	if cfg.Auth.JwtSecret != "" || cfg.Auth.JwtPublicKey != "" {
+		verifier := &auth.Verifier{
+			HmacSecret:   []byte(cfg.Auth.JwtSecret),
+			SubjectLabel: cfg.Auth.JwtSubjectLabel,
+		}
+		if cfg.Auth.JwtPublicKey != "" {
+			data, err := os.ReadFile(cfg.Auth.JwtPublicKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			verifier.RsaPublicKey, err = auth.ParseRsaPublicKey(data)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		Bithose.TokenVerifier = verifier
+	}
+
+	if cfg.Auth.PublisherKeys != "" {
+		keys, err := auth.LoadPublisherKeys(cfg.Auth.PublisherKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		Bithose.PublisherKeys = keys
+	}
+
+	// stores sharing messages with other instances are closed on shutdown
+	var closeStore func()
+
+	var localStore connectionstore.ConnectionStore
+	switch cfg.Store.Type {
+	case "map":
+		localStore = connectionstore.GetMapStore()
+	case "sharded":
+		localStore = connectionstore.NewShardedStore(cfg.Store.Shards)
+	}
+
+	// messages are numbered and kept for resuming subscribers by the message log, or
+	// else in memory. History is kept by the local store so that messages from other
+	// instances are numbered too. The message log is closed last, once nothing is
+	// published anymore
+	var messageLog *messagelog.Log
+	if cfg.Log.Dir != "" {
+		messageLog, err = messagelog.Open(cfg.Log.Dir, cfg.LogOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("logging messages to %s from offset %d", cfg.Log.Dir, messageLog.NextOffset())
+		localStore = messagelog.NewStore(localStore, messageLog)
+	} else if cfg.Store.HistorySize > 0 && len(cfg.Cluster.Peers) == 0 {
+		// cluster nodes do not receive every message, so they keep no history
+		localStore = connectionstore.NewHistoryStore(localStore, cfg.Store.HistorySize)
+	}
+
+	var store connectionstore.ConnectionStore
+	if cfg.Redis.Address != "" {
+		redisStore := redisstore.NewStore(localStore, cfg.Redis.Address, cfg.Redis.Channel)
+		closeStore = redisStore.Close
+		store = redisStore
+	} else if len(cfg.Cluster.Peers) > 0 {
+		clusterStore := cluster.NewStore(localStore, cfg.Cluster.Peers, cfg.Cluster.Secret)
+		http.HandleFunc(cluster.SummaryPath, clusterStore.SummaryHandler)
+		http.HandleFunc(cluster.MessagePath, clusterStore.MessageHandler)
+		closeStore = clusterStore.Close
+		store = clusterStore
+	} else {
+		store = localStore
+	}
+
+	connectionstore.SetStore(store)
 
-func main() {
 	http.HandleFunc("/", Bithose.WsHandler)
 	http.HandleFunc("/stats", Bithose.StatsHandler)
-	log.Fatal(http.ListenAndServe(hostname, nil))
+	http.HandleFunc("/metrics", Bithose.MetricsHandler)
+	http.HandleFunc("/publish", Bithose.PublishHandler)
+	http.HandleFunc("/events", Bithose.SseHandler)
+	http.HandleFunc("/poll", Bithose.PollHandler)
+
+	var tlsConfig *tls.Config
+	if cfg.Tls.Cert != "" {
+		reloader, err := tlsconfig.NewCertReloader(cfg.Tls.Cert, cfg.Tls.Key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig, err = tlsconfig.ServerConfig(reloader, cfg.Tls.ClientCA, cfg.Tls.RequireClientCert)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serveErr := make(chan error, 2)
+
+	var rpcServer *grpc.Server
+	if cfg.Listen.Rpc != "" {
+		listener, err := net.Listen("tcp", cfg.Listen.Rpc)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var options []grpc.ServerOption
+		if tlsConfig != nil {
+			options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		rpcServer = grpc.NewServer(options...)
+		rpc.RegisterBithoseServer(rpcServer, Bithose.NewRpcServer())
+		go func() {
+			serveErr <- rpcServer.Serve(listener)
+		}()
+	}
+
+	server := &http.Server{
+		Addr:      cfg.Listen.Http,
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		if tlsConfig != nil {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	// a second signal kills the server
+	stop()
+
+	log.Println("shutting down, draining connections for up to", time.Duration(cfg.Shutdown.Timeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Shutdown.Timeout))
+	defer cancel()
+	shutdown(shutdownCtx, server, rpcServer)
+	if closeStore != nil {
+		closeStore()
+	}
+	if messageLog != nil {
+		if err := messageLog.Close(); err != nil {
+			log.Println("message log:", err)
+		}
+	}
+	log.Println("shut down")
+}
+
+// shutdown stops the listeners and drains the connections, closing whatever is left
+// once ctx is done
+func shutdown(ctx context.Context, server *http.Server, rpcServer *grpc.Server) {
+	wg := &sync.WaitGroup{}
+
+	// the http server waits for the event streams and polls, which end once drained
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("http server:", err)
+			server.Close()
+		}
+	}()
+
+	if rpcServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				rpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				log.Println("gRPC server:", ctx.Err())
+				rpcServer.Stop()
+			}
+		}()
+	}
+
+	if err := Bithose.Shutdown(ctx); err != nil {
+		log.Println("websockets:", err)
+	}
+	wg.Wait()
 }
@@ -12,6 +12,9 @@ func main() {
 	go func() {
 		http.HandleFunc("/", Bithose.WsHandler)
 		http.HandleFunc("/stats", Bithose.StatsHandler)
+		http.HandleFunc("/publish", Bithose.PublishHandler)
+		http.HandleFunc("/events", Bithose.SseHandler)
+		http.HandleFunc("/poll", Bithose.PollHandler)
 		log.Fatal(http.ListenAndServe(":80", nil))
 	}()
 
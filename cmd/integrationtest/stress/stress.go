@@ -163,6 +163,6 @@ func Run() {
 
 	fmt.Printf("\nTotal messages sent: %v", ta.totalMessagesSent)
 	fmt.Printf("\nTotal messages received: %v", ta.totalMessagesReceived)
-	fmt.Printf("\nMiss rate: %e%", (ta.totalMessagesReceived/ta.totalMessagesSent)*100)
+	fmt.Printf("\nMiss rate: %e%%", (float64(ta.totalMessagesReceived)/float64(ta.totalMessagesSent))*100)
 	fmt.Printf("\nAverage delay in msg receive: %fs", (float64(ta.totalDelayInReceived)/float64(ta.totalMessagesReceived))*100)
 }
@@ -0,0 +1,241 @@
+/*
+Package config holds the configuration of the bithose server. The effective
+configuration is built from, in increasing order of precedence, the defaults, a YAML
+or TOML file, BITHOSE_* environment variables and command line flags.
+
+Every setting has a key in the file (e.g. store.send_timeout), an environment variable
+made of the upper-cased key (BITHOSE_STORE_SEND_TIMEOUT) and, for most settings, a flag.
+Lists are comma separated in environment variables and flags, durations use Go's
+duration syntax (100ms, 1m30s).
+*/
+package config
+
+import (
+	"github.com/JonathanRosado/Bithose"
+	"github.com/JonathanRosado/Bithose/cluster"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"github.com/JonathanRosado/Bithose/messagelog"
+	"github.com/JonathanRosado/Bithose/redisstore"
+	"runtime"
+	"time"
+)
+
+// Duration is a time.Duration written as a duration string in config files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+type Config struct {
+	Listen   Listen   `yaml:"listen" toml:"listen"`
+	Store    Store    `yaml:"store" toml:"store"`
+	Buffers  Buffers  `yaml:"buffers" toml:"buffers"`
+	Ws       Ws       `yaml:"websocket" toml:"websocket"`
+	Sse      Sse      `yaml:"sse" toml:"sse"`
+	Poll     Poll     `yaml:"poll" toml:"poll"`
+	Cluster  Cluster  `yaml:"cluster" toml:"cluster"`
+	Redis    Redis    `yaml:"redis" toml:"redis"`
+	Auth     Auth     `yaml:"auth" toml:"auth"`
+	Cors     Cors     `yaml:"cors" toml:"cors"`
+	Tls      Tls      `yaml:"tls" toml:"tls"`
+	Shutdown Shutdown `yaml:"shutdown" toml:"shutdown"`
+	Log      Log      `yaml:"log" toml:"log"`
+}
+
+type Listen struct {
+	Http string `yaml:"http" toml:"http" flag:"hostname" usage:"hostname for the bithose server to run on"`
+	Rpc  string `yaml:"rpc" toml:"rpc" flag:"rpc-hostname" usage:"hostname for the bithose gRPC server to run on, empty to disable"`
+}
+
+type Store struct {
+	Type        string   `yaml:"type" toml:"type" flag:"store" usage:"connection store to use, either map or sharded"`
+	Shards      int      `yaml:"shards" toml:"shards" flag:"shards" usage:"number of shards of the sharded connection store"`
+	SendTimeout Duration `yaml:"send_timeout" toml:"send_timeout" flag:"send-timeout" usage:"how long a subscriber may take to accept a message before it is dropped"`
+	QueueSize   int      `yaml:"queue_size" toml:"queue_size" flag:"queue-size" usage:"number of messages queued for each subscriber by the connection store"`
+	MaxRetained int      `yaml:"max_retained" toml:"max_retained" flag:"max-retained" usage:"number of label sets a retained message is kept for, the least recently updated is evicted past it"`
+	MaxTtl      Duration `yaml:"max_ttl" toml:"max_ttl" flag:"max-ttl" usage:"longest ttl a publisher may give a message"`
+	HistorySize int      `yaml:"history_size" toml:"history_size" flag:"history-size" optional:"true" usage:"number of recent messages kept in memory for subscribers resuming with since_seq or since_time when there is no message log, 0 to keep none. Cluster nodes keep none"`
+}
+
+type Buffers struct {
+	Default        int `yaml:"default" toml:"default" flag:"buffer-size" usage:"number of messages buffered for each subscription when the client does not ask for a size"`
+	Max            int `yaml:"max" toml:"max" flag:"max-buffer-size" usage:"largest buffer size a client may ask for"`
+	WebsocketRead  int `yaml:"websocket_read" toml:"websocket_read" usage:"read buffer size of websocket connections in bytes"`
+	WebsocketWrite int `yaml:"websocket_write" toml:"websocket_write" usage:"write buffer size of websocket connections in bytes"`
+}
+
+type Ws struct {
+	PingInterval Duration `yaml:"ping_interval" toml:"ping_interval" flag:"ws-ping-interval" usage:"how often websockets are pinged"`
+	PongTimeout  Duration `yaml:"pong_timeout" toml:"pong_timeout" flag:"ws-pong-timeout" usage:"how long a websocket may go without answering a ping before its subscriptions are removed"`
+}
+
+type Sse struct {
+	HeartbeatInterval Duration `yaml:"heartbeat_interval" toml:"heartbeat_interval" usage:"how often idle event streams get a heartbeat comment"`
+}
+
+type Poll struct {
+	Timeout            Duration `yaml:"timeout" toml:"timeout" usage:"longest time a poll waits for messages"`
+	SessionIdleTimeout Duration `yaml:"session_idle_timeout" toml:"session_idle_timeout" usage:"how long a poll session lives without being polled"`
+}
+
+type Cluster struct {
+	Peers            []string `yaml:"peers" toml:"peers" flag:"cluster-peers" usage:"addresses of the nodes of the cluster, as host:port or URL"`
+	Secret           string   `yaml:"secret" toml:"secret" flag:"cluster-secret" secret:"true" usage:"secret shared by the nodes of the cluster, required by the cluster endpoints"`
+	SummaryInterval  Duration `yaml:"summary_interval" toml:"summary_interval" usage:"how often the subscriptions of the peers are fetched"`
+	ForwardQueueSize int      `yaml:"forward_queue_size" toml:"forward_queue_size" usage:"number of messages queued for each peer"`
+}
+
+type Redis struct {
+	Address           string   `yaml:"address" toml:"address" flag:"redis-address" usage:"host:port of a Redis server used to share messages with other instances"`
+	Channel           string   `yaml:"channel" toml:"channel" flag:"redis-channel" usage:"Redis channel messages are shared on"`
+	ReconnectInterval Duration `yaml:"reconnect_interval" toml:"reconnect_interval" usage:"how long to wait before connecting to Redis again"`
+}
+
+type Auth struct {
+	JwtSecret       string `yaml:"jwt_secret" toml:"jwt_secret" flag:"jwt-secret" secret:"true" usage:"secret verifying HS256 tokens. Subscribers must present a valid token once a secret or public key is set"`
+	JwtPublicKey    string `yaml:"jwt_public_key" toml:"jwt_public_key" flag:"jwt-public-key" usage:"PEM file of the RSA public key verifying RS256 tokens"`
+	JwtSubjectLabel string `yaml:"jwt_subject_label" toml:"jwt_subject_label" flag:"jwt-subject-label" usage:"label pinned to the subject of the token"`
+	PublisherKeys   string `yaml:"publisher_keys" toml:"publisher_keys" flag:"publisher-keys" usage:"JSON file of the api keys allowed to publish and the labels each may publish"`
+}
+
+type Cors struct {
+	AllowedOrigins   []string `yaml:"allowed_origins" toml:"allowed_origins" flag:"allowed-origins" usage:"origins allowed to connect, exact (https://example.com), wildcard subdomain (https://*.example.com) or *"`
+	AllowedMethods   []string `yaml:"allowed_methods" toml:"allowed_methods" flag:"allowed-methods" usage:"methods allowed by CORS"`
+	AllowedHeaders   []string `yaml:"allowed_headers" toml:"allowed_headers" flag:"allowed-headers" usage:"headers allowed by CORS"`
+	AllowCredentials bool     `yaml:"allow_credentials" toml:"allow_credentials" flag:"allow-credentials" usage:"allow credentialed CORS requests"`
+}
+
+type Tls struct {
+	Cert              string `yaml:"cert" toml:"cert" flag:"tls-cert" usage:"PEM certificate file, serves https/wss and gRPC over TLS together with the key. The files are reloaded when they change"`
+	Key               string `yaml:"key" toml:"key" flag:"tls-key" usage:"PEM private key file of the certificate"`
+	ClientCA          string `yaml:"client_ca" toml:"client_ca" flag:"tls-client-ca" usage:"PEM file of the CAs verifying client certificates"`
+	RequireClientCert bool   `yaml:"require_client_cert" toml:"require_client_cert" flag:"tls-require-client-cert" usage:"refuse clients without a certificate when a client CA is set"`
+}
+
+type Shutdown struct {
+	Timeout Duration `yaml:"timeout" toml:"timeout" flag:"shutdown-timeout" usage:"how long connections are given to drain on SIGTERM before they are closed"`
+}
+
+type Log struct {
+	Dir          string   `yaml:"dir" toml:"dir" flag:"log-dir" usage:"directory of the on-disk log of published messages, empty to disable"`
+	Sync         string   `yaml:"sync" toml:"sync" flag:"log-sync" usage:"when the message log is flushed to disk, either always, interval or never"`
+	SyncInterval Duration `yaml:"sync_interval" toml:"sync_interval" usage:"how often the message log is flushed with the interval sync policy"`
+	SegmentSize  int      `yaml:"segment_size" toml:"segment_size" usage:"size in bytes of the segment files of the message log"`
+	MaxBytes     int      `yaml:"max_bytes" toml:"max_bytes" optional:"true" usage:"size in bytes past which the oldest messages are removed from the log, 0 keeps them"`
+	MaxAge       Duration `yaml:"max_age" toml:"max_age" flag:"log-max-age" optional:"true" usage:"age past which messages are removed from the log, 0 keeps them"`
+}
+
+// LogOptions returns the options the message log is opened with
+func (c *Config) LogOptions() messagelog.Options {
+	return messagelog.Options{
+		SegmentSize:  int64(c.Log.SegmentSize),
+		Sync:         messagelog.SyncPolicy(c.Log.Sync),
+		SyncInterval: time.Duration(c.Log.SyncInterval),
+		MaxBytes:     int64(c.Log.MaxBytes),
+		MaxAge:       time.Duration(c.Log.MaxAge),
+	}
+}
+
+// Default returns the configuration used when nothing is set, which are the defaults
+// of the packages it configures
+func Default() *Config {
+	return &Config{
+		Listen: Listen{
+			Http: ":9483",
+			Rpc:  ":9484",
+		},
+		Store: Store{
+			Type:        "map",
+			Shards:      runtime.NumCPU(),
+			SendTimeout: Duration(connectionstore.SendTimeout),
+			QueueSize:   connectionstore.QueueSize,
+			MaxRetained: connectionstore.MaxRetainedMessages,
+			MaxTtl:      Duration(connectionstore.MaxTTL),
+			HistorySize: connectionstore.HistorySize,
+		},
+		Buffers: Buffers{
+			Default:        Bithose.MessageBufferSize,
+			Max:            Bithose.MaxMessageBufferSize,
+			WebsocketRead:  Bithose.Upgrader.ReadBufferSize,
+			WebsocketWrite: Bithose.Upgrader.WriteBufferSize,
+		},
+		Ws: Ws{
+			PingInterval: Duration(Bithose.WsPingInterval),
+			PongTimeout:  Duration(Bithose.WsPongTimeout),
+		},
+		Sse: Sse{
+			HeartbeatInterval: Duration(Bithose.SseHeartbeatInterval),
+		},
+		Poll: Poll{
+			Timeout:            Duration(Bithose.PollTimeout),
+			SessionIdleTimeout: Duration(Bithose.PollSessionIdleTimeout),
+		},
+		Cluster: Cluster{
+			SummaryInterval:  Duration(cluster.SummaryInterval),
+			ForwardQueueSize: cluster.ForwardQueueSize,
+		},
+		Redis: Redis{
+			Channel:           redisstore.DefaultChannel,
+			ReconnectInterval: Duration(redisstore.ReconnectInterval),
+		},
+		Cors: Cors{
+			AllowedOrigins:   append([]string{}, Bithose.Cors.AllowedOrigins...),
+			AllowedMethods:   append([]string{}, Bithose.Cors.AllowedMethods...),
+			AllowedHeaders:   append([]string{}, Bithose.Cors.AllowedHeaders...),
+			AllowCredentials: Bithose.Cors.AllowCredentials,
+		},
+		Tls: Tls{
+			RequireClientCert: true,
+		},
+		Shutdown: Shutdown{
+			Timeout: Duration(30 * time.Second),
+		},
+		Log: Log{
+			Sync:         string(messagelog.SyncInterval),
+			SyncInterval: Duration(messagelog.DefaultSyncInterval),
+			SegmentSize:  int(messagelog.SegmentSize),
+		},
+	}
+}
+
+// Apply sets the package level settings of the server packages. Settings that need
+// wiring, such as the store, listeners, auth and TLS, are left to the caller.
+func (c *Config) Apply() {
+	connectionstore.SendTimeout = time.Duration(c.Store.SendTimeout)
+	connectionstore.QueueSize = c.Store.QueueSize
+	connectionstore.MaxRetainedMessages = c.Store.MaxRetained
+	connectionstore.MaxTTL = time.Duration(c.Store.MaxTtl)
+	connectionstore.HistorySize = c.Store.HistorySize
+
+	Bithose.MessageBufferSize = c.Buffers.Default
+	Bithose.MaxMessageBufferSize = c.Buffers.Max
+	Bithose.Upgrader.ReadBufferSize = c.Buffers.WebsocketRead
+	Bithose.Upgrader.WriteBufferSize = c.Buffers.WebsocketWrite
+
+	Bithose.WsPingInterval = time.Duration(c.Ws.PingInterval)
+	Bithose.WsPongTimeout = time.Duration(c.Ws.PongTimeout)
+	Bithose.SseHeartbeatInterval = time.Duration(c.Sse.HeartbeatInterval)
+	Bithose.PollTimeout = time.Duration(c.Poll.Timeout)
+	Bithose.PollSessionIdleTimeout = time.Duration(c.Poll.SessionIdleTimeout)
+
+	cluster.SummaryInterval = time.Duration(c.Cluster.SummaryInterval)
+	cluster.ForwardQueueSize = c.Cluster.ForwardQueueSize
+	redisstore.ReconnectInterval = time.Duration(c.Redis.ReconnectInterval)
+
+	Bithose.Cors = &Bithose.CorsPolicy{
+		AllowedOrigins:   c.Cors.AllowedOrigins,
+		AllowedMethods:   c.Cors.AllowedMethods,
+		AllowedHeaders:   c.Cors.AllowedHeaders,
+		AllowCredentials: c.Cors.AllowCredentials,
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeFile(t, "bithose.yaml", `
+listen:
+  http: ":1000"
+  rpc: ":1001"
+store:
+  type: sharded
+  shards: 2
+  send_timeout: 250ms
+cluster:
+  peers: [a:1, b:2]
+  secret: s3cr3t
+`)
+
+	config, _, err := Load("bithose", []string{"-config", path, "-shards", "4"}, env(map[string]string{
+		"BITHOSE_LISTEN_RPC":   ":2001",
+		"BITHOSE_STORE_SHARDS": "3",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Listen.Http != ":1000" {
+		t.Errorf("file should override the default, got %v", config.Listen.Http)
+	}
+	if config.Listen.Rpc != ":2001" {
+		t.Errorf("environment should override the file, got %v", config.Listen.Rpc)
+	}
+	if config.Store.Shards != 4 {
+		t.Errorf("flags should override the environment, got %v", config.Store.Shards)
+	}
+	if time.Duration(config.Store.SendTimeout) != 250*time.Millisecond {
+		t.Errorf("expected a 250ms send timeout, got %v", time.Duration(config.Store.SendTimeout))
+	}
+	if len(config.Cluster.Peers) != 2 || config.Cluster.Peers[1] != "b:2" {
+		t.Errorf("unexpected peers %v", config.Cluster.Peers)
+	}
+	if config.Buffers.Default != Default().Buffers.Default {
+		t.Errorf("unset settings should keep their default, got %v", config.Buffers.Default)
+	}
+}
+
+func TestLoad_Toml(t *testing.T) {
+	path := writeFile(t, "bithose.toml", `
+[store]
+type = "sharded"
+send_timeout = "1s"
+
+[cors]
+allowed_origins = ["https://*.example.com"]
+`)
+
+	config, _, err := Load("bithose", nil, env(map[string]string{"BITHOSE_CONFIG": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Store.Type != "sharded" || time.Duration(config.Store.SendTimeout) != time.Second {
+		t.Errorf("unexpected store %+v", config.Store)
+	}
+	if len(config.Cors.AllowedOrigins) != 1 || config.Cors.AllowedOrigins[0] != "https://*.example.com" {
+		t.Errorf("unexpected origins %v", config.Cors.AllowedOrigins)
+	}
+}
+
+func TestLoad_UnknownKeys(t *testing.T) {
+	for _, path := range []string{
+		writeFile(t, "bithose.yaml", "store:\n  shard: 2\n"),
+		writeFile(t, "bithose.toml", "[store]\nshard = 2\n"),
+	} {
+		if _, _, err := Load("bithose", []string{"-config", path}, env(nil)); err == nil || !strings.Contains(err.Error(), "shard") {
+			t.Errorf("expected an error naming the unknown key for %v, got %v", path, err)
+		}
+	}
+
+	if _, _, err := Load("bithose", []string{"-config", writeFile(t, "bithose.ini", "")}, env(nil)); err != UnknownFormatErr {
+		t.Errorf("expected UnknownFormatErr, got %v", err)
+	}
+}
+
+func TestLoad_Validation(t *testing.T) {
+	_, _, err := Load("bithose", []string{"-store", "list", "-buffer-size", "5000", "-tls-cert", "cert.pem", "-log-sync", "sometimes"},
+		env(map[string]string{"BITHOSE_POLL_TIMEOUT": "0s", "BITHOSE_LOG_SEGMENT_SIZE": "0"}))
+	validationErr, ok := err.(ValidationErr)
+	if !ok {
+		t.Fatalf("expected a ValidationErr, got %v", err)
+	}
+
+	for _, key := range []string{"store.type", "buffers.max", "poll.timeout", "tls.cert", "tls:", "log.sync", "log.segment_size"} {
+		found := false
+		for _, problem := range validationErr {
+			found = found || strings.HasPrefix(problem, key)
+		}
+		if !found {
+			t.Errorf("expected a problem with %v in %v", key, validationErr)
+		}
+	}
+
+	// optional settings may be zero
+	if _, _, err := Load("bithose", []string{"-log-max-age", "0s"}, env(map[string]string{"BITHOSE_LOG_MAX_BYTES": "0"})); err != nil {
+		t.Errorf("expected zero optional settings to be valid, got %v", err)
+	}
+
+	if _, _, err := Load("bithose", nil, env(map[string]string{"BITHOSE_STORE_SHARDS": "many"})); err == nil ||
+		!strings.Contains(err.Error(), "BITHOSE_STORE_SHARDS") {
+		t.Errorf("expected an error naming the variable, got %v", err)
+	}
+	if _, _, err := Load("bithose", []string{"-send-timeout", "soon"}, env(nil)); err == nil {
+		t.Error("expected an error for an invalid flag value")
+	}
+}
+
+func TestConfig_Print(t *testing.T) {
+	config, options, err := Load("bithose", []string{"-print-config", "-jwt-secret", "hunter2"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !options.PrintConfig {
+		t.Error("print-config should be set")
+	}
+
+	var buf bytes.Buffer
+	if err := config.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "hunter2") || !strings.Contains(buf.String(), "jwt_secret: REDACTED") {
+		t.Errorf("secrets should be redacted:\n%s", buf.String())
+	}
+	if config.Auth.JwtSecret != "hunter2" {
+		t.Error("printing should not change the configuration")
+	}
+
+	// the printed configuration can be loaded back
+	path := writeFile(t, "printed.yaml", strings.Replace(buf.String(), "REDACTED", "", 1))
+	printed, _, err := Load("bithose", []string{"-config", path}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(printed.Poll.SessionIdleTimeout) != time.Duration(config.Poll.SessionIdleTimeout) {
+		t.Errorf("expected %v, got %v", time.Duration(config.Poll.SessionIdleTimeout), time.Duration(printed.Poll.SessionIdleTimeout))
+	}
+}
@@ -0,0 +1,353 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/JonathanRosado/Bithose/messagelog"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix prefixes the environment variable of every setting
+const EnvPrefix = "BITHOSE_"
+
+var (
+	UnknownFormatErr = errors.New("unknown config file format, expected .yaml, .yml or .toml")
+
+	durationType = reflect.TypeOf(Duration(0))
+)
+
+// setting is a leaf of the Config struct
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	// optional settings may be zero to disable what they configure
+	optional bool
+	// index is the field index path from Config to the setting
+	index []int
+}
+
+func (s setting) field(c *Config) reflect.Value {
+	return reflect.ValueOf(c).Elem().FieldByIndex(s.index)
+}
+
+// settings lists the settings of the Config struct, in declaration order
+func settings() []setting {
+	var list []setting
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		section := configType.Field(i)
+		sectionKey := strings.Split(section.Tag.Get("yaml"), ",")[0]
+		for j := 0; j < section.Type.NumField(); j++ {
+			field := section.Type.Field(j)
+			key := sectionKey + "." + strings.Split(field.Tag.Get("yaml"), ",")[0]
+			list = append(list, setting{
+				key:      key,
+				env:      EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_")),
+				flag:     field.Tag.Get("flag"),
+				usage:    field.Tag.Get("usage"),
+				secret:   field.Tag.Get("secret") == "true",
+				optional: field.Tag.Get("optional") == "true",
+				index:    []int{i, j},
+			})
+		}
+	}
+	return list
+}
+
+// setString sets the value from its string form, as given in environment
+// variables and flags
+func setString(value reflect.Value, s string) error {
+	if value.Type() == durationType {
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(duration))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %v", value.Type())
+	}
+	return nil
+}
+
+// formatString returns the string form of the value
+func formatString(value reflect.Value) string {
+	if value.Type() == durationType {
+		return time.Duration(value.Int()).String()
+	}
+	if value.Kind() == reflect.Slice {
+		return strings.Join(value.Interface().([]string), ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// flagValue records the flags set on the command line, which are applied after the
+// file and the environment
+type flagValue struct {
+	setting setting
+	value   reflect.Value
+	set     *[]func(c *Config) error
+}
+
+func (f *flagValue) String() string {
+	// zero defaults are left out of the usage
+	if !f.value.IsValid() || f.value.IsZero() {
+		return ""
+	}
+	return formatString(f.value)
+}
+
+func (f *flagValue) Set(s string) error {
+	// the value is checked right away so flag errors point at the flag
+	if err := setString(reflect.New(f.value.Type()).Elem(), s); err != nil {
+		return err
+	}
+	*f.set = append(*f.set, func(c *Config) error {
+		return setString(f.setting.field(c), s)
+	})
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.value.IsValid() && f.value.Kind() == reflect.Bool
+}
+
+// Options are the flags that control loading rather than the configuration itself
+type Options struct {
+	// File is the config file, given by -config or BITHOSE_CONFIG
+	File string
+	// PrintConfig is set by -print-config
+	PrintConfig bool
+}
+
+// Load returns the effective configuration for the command line arguments and the
+// environment. getenv is usually os.Getenv. The configuration is validated.
+func Load(name string, args []string, getenv func(string) string) (*Config, *Options, error) {
+	defaults := Default()
+	options := &Options{}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&options.File, "config", "", "YAML or TOML config file, also read from "+EnvPrefix+"CONFIG")
+	flags.BoolVar(&options.PrintConfig, "print-config", false, "print the effective configuration and exit")
+	var flagSetters []func(c *Config) error
+	for _, s := range settings() {
+		if s.flag == "" {
+			continue
+		}
+		flags.Var(&flagValue{setting: s, value: s.field(defaults), set: &flagSetters}, s.flag,
+			s.usage+" ("+s.key+", "+s.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if options.File == "" {
+		options.File = getenv(EnvPrefix + "CONFIG")
+	}
+
+	config := defaults
+	if options.File != "" {
+		if err := config.readFile(options.File); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, s := range settings() {
+		if value := getenv(s.env); value != "" {
+			if err := setString(s.field(config), value); err != nil {
+				return nil, nil, fmt.Errorf("invalid value %q for %s: %v", value, s.env, err)
+			}
+		}
+	}
+
+	for _, set := range flagSetters {
+		if err := set(config); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return config, options, nil
+}
+
+// readFile decodes the file over the configuration. Unknown keys are errors, so that
+// typos do not go unnoticed.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	case ".toml":
+		metadata, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("%s: unknown keys %s", path, strings.Join(keys, ", "))
+		}
+	default:
+		return UnknownFormatErr
+	}
+	return nil
+}
+
+// Print writes the configuration as YAML, with secrets redacted
+func (c *Config) Print(writer io.Writer) error {
+	redacted := *c
+	for _, s := range settings() {
+		if field := s.field(&redacted); s.secret && field.String() != "" {
+			field.SetString("REDACTED")
+		}
+	}
+
+	encoder := yaml.NewEncoder(writer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&redacted); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// ValidationErr lists every problem found in a configuration
+type ValidationErr []string
+
+func (v ValidationErr) Error() string {
+	return "invalid configuration:\n  " + strings.Join(v, "\n  ")
+}
+
+// Validate returns a ValidationErr if any setting is invalid
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(key string, format string, args ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.Listen.Http == "" {
+		problem("listen.http", "must be set")
+	}
+	if c.Store.Type != "map" && c.Store.Type != "sharded" {
+		problem("store.type", "must be map or sharded, got %q", c.Store.Type)
+	}
+
+	for _, s := range settings() {
+		field := s.field(c)
+		if s.optional && field.IsZero() {
+			continue
+		}
+		if field.Type() == durationType && field.Int() <= 0 {
+			problem(s.key, "must be a positive duration, got %v", formatString(field))
+		}
+		if field.Kind() == reflect.Int && field.Int() < 1 {
+			problem(s.key, "must be at least 1, got %v", field.Int())
+		}
+	}
+	if c.Buffers.Max < c.Buffers.Default {
+		problem("buffers.max", "must not be less than buffers.default (%v), got %v", c.Buffers.Default, c.Buffers.Max)
+	}
+
+	if c.Ws.PongTimeout <= c.Ws.PingInterval {
+		problem("websocket.pong_timeout", "must be longer than websocket.ping_interval (%v), got %v",
+			time.Duration(c.Ws.PingInterval), time.Duration(c.Ws.PongTimeout))
+	}
+
+	switch messagelog.SyncPolicy(c.Log.Sync) {
+	case messagelog.SyncAlways, messagelog.SyncInterval, messagelog.SyncNever:
+	default:
+		problem("log.sync", "must be always, interval or never, got %q", c.Log.Sync)
+	}
+
+	if len(c.Cluster.Peers) > 0 && c.Redis.Address != "" {
+		problem("cluster.peers", "can not be used together with redis.address")
+	}
+	if len(c.Cluster.Peers) > 0 && c.Log.Dir != "" {
+		problem("log.dir", "can not be used together with cluster.peers, whose nodes only receive the messages their subscribers want")
+	}
+	if len(c.Cluster.Peers) > 0 && c.Cluster.Secret == "" {
+		problem("cluster.secret", "is required by cluster.peers")
+	}
+	if c.Auth.JwtSubjectLabel != "" && c.Auth.JwtSecret == "" && c.Auth.JwtPublicKey == "" {
+		problem("auth.jwt_subject_label", "requires auth.jwt_secret or auth.jwt_public_key")
+	}
+	for _, file := range []struct{ key, path string }{
+		{"auth.jwt_public_key", c.Auth.JwtPublicKey},
+		{"auth.publisher_keys", c.Auth.PublisherKeys},
+		{"tls.cert", c.Tls.Cert},
+		{"tls.key", c.Tls.Key},
+		{"tls.client_ca", c.Tls.ClientCA},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			problem(file.key, "%v", err)
+		}
+	}
+
+	if len(c.Cors.AllowedOrigins) == 0 {
+		problem("cors.allowed_origins", "must not be empty, use * to allow every origin")
+	}
+	if (c.Tls.Cert == "") != (c.Tls.Key == "") {
+		problem("tls", "cert and key must be set together")
+	}
+	if c.Tls.ClientCA != "" && c.Tls.Cert == "" {
+		problem("tls.client_ca", "requires tls.cert and tls.key")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return ValidationErr(problems)
+	}
+	return nil
+}
@@ -13,6 +13,32 @@ type ConnectionStore interface {
 	Stats() *Statistics
 }
 
+var (
+	storeMtx      = &sync.RWMutex{}
+	storeInstance ConnectionStore
+)
+
+// GetStore returns the connection store used by the server, which is the MapStore
+// unless another store was set with SetStore.
+func GetStore() ConnectionStore {
+	storeMtx.RLock()
+	store := storeInstance
+	storeMtx.RUnlock()
+
+	if store == nil {
+		return GetMapStore()
+	}
+	return store
+}
+
+// SetStore replaces the connection store returned by GetStore. It should be called
+// before the server starts accepting connections.
+func SetStore(store ConnectionStore) {
+	storeMtx.Lock()
+	defer storeMtx.Unlock()
+	storeInstance = store
+}
+
 type Connection struct {
 	Ch                      chan []byte
 	LabelAcceptanceCriteria []LabelAcceptanceCriterion
@@ -26,32 +52,57 @@ func NewConnection(ch chan []byte, labelAcceptanceCriteria []LabelAcceptanceCrit
 }
 
 // AcceptsLabels returns true if the given Label Pairs matches all the
-// criterions specified in the connection. If the label is
+// criterions specified in the connection. Labels without a criterion are ignored,
+// every other label must meet one of the criteria for its name and every criterion
+// must be met by one of the labels.
 func (c *Connection) AcceptsLabels(pairs []LabelPair) (bool, error) {
 	pairs = c.filterLabelPairs(pairs)
 	if len(pairs) != len(c.LabelAcceptanceCriteria) {
 		return false, nil
 	}
 
-	accepts := true
+	metCriteria := make([]bool, len(c.LabelAcceptanceCriteria))
 
 	for _, pair := range pairs {
 		meetsCriteria := false
-		for _, criterion := range c.LabelAcceptanceCriteria {
+		for i, criterion := range c.LabelAcceptanceCriteria {
 			accepts, _, err := criterion.acceptsLabel(pair)
 			if err != nil {
 				return false, err
 			}
 			if accepts {
 				meetsCriteria = true
+				metCriteria[i] = true
 			}
 		}
 		if !meetsCriteria {
-			accepts = false
+			return false, nil
+		}
+	}
+
+	for _, met := range metCriteria {
+		if !met {
+			return false, nil
 		}
 	}
 
-	return accepts, nil
+	return true, nil
+}
+
+// EqualityLabel returns the label pair of the first equality criterion of the
+// connection, normalized with NormalizeLabelValue. Every message the connection
+// accepts carries this label. The second return value is false if the connection
+// has no equality criterion.
+func (c *Connection) EqualityLabel() (LabelPair, bool) {
+	for _, criterion := range c.LabelAcceptanceCriteria {
+		if criterion.Operator != "==" {
+			continue
+		}
+		if value, ok := NormalizeLabelValue(criterion.LabelPair.Value); ok {
+			return LabelPair{Name: criterion.LabelPair.Name, Value: value}, true
+		}
+	}
+	return LabelPair{}, false
 }
 
 // filterLabelPairs filters the label pairs such that only the label pairs with label names
@@ -79,6 +130,23 @@ type LabelAcceptanceCriterion struct {
 	Operator  string    `json:"operator"`
 }
 
+// Validate returns an error if the criterion can never be evaluated. The value must be
+// a string, a number or a boolean and only numbers may be used with the range operators.
+func (l *LabelAcceptanceCriterion) Validate() error {
+	if err := ValidateLabelPairs([]LabelPair{l.LabelPair}); err != nil {
+		return err
+	}
+	switch l.Operator {
+	case "==":
+		return nil
+	case ">", "<", ">=", "<=":
+		if _, ok := toFloat64(l.LabelPair.Value); ok {
+			return nil
+		}
+	}
+	return OperatorNotFound
+}
+
 // acceptsLabel takes in a label Name and label value pair from the pushed message and does two things:
 //  - checks whether the label Name is included in the LabelAcceptanceCriterion
 //  - if it is, checks whether the label value meets the LabelAcceptanceCriterion
@@ -90,81 +158,119 @@ func (l *LabelAcceptanceCriterion) acceptsLabel(pair LabelPair) (result bool, la
 		return false, true, nil
 	}
 
-	switch pair.Value.(type) {
-	case float64: /* since json does not differentiate between int or float, the marshaller will encode numbers as float64 */
-		switch l.Operator {
-		case "==":
-			return pair.Value.(float64) == l.LabelPair.Value.(float64), false, nil
-		case ">":
-			return pair.Value.(float64) > l.LabelPair.Value.(float64), false, nil
-		case "<":
-			return pair.Value.(float64) < l.LabelPair.Value.(float64), false, nil
-		case ">=":
-			return pair.Value.(float64) >= l.LabelPair.Value.(float64), false, nil
-		case "<=":
-			return pair.Value.(float64) <= l.LabelPair.Value.(float64), false, nil
-		default:
-			return false, false, OperatorNotFound
-		}
+	switch value := pair.Value.(type) {
 	case string:
+		criterionValue, ok := l.LabelPair.Value.(string)
+		if !ok {
+			return false, false, nil
+		}
 		switch l.Operator {
 		case "==":
-			return pair.Value.(string) == l.LabelPair.Value.(string), false, nil
+			return value == criterionValue, false, nil
 		default:
 			return false, false, OperatorNotFound
 		}
 	case bool:
+		criterionValue, ok := l.LabelPair.Value.(bool)
+		if !ok {
+			return false, false, nil
+		}
 		switch l.Operator {
 		case "==":
-			return pair.Value.(bool) == l.LabelPair.Value.(bool), false, nil
+			return value == criterionValue, false, nil
 		default:
 			return false, false, OperatorNotFound
 		}
 	}
 
-	return false, false, nil
-}
-
-type Statistics struct {
-	TotalConnections     int `json:"total_connections"`
-	TotalMessagesSent    int `json:"total_messages_sent"`
-	TotalMessagesTimeout int `json:"total_messages_timeout"`
-	mtx                  *sync.RWMutex
-}
-
-func NewStatistics() *Statistics {
-	return &Statistics{
-		TotalConnections:     0,
-		TotalMessagesSent:    0,
-		TotalMessagesTimeout: 0,
-		mtx:                  &sync.RWMutex{},
+	/* since json does not differentiate between int or float, the marshaller will encode numbers as float64.
+	Values built in Go may still be ints, so every numeric type is compared as a float64 */
+	number, ok := toFloat64(pair.Value)
+	if !ok {
+		return false, false, nil
+	}
+	criterionNumber, ok := toFloat64(l.LabelPair.Value)
+	if !ok {
+		return false, false, nil
+	}
+	switch l.Operator {
+	case "==":
+		return number == criterionNumber, false, nil
+	case ">":
+		return number > criterionNumber, false, nil
+	case "<":
+		return number < criterionNumber, false, nil
+	case ">=":
+		return number >= criterionNumber, false, nil
+	case "<=":
+		return number <= criterionNumber, false, nil
+	default:
+		return false, false, OperatorNotFound
 	}
 }
 
-func (s *Statistics) IncrementConnection() {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	s.TotalConnections++
-}
-
-func (s *Statistics) DecrementConnection() {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	s.TotalConnections--
+// toFloat64 converts any of Go's numeric types to a float64. The second return value
+// is false if the value is not a number.
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
 }
 
-func (s *Statistics) IncrementMessageSent() {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	s.TotalMessagesSent++
+// NormalizeLabelValue returns the value with numbers converted to float64, so that
+// equal values compare equal with ==. The second return value is false if the value
+// is not a string, a number or a boolean.
+func NormalizeLabelValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string, bool:
+		return v, true
+	}
+	if number, ok := toFloat64(value); ok {
+		return number, true
+	}
+	return nil, false
 }
 
-func (s *Statistics) IncrementMessageTimeout() {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	s.TotalMessagesTimeout++
+// ValidateLabelPairs returns InvalidLabelValueErr if any of the label values is not
+// a string, a number or a boolean, which are the only types criteria can compare.
+func ValidateLabelPairs(pairs []LabelPair) error {
+	for _, pair := range pairs {
+		switch pair.Value.(type) {
+		case string, bool:
+			continue
+		}
+		if _, ok := toFloat64(pair.Value); !ok {
+			return InvalidLabelValueErr
+		}
+	}
+	return nil
 }
 
 var (
-	OperatorNotFound = errors.New("Operator not found")
+	OperatorNotFound     = errors.New("Operator not found")
+	InvalidLabelValueErr = errors.New("label values must be strings, numbers or booleans")
 )
@@ -274,3 +274,95 @@ func TestConnection_WithGreaterThanOperator(t *testing.T) {
 		}
 	}
 }
+
+func TestConnection_WithMismatchedValueTypes(t *testing.T) {
+	ch := make(chan []byte)
+	connection := Connection{
+		Ch: ch,
+		LabelAcceptanceCriteria: []LabelAcceptanceCriterion{
+			{
+				LabelPair: LabelPair{
+					Name:  "channel",
+					Value: "viva_la_vida",
+				},
+				Operator: "==",
+			},
+		},
+	}
+
+	result, err := connection.AcceptsLabels([]LabelPair{
+		{
+			Name:  "channel",
+			Value: 5.0,
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if result {
+		t.Error("Should return false as a number cannot match a string criterion")
+	}
+}
+
+func TestValidateLabelPairs(t *testing.T) {
+	err := ValidateLabelPairs([]LabelPair{
+		{Name: "channel", Value: "chats"},
+		{Name: "number", Value: 5},
+		{Name: "float", Value: 5.5},
+		{Name: "is_true", Value: true},
+	})
+	if err != nil {
+		t.Error("strings, numbers and booleans should be valid label values")
+	}
+
+	err = ValidateLabelPairs([]LabelPair{
+		{Name: "channel", Value: []interface{}{"chats"}},
+	})
+	if err != InvalidLabelValueErr {
+		t.Error("arrays should not be valid label values")
+	}
+}
+
+func TestConnection_WithRepeatedLabelMissingCriterion(t *testing.T) {
+	ch := make(chan []byte)
+	connection := Connection{
+		Ch: ch,
+		LabelAcceptanceCriteria: []LabelAcceptanceCriterion{
+			{
+				LabelPair: LabelPair{
+					Name:  "channel",
+					Value: "viva_la_vida",
+				},
+				Operator: "==",
+			},
+			{
+				LabelPair: LabelPair{
+					Name:  "event",
+					Value: "button_press",
+				},
+				Operator: "==",
+			},
+		},
+	}
+
+	result, err := connection.AcceptsLabels([]LabelPair{
+		{
+			Name:  "event",
+			Value: "button_press",
+		},
+		{
+			Name:  "event",
+			Value: "button_press",
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if result {
+		t.Error("Should return false as the channel criterion is not met by any label")
+	}
+}
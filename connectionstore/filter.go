@@ -0,0 +1,98 @@
+package connectionstore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	InvalidFilterErr = errors.New("invalid filter")
+
+	// filterOperators is ordered so that two character operators are matched before
+	// their one character prefixes
+	filterOperators = []string{"==", ">=", "<=", ">", "<"}
+)
+
+// ParseFilter turns a filter expression such as `channel==chats` or `number>=5` into a
+// LabelAcceptanceCriterion. Values are typed as follows:
+//   - `true` and `false` are booleans
+//   - anything strconv.ParseFloat accepts is a number
+//   - values wrapped in single or double quotes are strings, which allows `uid=="5"`
+//   - everything else is a string
+//
+// Only numbers may be used with the range operators.
+func ParseFilter(filter string) (LabelAcceptanceCriterion, error) {
+	opIndex := strings.IndexAny(filter, "=<>")
+	if opIndex <= 0 {
+		return LabelAcceptanceCriterion{}, fmt.Errorf("%w %q: expected <label><operator><value>", InvalidFilterErr, filter)
+	}
+
+	name := strings.TrimSpace(filter[:opIndex])
+	rest := filter[opIndex:]
+
+	operator := ""
+	for _, op := range filterOperators {
+		if strings.HasPrefix(rest, op) {
+			operator = op
+			break
+		}
+	}
+	if operator == "" {
+		return LabelAcceptanceCriterion{}, fmt.Errorf("%w %q: unknown operator", InvalidFilterErr, filter)
+	}
+
+	rawValue := strings.TrimSpace(rest[len(operator):])
+	if name == "" || rawValue == "" {
+		return LabelAcceptanceCriterion{}, fmt.Errorf("%w %q: expected <label><operator><value>", InvalidFilterErr, filter)
+	}
+
+	value := parseFilterValue(rawValue)
+	if _, isNumber := value.(float64); !isNumber && operator != "==" {
+		return LabelAcceptanceCriterion{}, fmt.Errorf("%w %q: operator %s can only be used with numbers", InvalidFilterErr, filter, operator)
+	}
+
+	return LabelAcceptanceCriterion{
+		LabelPair: LabelPair{
+			Name:  name,
+			Value: value,
+		},
+		Operator: operator,
+	}, nil
+}
+
+// ParseFilters parses every filter expression, stopping at the first invalid one.
+func ParseFilters(filters []string) ([]LabelAcceptanceCriterion, error) {
+	criteria := make([]LabelAcceptanceCriterion, 0, len(filters))
+	for _, filter := range filters {
+		criterion, err := ParseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		criteria = append(criteria, criterion)
+	}
+	return criteria, nil
+}
+
+func parseFilterValue(rawValue string) interface{} {
+	if len(rawValue) >= 2 {
+		first, last := rawValue[0], rawValue[len(rawValue)-1]
+		if (first == '"' || first == '\'') && first == last {
+			return rawValue[1 : len(rawValue)-1]
+		}
+	}
+
+	switch rawValue {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	if number, err := strconv.ParseFloat(rawValue, 64); err == nil {
+		return number
+	}
+
+	return rawValue
+}
@@ -0,0 +1,60 @@
+package connectionstore
+
+import "testing"
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter   string
+		name     string
+		operator string
+		value    interface{}
+	}{
+		{"channel==chats", "channel", "==", "chats"},
+		{"uid==SCDJCSDM", "uid", "==", "SCDJCSDM"},
+		{"uid==\"5\"", "uid", "==", "5"},
+		{"uid=='true'", "uid", "==", "true"},
+		{"number==5", "number", "==", 5.0},
+		{"number>5", "number", ">", 5.0},
+		{"number<-2.5", "number", "<", -2.5},
+		{"number>=5", "number", ">=", 5.0},
+		{"number<=5", "number", "<=", 5.0},
+		{"is_true==true", "is_true", "==", true},
+		{"is_true==false", "is_true", "==", false},
+		{"url==a=b", "url", "==", "a=b"},
+	}
+
+	for _, test := range tests {
+		criterion, err := ParseFilter(test.filter)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.filter, err)
+			continue
+		}
+		if criterion.LabelPair.Name != test.name {
+			t.Errorf("%v: expected name %v, got %v", test.filter, test.name, criterion.LabelPair.Name)
+		}
+		if criterion.Operator != test.operator {
+			t.Errorf("%v: expected operator %v, got %v", test.filter, test.operator, criterion.Operator)
+		}
+		if criterion.LabelPair.Value != test.value {
+			t.Errorf("%v: expected value %#v, got %#v", test.filter, test.value, criterion.LabelPair.Value)
+		}
+	}
+}
+
+func TestParseFilter_Invalid(t *testing.T) {
+	filters := []string{
+		"",
+		"channel",
+		"==chats",
+		"channel==",
+		"channel=chats",
+		"channel>chats",
+		"is_true<=true",
+	}
+
+	for _, filter := range filters {
+		if _, err := ParseFilter(filter); err == nil {
+			t.Errorf("%q should not parse", filter)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package connectionstore
+
+import (
+	"errors"
+	UuidLib "github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+var (
+	// HistorySize is the number of recent messages kept by a HistoryStore
+	HistorySize = 1024
+
+	HistoryExpiredErr    = errors.New("requested history is no longer available")
+	UnknownSequenceErr   = errors.New("sequence number was not issued by this server")
+	ReplayUnsupportedErr = errors.New("the server keeps no message history to replay")
+)
+
+// ReplayPosition is where a replay starts: after the message with sequence number
+// Seq of the epoch Epoch, or, when Time is set, at the first message published at or
+// after Time
+type ReplayPosition struct {
+	Epoch string
+	Seq   int64
+	Time  time.Time
+}
+
+// Replayer is implemented by stores that number the messages sent through them and
+// keep some of them, and by the stores wrapping them
+type Replayer interface {
+	// Replay calls fn, in order, with the kept messages from the position on that
+	// the criteria accept and that have not expired, until fn returns false. It returns HistoryExpiredErr
+	// without calling fn if messages from the position on are no longer kept, and
+	// UnknownSequenceErr if the sequence number was never issued in the epoch.
+	Replay(from ReplayPosition, criteria []LabelAcceptanceCriterion, fn func(Message) bool) error
+}
+
+// HistoryStore is a ConnectionStore that numbers the messages sent through it and
+// keeps the last size of them in memory to replay. Numbering starts over with every
+// HistoryStore, so each one has its own random epoch
+type HistoryStore struct {
+	next  ConnectionStore
+	size  int
+	epoch string
+
+	// mtx is held while a message is numbered and kept, and sequencer makes
+	// subscribers receive messages in sequence order
+	mtx       *sync.RWMutex
+	sequencer *Sequencer
+	// messages is a ring of the kept messages, the oldest at start
+	messages []Message
+	start    int
+	lastSeq  int64
+}
+
+// NewHistoryStore wraps the store, keeping the last size messages sent through it
+func NewHistoryStore(next ConnectionStore, size int) *HistoryStore {
+	return &HistoryStore{
+		next:      next,
+		size:      size,
+		epoch:     UuidLib.New().String(),
+		mtx:       &sync.RWMutex{},
+		sequencer: NewSequencer(1),
+		messages:  make([]Message, 0, size),
+	}
+}
+
+// Epoch returns the epoch messages are stamped with along with their sequence number
+func (h *HistoryStore) Epoch() string {
+	return h.epoch
+}
+
+func (h *HistoryStore) AddConnection(connection *Connection) (string, error) {
+	return h.next.AddConnection(connection)
+}
+
+func (h *HistoryStore) RemoveConnection(uuid string) {
+	h.next.RemoveConnection(uuid)
+}
+
+func (h *HistoryStore) GetConnection(uuid string) (connection *Connection, exists bool) {
+	return h.next.GetConnection(uuid)
+}
+
+// SendMessage numbers and keeps the message, then delivers it once the messages
+// numbered before it are delivered
+func (h *HistoryStore) SendMessage(message Message) (numOfSent int, numOfTimeouts int, err error) {
+	h.mtx.Lock()
+	h.lastSeq++
+	message.Seq = h.lastSeq
+	message.Epoch = h.epoch
+	if len(h.messages) < h.size {
+		h.messages = append(h.messages, message)
+	} else if h.size > 0 {
+		h.messages[h.start] = message
+		h.start = (h.start + 1) % h.size
+	}
+	h.mtx.Unlock()
+
+	h.sequencer.Wait(message.Seq)
+	defer h.sequencer.Done(message.Seq)
+	return h.next.SendMessage(message)
+}
+
+func (h *HistoryStore) Stats() *Statistics {
+	return h.next.Stats()
+}
+
+// Replay replays the kept messages from the position on
+func (h *HistoryStore) Replay(from ReplayPosition, criteria []LabelAcceptanceCriterion, fn func(Message) bool) error {
+	h.mtx.RLock()
+	kept := make([]Message, 0, len(h.messages))
+	kept = append(kept, h.messages[h.start:]...)
+	kept = append(kept, h.messages[:h.start]...)
+	lastSeq := h.lastSeq
+	h.mtx.RUnlock()
+
+	firstSeq := lastSeq + 1
+	if len(kept) > 0 {
+		firstSeq = kept[0].Seq
+	}
+
+	if from.Time.IsZero() {
+		if from.Epoch != h.epoch || from.Seq > lastSeq {
+			return UnknownSequenceErr
+		}
+		if from.Seq+1 < firstSeq {
+			return HistoryExpiredErr
+		}
+	} else if firstSeq > 1 && (len(kept) == 0 || kept[0].Timestamp.After(from.Time)) {
+		// messages were dropped, and they may have been published after Time
+		return HistoryExpiredErr
+	}
+
+	filter := NewConnection(nil, criteria)
+	now := time.Now()
+	for _, message := range kept {
+		if message.Seq <= from.Seq || message.Timestamp.Before(from.Time) || message.Expired(now) {
+			continue
+		}
+		if accepts, err := filter.AcceptsLabels(message.LabelPairs); err != nil || !accepts {
+			continue
+		}
+		if !fn(message) {
+			return nil
+		}
+	}
+	return nil
+}
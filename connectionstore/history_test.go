@@ -0,0 +1,150 @@
+package connectionstore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHistoryStore_Replay(t *testing.T) {
+	store := NewHistoryStore(NewShardedStore(1), 3)
+	ch := make(chan []byte, 10)
+	store.AddConnection(NewConnection(ch, nil))
+
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		store.SendMessage(Message{
+			LabelPairs: []LabelPair{{Name: "n", Value: float64(i)}},
+			Timestamp:  start.Add(time.Duration(i) * time.Second),
+			Body:       float64(i),
+		})
+	}
+
+	replay := func(from ReplayPosition, criteria []LabelAcceptanceCriterion) ([]int64, error) {
+		var seqs []int64
+		err := store.Replay(from, criteria, func(message Message) bool {
+			seqs = append(seqs, message.Seq)
+			return true
+		})
+		return seqs, err
+	}
+
+	if seqs, err := replay(ReplayPosition{Epoch: store.epoch, Seq: 2}, nil); err != nil || len(seqs) != 3 || seqs[0] != 3 || seqs[2] != 5 {
+		t.Errorf("expected 3 to 5, got %v %v", seqs, err)
+	}
+	if seqs, err := replay(ReplayPosition{Epoch: store.epoch, Seq: 5}, nil); err != nil || len(seqs) != 0 {
+		t.Errorf("expected nothing after the last message, got %v %v", seqs, err)
+	}
+	criteria := []LabelAcceptanceCriterion{{LabelPair: LabelPair{Name: "n", Value: 4}, Operator: ">="}}
+	if seqs, err := replay(ReplayPosition{Epoch: store.epoch, Seq: 2}, criteria); err != nil || len(seqs) != 2 || seqs[0] != 4 {
+		t.Errorf("expected 4 and 5, got %v %v", seqs, err)
+	}
+	if seqs, err := replay(ReplayPosition{Time: start.Add(4 * time.Second)}, nil); err != nil || len(seqs) != 2 || seqs[0] != 4 {
+		t.Errorf("expected 4 and 5, got %v %v", seqs, err)
+	}
+
+	if _, err := replay(ReplayPosition{Epoch: store.epoch, Seq: 1}, nil); err != HistoryExpiredErr {
+		t.Errorf("expected HistoryExpiredErr, got %v", err)
+	}
+	if _, err := replay(ReplayPosition{Time: start}, nil); err != HistoryExpiredErr {
+		t.Errorf("expected HistoryExpiredErr, got %v", err)
+	}
+	if _, err := replay(ReplayPosition{Epoch: store.epoch, Seq: 6}, nil); err != UnknownSequenceErr {
+		t.Errorf("expected UnknownSequenceErr, got %v", err)
+	}
+	// the sequence numbers of another store, or of this one before a restart, are
+	// not resumed from
+	other := NewHistoryStore(NewShardedStore(1), 3)
+	if _, err := replay(ReplayPosition{Epoch: other.epoch, Seq: 2}, nil); err != UnknownSequenceErr {
+		t.Errorf("expected UnknownSequenceErr for another epoch, got %v", err)
+	}
+	if _, err := replay(ReplayPosition{Seq: 2}, nil); err != UnknownSequenceErr {
+		t.Errorf("expected UnknownSequenceErr without an epoch, got %v", err)
+	}
+
+	// expired messages are not replayed
+	store.SendMessage(Message{Timestamp: time.Now().Add(-time.Minute), Body: 6.0, TTL: 1})
+	if seqs, err := replay(ReplayPosition{Epoch: store.epoch, Seq: 4}, nil); err != nil || len(seqs) != 1 || seqs[0] != 5 {
+		t.Errorf("expected only 5, got %v %v", seqs, err)
+	}
+
+	// delivered messages carry their sequence number, in order
+	for i := 1; i <= 5; i++ {
+		select {
+		case data := <-ch:
+			var message Message
+			json.Unmarshal(data, &message)
+			if message.Seq != int64(i) {
+				t.Fatalf("expected seq %v, got %v", i, message.Seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message was not delivered")
+		}
+	}
+}
+
+// blockingStore holds the delivery of every message until release is closed
+type blockingStore struct {
+	ConnectionStore
+	delivering chan struct{}
+	release    chan struct{}
+}
+
+func (b *blockingStore) SendMessage(message Message) (int, int, error) {
+	b.delivering <- struct{}{}
+	<-b.release
+	return b.ConnectionStore.SendMessage(message)
+}
+
+func TestHistoryStore_DeliversInOrderWithoutHoldingTheLock(t *testing.T) {
+	next := &blockingStore{
+		ConnectionStore: NewShardedStore(4),
+		delivering:      make(chan struct{}, 100),
+		release:         make(chan struct{}),
+	}
+	store := NewHistoryStore(next, 100)
+	ch := make(chan []byte, 100)
+	store.AddConnection(NewConnection(ch, nil))
+
+	const published = 50
+	for i := 0; i < published; i++ {
+		go store.SendMessage(Message{Timestamp: time.Now(), Body: float64(i)})
+	}
+
+	// the first delivery is held, and only it has its turn
+	<-next.delivering
+	time.Sleep(time.Millisecond * 20)
+	if len(next.delivering) != 0 {
+		t.Fatalf("expected one delivery at a time, got %v more", len(next.delivering))
+	}
+	// every message is numbered and kept meanwhile
+	deadline := time.Now().Add(time.Second)
+	for {
+		var kept int
+		store.Replay(ReplayPosition{Epoch: store.Epoch()}, nil, func(Message) bool {
+			kept++
+			return true
+		})
+		if kept == published {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v messages kept during a delivery, got %v", published, kept)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(next.release)
+	for seq := int64(1); seq <= published; seq++ {
+		select {
+		case data := <-ch:
+			var message Message
+			json.Unmarshal(data, &message)
+			if message.Seq != seq {
+				t.Fatalf("expected message %v, got %v", seq, message.Seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected message %v", seq)
+		}
+	}
+}
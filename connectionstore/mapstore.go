@@ -19,84 +19,297 @@ var (
 	mapStoreInstance *MapStore
 )
 
+// labelKey identifies a label name and value pair in the index. Numbers are always
+// stored as float64 so that equal numbers of different types share a key.
+type labelKey struct {
+	name  string
+	value interface{}
+}
+
+// channelRefs counts the connections sharing a channel, so that a channel shared by
+// several connections is only closed once, after the last of their writers exits
+type channelRefs struct {
+	count int
+	stale bool
+}
+
 type MapStore struct {
 	mtx         *sync.RWMutex
 	connections map[string]*Connection
-	stats       *Statistics
+	// queues holds the queue of every connection, each drained by its own writer goroutine
+	queues map[string]*connectionQueue
+	// index holds the connections under the key of one of their equality criteria
+	index map[labelKey]map[string]*Connection
+	// indexKeys holds the key each indexed connection was added under
+	indexKeys map[string]labelKey
+	// unindexed holds the connections without an equality criterion, which
+	// are candidates for every message
+	unindexed map[string]*Connection
+	// retained holds the retained messages queued for new connections, shared by
+	// the shards of a ShardedStore
+	retained *retainedMessages
+	stats    *Statistics
+
+	channelsMtx *sync.Mutex
+	channels    map[chan []byte]*channelRefs
 }
 
 func GetMapStore() ConnectionStore {
 	if mapStoreInstance == nil {
-		mapStoreInstance = &MapStore{
-			mtx:         &sync.RWMutex{},
-			connections: map[string]*Connection{},
-			stats:       NewStatistics(),
-		}
+		mapStoreInstance = newMapStore()
 	}
 	return mapStoreInstance
 }
 
-func (m *MapStore) AddConnection(connection *Connection) (string, error) {
-	m.mtx.Lock()
-	defer m.mtx.Unlock()
+func newMapStore() *MapStore {
+	return newShard(newRetainedMessages())
+}
 
+// newShard returns a MapStore keeping its retained messages in retained
+func newShard(retained *retainedMessages) *MapStore {
+	return &MapStore{
+		mtx:         &sync.RWMutex{},
+		connections: map[string]*Connection{},
+		queues:      map[string]*connectionQueue{},
+		index:       map[labelKey]map[string]*Connection{},
+		indexKeys:   map[string]labelKey{},
+		unindexed:   map[string]*Connection{},
+		retained:    retained,
+		stats:       NewStatistics(),
+		channelsMtx: &sync.Mutex{},
+		channels:    map[chan []byte]*channelRefs{},
+	}
+}
+
+func (m *MapStore) AddConnection(connection *Connection) (string, error) {
 	// if no uuid is provided, generate one
 	u := UuidLib.New()
 	uuid := u.String()
 
+	m.retained.add(func() {
+		m.addConnection(uuid, connection)
+	})
+	return uuid, nil
+}
+
+// addConnection adds the connection under the given uuid and queues the retained
+// messages it accepts. It is called through retained.add
+func (m *MapStore) addConnection(uuid string, connection *Connection) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.channelsMtx.Lock()
+	refs, ok := m.channels[connection.Ch]
+	if !ok {
+		refs = &channelRefs{}
+		m.channels[connection.Ch] = refs
+	}
+	refs.count++
+	m.channelsMtx.Unlock()
+
+	queue := newConnectionQueue(uuid, connection)
+	m.retained.queueFor(queue)
+	go m.write(queue)
+
 	m.connections[uuid] = connection
+	m.queues[uuid] = queue
+	if key, ok := indexKey(connection); ok {
+		if _, exists := m.index[key]; !exists {
+			m.index[key] = map[string]*Connection{}
+		}
+		m.index[key][uuid] = connection
+		m.indexKeys[uuid] = key
+	} else {
+		m.unindexed[uuid] = connection
+	}
 	m.stats.IncrementConnection()
-	return uuid, nil
+	subscriptionsGauge.Inc()
 }
 
 func (m *MapStore) RemoveConnection(uuid string) {
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	queue, exists := m.removeConnection(uuid)
+	m.mtx.Unlock()
+
+	if exists {
+		queue.close(false)
+	}
+}
 
-	if _, exists := m.GetConnection(uuid); !exists {
-		return
+// dropStale removes a connection that did not accept its messages. The connection's
+// channel is closed once no other connection uses it.
+func (m *MapStore) dropStale(queue *connectionQueue) {
+	m.mtx.Lock()
+	if m.queues[queue.uuid] == queue {
+		m.removeConnection(queue.uuid)
 	}
+	m.mtx.Unlock()
+
+	queue.close(true)
+}
 
+// dropInvalid removes a connection whose criteria can not be evaluated, counting it
+// once. The connection's channel is closed once no other connection uses it.
+func (m *MapStore) dropInvalid(queue *connectionQueue) {
+	m.mtx.Lock()
+	dropped := false
+	if m.queues[queue.uuid] == queue {
+		m.removeConnection(queue.uuid)
+		dropped = true
+	}
+	m.mtx.Unlock()
+
+	if dropped {
+		m.stats.IncrementConnectionInvalid()
+		subscriptionsInvalid.Inc()
+	}
+	queue.close(true)
+}
+
+// write runs the writer of the queue and releases the connection's channel once the
+// writer exits
+func (m *MapStore) write(queue *connectionQueue) {
+	queue.write(m.stats, m.dropStale)
+	<-queue.stop
+	// the queue was removed from the store before it was stopped, so nothing is
+	// queued anymore and the messages left in it are never delivered
+	queuedMessages.Add(-int64(len(queue.messages)))
+
+	ch := queue.connection.Ch
+	m.channelsMtx.Lock()
+	defer m.channelsMtx.Unlock()
+	refs := m.channels[ch]
+	refs.count--
+	refs.stale = refs.stale || queue.stale
+	if refs.count == 0 {
+		delete(m.channels, ch)
+		if refs.stale {
+			close(ch)
+		}
+	}
+}
+
+// removeConnection removes the connection from the maps and the index and returns its
+// queue. The write lock must be held.
+func (m *MapStore) removeConnection(uuid string) (*connectionQueue, bool) {
+	queue, exists := m.queues[uuid]
+	if !exists {
+		return nil, false
+	}
+	delete(m.queues, uuid)
+
+	if key, ok := m.indexKeys[uuid]; ok {
+		delete(m.index[key], uuid)
+		if len(m.index[key]) == 0 {
+			delete(m.index, key)
+		}
+		delete(m.indexKeys, uuid)
+	} else {
+		delete(m.unindexed, uuid)
+	}
 	delete(m.connections, uuid)
 	m.stats.DecrementConnection()
+	subscriptionsGauge.Dec()
+	return queue, true
 }
 
+// SendMessage queues the message for every accepting connection. numOfSent is the
+// number of connections the message was queued for and numOfTimeouts the number of
+// connections whose queue was full, which are removed as stale.
 func (m *MapStore) SendMessage(message Message) (numOfSent int, numOfTimeouts int, err error) {
+	start := time.Now()
+
 	// convert message to json
 	jsonMsg, err := json.Marshal(message)
 	if err != nil {
 		return 0, numOfTimeouts, err
 	}
 
-	// since we are iterating the map, we should lock it from writes
-	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	numOfSent, numOfTimeouts, err = m.retained.publish(message, jsonMsg, func() (int, int, error) {
+		return m.sendJsonMessage(message, jsonMsg)
+	})
+	observePublish(start, numOfSent)
+	return numOfSent, numOfTimeouts, err
+}
 
-	for uuid, connection := range m.connections {
+// sendJsonMessage queues the json encoding of the message for every accepting
+// connection. Retained messages are kept by the caller, through retained.publish
+func (m *MapStore) sendJsonMessage(message Message, jsonMsg []byte) (numOfSent int, numOfTimeouts int, err error) {
+	// publishing only enqueues, so the read lock is held for as short as possible
+	var stale []*connectionQueue
+	now := time.Now()
+	expires, _ := message.Expiry()
+	// a message that expired before it was published is dropped for every subscriber
+	expired := message.Expired(now)
+	var invalid []*connectionQueue
+	m.mtx.RLock()
+	for uuid, connection := range m.candidates(message.LabelPairs) {
 		accepts, err := connection.AcceptsLabels(message.LabelPairs)
 		if err != nil {
-			return 0, numOfTimeouts, err
+			// criteria that can not be evaluated never will be, so the connection
+			// is dropped rather than failing the publish for every other one
+			invalid = append(invalid, m.queues[uuid])
+			continue
+		}
+		if accepts && expired {
+			countExpired(m.stats)
+			continue
 		}
 		if accepts {
-			select {
-			case connection.Ch <- jsonMsg:
+			queue := m.queues[uuid]
+			if queue.enqueue(queuedMessage{data: jsonMsg, queued: now, published: message.Timestamp, expires: expires}) {
 				numOfSent++
-				m.stats.IncrementMessageSent()
-			// if we have to wait, we will assume the connection is stale and delete it
-			// NOTE: the wait time has to be as small as possible as this may cause delays
-			case <-time.After(time.Millisecond * 100):
-				numOfTimeouts++
-				m.stats.IncrementMessageTimeout()
-				close(connection.Ch)
-				m.RemoveConnection(uuid)
+				continue
 			}
+			// the queue is full, so the connection has not accepted a message in a while
+			numOfTimeouts++
+			m.stats.IncrementMessageTimeout()
+			messagesTimedOut.Inc()
+			stale = append(stale, queue)
 		}
 	}
+	m.mtx.RUnlock()
+
+	// stale and invalid connections are removed off the publishing path
+	if len(stale) > 0 || len(invalid) > 0 {
+		go func() {
+			for _, queue := range stale {
+				m.dropStale(queue)
+			}
+			for _, queue := range invalid {
+				m.dropInvalid(queue)
+			}
+		}()
+	}
 
 	return numOfSent, numOfTimeouts, nil
 }
 
+// candidates returns the connections that may accept the label pairs: the ones
+// indexed under one of the pairs plus the unindexed ones. Since a connection only
+// accepts a message when all its criteria are met, a connection indexed under a
+// key that is not in the message can never accept it.
+func (m *MapStore) candidates(pairs []LabelPair) map[string]*Connection {
+	candidates := make(map[string]*Connection, len(m.unindexed))
+	for uuid, connection := range m.unindexed {
+		candidates[uuid] = connection
+	}
+	for _, pair := range pairs {
+		value, ok := NormalizeLabelValue(pair.Value)
+		if !ok {
+			continue
+		}
+		for uuid, connection := range m.index[labelKey{name: pair.Name, value: value}] {
+			candidates[uuid] = connection
+		}
+	}
+	return candidates
+}
+
 func (m *MapStore) GetConnection(uuid string) (connection *Connection, exists bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
 	if connection, ok := m.connections[uuid]; ok {
 		return connection, ok
 	} else {
@@ -104,6 +317,19 @@ func (m *MapStore) GetConnection(uuid string) (connection *Connection, exists bo
 	}
 }
 
+// Stats returns a copy of the statistics of the store
 func (m *MapStore) Stats() *Statistics {
-	return m.stats
+	stats := m.stats.Copy()
+	stats.Add(m.retained.stats)
+	return stats
+}
+
+// indexKey returns the key of the first equality criterion of the connection. The
+// second return value is false if the connection has no equality criterion.
+func indexKey(connection *Connection) (labelKey, bool) {
+	label, ok := connection.EqualityLabel()
+	if !ok {
+		return labelKey{}, false
+	}
+	return labelKey{name: label.Name, value: label.Value}, true
 }
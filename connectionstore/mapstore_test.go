@@ -2,6 +2,7 @@ package connectionstore
 
 import (
 	"encoding/json"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -73,7 +74,7 @@ func TestMapStore_SendMessage(t *testing.T) {
 		var msg Message
 		json.Unmarshal(<-ch, &msg)
 		t.Log(msg)
-		if msg.Body == "hello there" {
+		if msg.Body != "hello there" {
 			t.Error("message bodies should be the same")
 		}
 		done <- struct{}{}
@@ -113,7 +114,7 @@ func TestMapStore_SendMessage2(t *testing.T) {
 		var msg Message
 		json.Unmarshal(<-ch, &msg)
 		t.Log(msg)
-		if msg.Body == "hello there" {
+		if msg.Body != "hello there" {
 			t.Error("message bodies should be the same")
 		}
 		done <- struct{}{}
@@ -508,3 +509,318 @@ func TestMapStore_SendMessage9(t *testing.T) {
 
 	<-done
 }
+
+func TestMapStore_IndexMatchesNumbersOfAnyType(t *testing.T) {
+	ms := newMapStore()
+	ch := make(chan []byte, 1)
+	ms.AddConnection(NewConnection(ch, []LabelAcceptanceCriterion{
+		{
+			LabelPair: LabelPair{
+				Name:  "room",
+				Value: 5,
+			},
+			Operator: "==",
+		},
+	}))
+
+	numOfSent, _, _ := ms.SendMessage(Message{
+		LabelPairs: []LabelPair{
+			{
+				Name:  "room",
+				Value: 5.0,
+			},
+		},
+		Timestamp: time.Now(),
+		Body:      "hello there",
+	})
+
+	if numOfSent != 1 {
+		t.Error("an int criterion should match a float64 label")
+	}
+}
+
+func TestMapStore_UnindexedConnections(t *testing.T) {
+	ms := newMapStore()
+	rangeCh := make(chan []byte, 1)
+	ms.AddConnection(NewConnection(rangeCh, []LabelAcceptanceCriterion{
+		{
+			LabelPair: LabelPair{
+				Name:  "number",
+				Value: 5,
+			},
+			Operator: ">",
+		},
+	}))
+	allCh := make(chan []byte, 1)
+	ms.AddConnection(NewConnection(allCh, nil))
+
+	numOfSent, _, _ := ms.SendMessage(Message{
+		LabelPairs: []LabelPair{
+			{
+				Name:  "number",
+				Value: 6,
+			},
+		},
+		Timestamp: time.Now(),
+		Body:      "hello there",
+	})
+
+	if numOfSent != 2 {
+		t.Errorf("connections without equality criteria should be evaluated for every message, sent %v", numOfSent)
+	}
+}
+
+func TestMapStore_RemoveConnectionFromIndex(t *testing.T) {
+	ms := newMapStore()
+	ch := make(chan []byte, 1)
+	uuid, _ := ms.AddConnection(NewConnection(ch, []LabelAcceptanceCriterion{
+		{
+			LabelPair: LabelPair{
+				Name:  "channel",
+				Value: "da_boys",
+			},
+			Operator: "==",
+		},
+	}))
+	ms.RemoveConnection(uuid)
+
+	if len(ms.index) != 0 {
+		t.Error("the index should not keep removed connections")
+	}
+
+	numOfSent, _, _ := ms.SendMessage(Message{
+		LabelPairs: []LabelPair{
+			{
+				Name:  "channel",
+				Value: "da_boys",
+			},
+		},
+		Timestamp: time.Now(),
+		Body:      "hello there",
+	})
+
+	if numOfSent != 0 {
+		t.Error("removed connections should not receive messages")
+	}
+}
+
+// benchmarkSendMessage publishes to random channels of a store holding
+// subscriptions spread evenly across channels. Every subscription also has a
+// range criterion which is only evaluated for the candidates of a channel.
+func benchmarkSendMessage(b *testing.B, subscriptions int, channels int) {
+	ms := newMapStore()
+
+	// all subscriptions share a channel drained by a single goroutine
+	ch := make(chan []byte, 1024)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < subscriptions; i++ {
+		ms.AddConnection(NewConnection(ch, []LabelAcceptanceCriterion{
+			{
+				LabelPair: LabelPair{
+					Name:  "channel",
+					Value: "channel_" + strconv.Itoa(i%channels),
+				},
+				Operator: "==",
+			},
+			{
+				LabelPair: LabelPair{
+					Name:  "num_of_chars",
+					Value: 5,
+				},
+				Operator: "<",
+			},
+		}))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ms.SendMessage(Message{
+			LabelPairs: []LabelPair{
+				{
+					Name:  "channel",
+					Value: "channel_" + strconv.Itoa(i%channels),
+				},
+				{
+					Name:  "num_of_chars",
+					Value: 4,
+				},
+			},
+			Timestamp: time.Now(),
+			Body:      "hello",
+		})
+	}
+}
+
+func BenchmarkMapStore_SendMessage100kSubscriptions10kChannels(b *testing.B) {
+	benchmarkSendMessage(b, 100000, 10000)
+}
+
+func BenchmarkMapStore_SendMessage100kSubscriptions10Channels(b *testing.B) {
+	benchmarkSendMessage(b, 100000, 10)
+}
+
+func TestMapStore_SendMessageDoesNotBlockOnStalledConnection(t *testing.T) {
+	ms := newMapStore()
+	stalled := make(chan []byte)
+	ms.AddConnection(NewConnection(stalled, []LabelAcceptanceCriterion{
+		{
+			LabelPair: LabelPair{
+				Name:  "channel",
+				Value: "stalled",
+			},
+			Operator: "==",
+		},
+	}))
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		ms.SendMessage(Message{
+			LabelPairs: []LabelPair{
+				{
+					Name:  "channel",
+					Value: "stalled",
+				},
+			},
+			Timestamp: time.Now(),
+			Body:      "hello there",
+		})
+	}
+
+	if elapsed := time.Since(start); elapsed > SendTimeout {
+		t.Errorf("publishing should not wait on a stalled connection, took %v", elapsed)
+	}
+}
+
+func TestMapStore_StaleConnectionsSharingAChannel(t *testing.T) {
+	ms := newMapStore()
+	ch := make(chan []byte)
+	criteria := []LabelAcceptanceCriterion{
+		{
+			LabelPair: LabelPair{
+				Name:  "channel",
+				Value: "shared",
+			},
+			Operator: "==",
+		},
+	}
+	uuid1, _ := ms.AddConnection(NewConnection(ch, criteria))
+	uuid2, _ := ms.AddConnection(NewConnection(ch, criteria))
+
+	// nobody reads from the channel, so both connections become stale
+	ms.SendMessage(Message{
+		LabelPairs: []LabelPair{
+			{
+				Name:  "channel",
+				Value: "shared",
+			},
+		},
+		Timestamp: time.Now(),
+		Body:      "hello there",
+	})
+
+	time.Sleep(SendTimeout * 3)
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("channel should be closed")
+		}
+	default:
+		t.Fatal("channel of stale connections should be closed")
+	}
+
+	if _, exists := ms.GetConnection(uuid1); exists {
+		t.Error("stale connection should be removed")
+	}
+	if _, exists := ms.GetConnection(uuid2); exists {
+		t.Error("stale connection should be removed")
+	}
+}
+
+func TestMapStore_DropsConnectionsWithInvalidCriteria(t *testing.T) {
+	ms := newMapStore()
+	invalid := make(chan []byte, 1)
+	valid := make(chan []byte, 1)
+	invalidUuid, _ := ms.AddConnection(NewConnection(invalid, []LabelAcceptanceCriterion{
+		{LabelPair: LabelPair{Name: "channel", Value: "x"}, Operator: "!="},
+	}))
+	ms.AddConnection(NewConnection(valid, []LabelAcceptanceCriterion{
+		{LabelPair: LabelPair{Name: "channel", Value: "chats"}, Operator: "=="},
+	}))
+
+	// the invalid connection does not fail the publish for the valid one
+	numOfSent, _, err := ms.SendMessage(Message{
+		LabelPairs: []LabelPair{{Name: "channel", Value: "chats"}},
+		Timestamp:  time.Now(),
+		Body:       "hello there",
+	})
+	if err != nil || numOfSent != 1 {
+		t.Fatalf("expected the message to be sent once, got %v %v", numOfSent, err)
+	}
+	select {
+	case <-valid:
+	case <-time.After(time.Second):
+		t.Fatal("the valid connection should receive the message")
+	}
+
+	select {
+	case _, ok := <-invalid:
+		if ok {
+			t.Fatal("the invalid connection should not receive the message")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the channel of the invalid connection should be closed")
+	}
+	if _, exists := ms.GetConnection(invalidUuid); exists {
+		t.Error("the invalid connection should be removed")
+	}
+	if stats := ms.Stats(); stats.TotalConnectionsInvalid != 1 {
+		t.Errorf("expected 1 invalid connection, got %v", stats.TotalConnectionsInvalid)
+	}
+}
+
+func TestMapStore_Metrics(t *testing.T) {
+	ms := newMapStore()
+	published := messagesPublished.Value()
+	delivered := messagesDelivered.Value()
+	fanouts := publishFanout.Count()
+	subscriptions := subscriptionsGauge.Value()
+
+	ch := make(chan []byte, 2)
+	uuid, _ := ms.AddConnection(NewConnection(ch, []LabelAcceptanceCriterion{
+		{LabelPair: LabelPair{Name: "channel", Value: "metrics"}, Operator: "=="},
+	}))
+	if subscriptionsGauge.Value() != subscriptions+1 {
+		t.Errorf("expected %v subscriptions, got %v", subscriptions+1, subscriptionsGauge.Value())
+	}
+
+	ms.SendMessage(Message{LabelPairs: []LabelPair{{Name: "channel", Value: "metrics"}}, Body: "a"})
+	ms.SendMessage(Message{LabelPairs: []LabelPair{{Name: "channel", Value: "other"}}, Body: "b"})
+	<-ch
+
+	if messagesPublished.Value() != published+2 {
+		t.Errorf("expected %v published, got %v", published+2, messagesPublished.Value())
+	}
+	if messagesDelivered.Value() != delivered+1 {
+		t.Errorf("expected %v delivered, got %v", delivered+1, messagesDelivered.Value())
+	}
+	if publishFanout.Count() != fanouts+2 {
+		t.Errorf("expected %v fan-out observations, got %v", fanouts+2, publishFanout.Count())
+	}
+
+	ms.RemoveConnection(uuid)
+	if subscriptionsGauge.Value() != subscriptions {
+		t.Errorf("expected %v subscriptions, got %v", subscriptions, subscriptionsGauge.Value())
+	}
+}
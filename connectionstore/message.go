@@ -1,11 +1,99 @@
 package connectionstore
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+var (
+	// MaxTTL is the longest lifetime a publisher may give a message
+	MaxTTL = 10 * 365 * 24 * time.Hour
+
+	InvalidTtlErr = errors.New("ttl must not be negative")
+	TtlTooLongErr = errors.New("ttl is longer than the server allows")
+)
 
 type Message struct {
+	// Seq is the sequence number the server published the message under, 0 until
+	// a store keeping history numbers it
+	Seq int64 `json:"seq,omitempty"`
+	// Epoch identifies the store that numbered the message. Sequence numbers are
+	// only comparable within an epoch, which changes when the server restarts
+	// without a message log
+	Epoch      string      `json:"epoch,omitempty"`
 	LabelPairs []LabelPair `json:"label_pairs"`
 	Timestamp  time.Time   `json:"timestamp"`
 	Body       interface{} `json:"body"`
+	// Retain keeps the message as the last value of its label set, delivered to
+	// every new subscription that accepts it. A retained message with an empty body
+	// clears the value
+	Retain bool `json:"retain,omitempty"`
+	// TTL is how many seconds after Timestamp the message expires, 0 if it does not
+	TTL float64 `json:"ttl,omitempty"`
+	// ExpiresAt is when the message expires, overriding TTL
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Validate checks a message received from a publisher before it is published, and
+// clears its sequence number and epoch, which only the server assigns. Every publish path
+// validates its messages.
+func (m *Message) Validate() error {
+	if err := ValidateLabelPairs(m.LabelPairs); err != nil {
+		return err
+	}
+	if m.TTL < 0 || math.IsNaN(m.TTL) {
+		return InvalidTtlErr
+	}
+	if m.TTL > MaxTTL.Seconds() {
+		return TtlTooLongErr
+	}
+	m.Seq = 0
+	m.Epoch = ""
+	return nil
+}
+
+// Expiry returns when the message expires, and false if it never does
+func (m *Message) Expiry() (time.Time, bool) {
+	if m.ExpiresAt != nil {
+		return *m.ExpiresAt, true
+	}
+	if m.TTL != 0 {
+		// a duration holds about 292 years, longer lifetimes are cut short to it
+		ttl := time.Duration(math.MaxInt64)
+		if m.TTL < ttl.Seconds() {
+			ttl = time.Duration(m.TTL * float64(time.Second))
+		}
+		return m.Timestamp.Add(ttl), true
+	}
+	return time.Time{}, false
+}
+
+// Expired returns true if the message expired at now. Expired messages are dropped
+// wherever they wait instead of being delivered
+func (m *Message) Expired(now time.Time) bool {
+	expiry, ok := m.Expiry()
+	return ok && !now.Before(expiry)
+}
+
+// Expired returns true if the json encoded message expired at now. Messages without
+// an expiry are not decoded.
+func Expired(data []byte, now time.Time) bool {
+	if !bytes.Contains(data, []byte(`"ttl"`)) && !bytes.Contains(data, []byte(`"expires_at"`)) {
+		return false
+	}
+	var stub struct {
+		Timestamp time.Time  `json:"timestamp"`
+		TTL       float64    `json:"ttl"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(data, &stub); err != nil {
+		return false
+	}
+	message := Message{Timestamp: stub.Timestamp, TTL: stub.TTL, ExpiresAt: stub.ExpiresAt}
+	return message.Expired(now)
 }
 
 type LabelPair struct {
@@ -0,0 +1,98 @@
+package connectionstore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMessage_Expired(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Minute)
+	for _, test := range []struct {
+		message Message
+		expired bool
+	}{
+		{Message{Timestamp: now.Add(-time.Hour)}, false},
+		{Message{Timestamp: now.Add(-2 * time.Second), TTL: 1}, true},
+		{Message{Timestamp: now.Add(-2 * time.Second), TTL: 2.5}, false},
+		{Message{Timestamp: now, TTL: 1, ExpiresAt: &now}, true},
+		{Message{Timestamp: now.Add(-time.Hour), TTL: 1, ExpiresAt: &later}, false},
+		{Message{Timestamp: now.Add(-time.Hour), TTL: 1e12}, false},
+	} {
+		if expired := test.message.Expired(now); expired != test.expired {
+			t.Errorf("expected expired %v for %+v, got %v", test.expired, test.message, expired)
+		}
+		data, _ := json.Marshal(test.message)
+		if expired := Expired(data, now); expired != test.expired {
+			t.Errorf("expected expired %v for %s, got %v", test.expired, data, expired)
+		}
+	}
+}
+
+func TestMessage_Validate(t *testing.T) {
+	for _, test := range []struct {
+		message Message
+		err     error
+	}{
+		{Message{TTL: 60}, nil},
+		{Message{TTL: -1}, InvalidTtlErr},
+		{Message{TTL: MaxTTL.Seconds() + 1}, TtlTooLongErr},
+		{Message{TTL: 1e12}, TtlTooLongErr},
+		{Message{LabelPairs: []LabelPair{{Name: "a", Value: []int{1}}}}, InvalidLabelValueErr},
+	} {
+		if err := test.message.Validate(); err != test.err {
+			t.Errorf("expected %v for %+v, got %v", test.err, test.message, err)
+		}
+	}
+
+	message := Message{Seq: 42}
+	if err := message.Validate(); err != nil || message.Seq != 0 {
+		t.Errorf("a publisher's seq should be cleared, got %v and %v", message.Seq, err)
+	}
+}
+
+func TestStores_DropExpiredMessages(t *testing.T) {
+	for name, store := range map[string]ConnectionStore{
+		"map":     newMapStore(),
+		"sharded": NewShardedStore(4),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// ch is not read for a while, so the writer holds the second message and
+			// the others wait in the queue, for less than SendTimeout
+			ch := make(chan []byte, 1)
+			store.AddConnection(NewConnection(ch, nil))
+			now := time.Now()
+			past := now.Add(-time.Second)
+
+			// already expired when published
+			numOfSent, _, _ := store.SendMessage(Message{Timestamp: now, Body: "late", ExpiresAt: &past})
+			if numOfSent != 0 {
+				t.Errorf("expected an expired message not to be queued, got %v sent", numOfSent)
+			}
+			store.SendMessage(Message{Timestamp: now, Body: "buffered"})
+			store.SendMessage(Message{Timestamp: now, Body: "held"})
+			store.SendMessage(Message{Timestamp: now, Body: "short lived", TTL: 0.02})
+			store.SendMessage(Message{Timestamp: now, Body: "lasting", TTL: 60})
+			time.Sleep(SendTimeout / 2)
+
+			var bodies []interface{}
+			for len(bodies) < 3 {
+				select {
+				case data := <-ch:
+					var message Message
+					json.Unmarshal(data, &message)
+					bodies = append(bodies, message.Body)
+				case <-time.After(time.Second):
+					t.Fatalf("expected 3 messages, got %v", bodies)
+				}
+			}
+			if bodies[0] != "buffered" || bodies[1] != "held" || bodies[2] != "lasting" {
+				t.Errorf("expected the short lived message to be dropped, got %v", bodies)
+			}
+			if expired := store.Stats().TotalMessagesExpired; expired != 2 {
+				t.Errorf("expected 2 expired messages, got %v", expired)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package connectionstore
+
+import (
+	"github.com/JonathanRosado/Bithose/metrics"
+	"time"
+)
+
+var (
+	subscriptionsGauge = metrics.NewGauge("bithose_subscriptions",
+		"Subscriptions in the connection store.")
+	messagesPublished = metrics.NewCounter("bithose_messages_published_total",
+		"Messages published to the connection store.")
+	messagesDelivered = metrics.NewCounter("bithose_messages_delivered_total",
+		"Messages handed to a subscriber.")
+	messagesTimedOut = metrics.NewCounter("bithose_messages_timed_out_total",
+		"Messages dropped because a subscriber did not accept them in time, which drops the subscriber.")
+	messagesExpired = metrics.NewCounter("bithose_messages_expired_total",
+		"Messages dropped instead of delivered to a subscriber because they expired.")
+	subscriptionsInvalid = metrics.NewCounter("bithose_subscriptions_invalid_total",
+		"Subscribers dropped because their criteria could not be evaluated.")
+	retainedEvicted = metrics.NewCounter("bithose_retained_messages_evicted_total",
+		"Retained messages forgotten because the store kept the most it may.")
+	publishFanout = metrics.NewHistogram("bithose_publish_fanout",
+		"Number of subscribers a published message was queued for.",
+		[]float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000})
+	publishDuration = metrics.NewHistogram("bithose_publish_duration_seconds",
+		"Time taken to queue a published message for its subscribers.", metrics.LatencyBuckets)
+	deliveryDuration = metrics.NewHistogram("bithose_delivery_duration_seconds",
+		"Time a message waited in a subscriber's queue before the subscriber accepted it.", metrics.LatencyBuckets)
+	queuedMessages = metrics.NewGauge("bithose_queued_messages",
+		"Messages waiting in subscriber queues.")
+	queueDepth = metrics.NewHistogram("bithose_queue_depth",
+		"Depth of a subscriber's queue when a message is queued for it.", metrics.ExponentialBuckets(1, 2, 10))
+)
+
+// observePublish records a publish that started at start and was queued for
+// numOfSent subscribers
+func observePublish(start time.Time, numOfSent int) {
+	messagesPublished.Inc()
+	publishFanout.Observe(float64(numOfSent))
+	publishDuration.Observe(time.Since(start).Seconds())
+}
+
+// QueuedMessages returns the number of messages waiting in the subscriber queues of
+// every store
+func QueuedMessages() int {
+	return int(queuedMessages.Value())
+}
+
+// countExpired counts a message dropped because it expired
+func countExpired(stats *Statistics) {
+	stats.IncrementMessageExpired()
+	messagesExpired.Inc()
+}
+
+// DropExpired returns true if the json encoded message expired, counting it in stats.
+// It is meant for the buffers messages wait in after leaving the store.
+func DropExpired(data []byte, stats *Statistics) bool {
+	if !Expired(data, time.Now()) {
+		return false
+	}
+	countExpired(stats)
+	return true
+}
@@ -0,0 +1,130 @@
+package connectionstore
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// SendTimeout is how long a connection's writer waits for the connection to
+	// accept a message before the connection is considered stale and removed
+	SendTimeout = time.Millisecond * 100
+
+	// QueueSize is the number of messages queued for each connection while its
+	// writer is waiting on the connection
+	QueueSize = 256
+)
+
+// queuedMessage is a message waiting in a queue since queued
+type queuedMessage struct {
+	data   []byte
+	queued time.Time
+	// published is the Timestamp of the message
+	published time.Time
+	// expires is when the message expires, zero if it does not
+	expires time.Time
+}
+
+// expired returns true if the message expired at now
+func (m queuedMessage) expired(now time.Time) bool {
+	return !m.expires.IsZero() && !now.Before(m.expires)
+}
+
+// connectionQueue holds the messages published to a connection until its writer
+// goroutine hands them to the connection's channel. Publishing only ever enqueues,
+// so a slow connection never blocks a publisher.
+type connectionQueue struct {
+	uuid       string
+	connection *Connection
+	messages   chan queuedMessage
+	stop       chan struct{}
+	stopOnce   *sync.Once
+	// stale is set before stop is closed when the connection was dropped for not
+	// accepting messages
+	stale bool
+}
+
+func newConnectionQueue(uuid string, connection *Connection) *connectionQueue {
+	return &connectionQueue{
+		uuid:       uuid,
+		connection: connection,
+		messages:   make(chan queuedMessage, QueueSize),
+		stop:       make(chan struct{}),
+		stopOnce:   &sync.Once{},
+	}
+}
+
+// enqueue returns false if the queue is full
+func (q *connectionQueue) enqueue(message queuedMessage) bool {
+	// counted before it can be dequeued, so that the gauge never goes negative
+	queuedMessages.Inc()
+	select {
+	case q.messages <- message:
+		queueDepth.Observe(float64(len(q.messages)))
+		return true
+	default:
+		queuedMessages.Dec()
+		return false
+	}
+}
+
+// close stops the writer. It is safe to call more than once.
+func (q *connectionQueue) close(stale bool) {
+	q.stopOnce.Do(func() {
+		q.stale = stale
+		close(q.stop)
+	})
+}
+
+// write hands the queued messages to the connection's channel until the queue is
+// closed or the connection does not accept a message within SendTimeout.
+func (q *connectionQueue) write(stats *Statistics, onStale func(q *connectionQueue)) {
+	timer := time.NewTimer(SendTimeout)
+	timer.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case message := <-q.messages:
+			queuedMessages.Dec()
+			if message.expired(time.Now()) {
+				countExpired(stats)
+				continue
+			}
+			select {
+			case q.connection.Ch <- message.data:
+				stats.IncrementMessageDelivered(message.published)
+				observeDelivery(message)
+				continue
+			case <-q.stop:
+				return
+			default:
+			}
+
+			// if we have to wait, we will assume the connection is stale once the timeout passes
+			timer.Reset(SendTimeout)
+			select {
+			case q.connection.Ch <- message.data:
+				stats.IncrementMessageDelivered(message.published)
+				observeDelivery(message)
+				if !timer.Stop() {
+					<-timer.C
+				}
+			case <-timer.C:
+				stats.IncrementMessageTimeout()
+				messagesTimedOut.Inc()
+				onStale(q)
+				return
+			case <-q.stop:
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+func observeDelivery(message queuedMessage) {
+	messagesDelivered.Inc()
+	deliveryDuration.Observe(time.Since(message.queued).Seconds())
+}
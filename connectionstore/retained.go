@@ -0,0 +1,174 @@
+package connectionstore
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxRetainedMessages is the number of label sets a store keeps a retained message
+// for. Past it, the label set updated the longest ago is evicted
+var MaxRetainedMessages = 10000
+
+// retainedMessage is the last retained message published with a label set, with its
+// json encoding
+type retainedMessage struct {
+	key     string
+	message Message
+	data    []byte
+}
+
+// retainedMessages keeps the last retained message of every distinct label set, to be
+// queued for new connections. A store keeps one for all its shards.
+type retainedMessages struct {
+	// gate is held for writing while a retained message is updated and published,
+	// and for reading while a connection is added, so that a new connection gets
+	// either the retained message or the live one
+	gate *sync.RWMutex
+
+	mtx      *sync.RWMutex
+	messages map[string]*list.Element
+	// order holds the retained messages, the least recently updated first
+	order *list.List
+	stats *Statistics
+}
+
+func newRetainedMessages() *retainedMessages {
+	return &retainedMessages{
+		gate:     &sync.RWMutex{},
+		mtx:      &sync.RWMutex{},
+		messages: map[string]*list.Element{},
+		order:    list.New(),
+		stats:    NewStatistics(),
+	}
+}
+
+// publish sends the message with send, updating the retained messages first if it
+// is retained
+func (r *retainedMessages) publish(message Message, data []byte, send func() (int, int, error)) (int, int, error) {
+	// a message that expired before it was published is not kept
+	if !message.Retain || message.Expired(time.Now()) {
+		return send()
+	}
+	r.gate.Lock()
+	defer r.gate.Unlock()
+	r.update(message, data)
+	return send()
+}
+
+// add adds a connection with add, which queues the retained messages for it
+func (r *retainedMessages) add(add func()) {
+	r.gate.RLock()
+	defer r.gate.RUnlock()
+	add()
+}
+
+// labelSetKey identifies the label set regardless of the order of the pairs
+func labelSetKey(pairs []LabelPair) string {
+	sorted := make([]LabelPair, len(pairs))
+	for i, pair := range pairs {
+		value, ok := NormalizeLabelValue(pair.Value)
+		if !ok {
+			value = pair.Value
+		}
+		sorted[i] = LabelPair{Name: pair.Name, Value: value}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	key, _ := json.Marshal(sorted)
+	return string(key)
+}
+
+// isEmptyBody returns true for the bodies that clear a retained message
+func isEmptyBody(body interface{}) bool {
+	return body == nil || body == ""
+}
+
+// update keeps the message if it is retained, or forgets the retained message of its
+// label set if its body is empty
+func (r *retainedMessages) update(message Message, data []byte) {
+	if !message.Retain {
+		return
+	}
+	key := labelSetKey(message.LabelPairs)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	element, exists := r.messages[key]
+	if isEmptyBody(message.Body) {
+		if exists {
+			r.remove(element)
+		}
+		return
+	}
+	retained := retainedMessage{key: key, message: message, data: data}
+	if exists {
+		element.Value = retained
+		r.order.MoveToBack(element)
+		return
+	}
+	r.messages[key] = r.order.PushBack(retained)
+	for r.order.Len() > MaxRetainedMessages {
+		r.remove(r.order.Front())
+		r.stats.IncrementRetainedEvicted()
+		retainedEvicted.Inc()
+	}
+}
+
+// remove forgets the retained message of the element. The write lock must be held.
+func (r *retainedMessages) remove(element *list.Element) {
+	delete(r.messages, element.Value.(retainedMessage).key)
+	r.order.Remove(element)
+}
+
+// matching returns the retained messages the connection accepts, oldest first.
+// Expired messages are forgotten.
+func (r *retainedMessages) matching(connection *Connection) []retainedMessage {
+	now := time.Now()
+	var matching []retainedMessage
+	var expired []string
+	r.mtx.RLock()
+	for key, element := range r.messages {
+		retained := element.Value.(retainedMessage)
+		if retained.message.Expired(now) {
+			expired = append(expired, key)
+			continue
+		}
+		if accepts, err := connection.AcceptsLabels(retained.message.LabelPairs); err == nil && accepts {
+			matching = append(matching, retained)
+		}
+	}
+	r.mtx.RUnlock()
+
+	if len(expired) > 0 {
+		r.mtx.Lock()
+		for _, key := range expired {
+			// unless a newer message replaced it meanwhile
+			if element, ok := r.messages[key]; ok {
+				if retained := element.Value.(retainedMessage); retained.message.Expired(now) {
+					r.remove(element)
+				}
+			}
+		}
+		r.mtx.Unlock()
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].message.Timestamp.Before(matching[j].message.Timestamp)
+	})
+	return matching
+}
+
+// queueFor queues the retained messages the connection accepts, as many as fit
+func (r *retainedMessages) queueFor(queue *connectionQueue) {
+	now := time.Now()
+	for _, retained := range r.matching(queue.connection) {
+		expires, _ := retained.message.Expiry()
+		if !queue.enqueue(queuedMessage{data: retained.data, queued: now, published: retained.message.Timestamp, expires: expires}) {
+			return
+		}
+	}
+}
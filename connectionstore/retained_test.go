@@ -0,0 +1,108 @@
+package connectionstore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// receive returns the bodies of the messages arriving on ch within the timeout
+func receive(ch chan []byte, timeout time.Duration) []interface{} {
+	var bodies []interface{}
+	for {
+		select {
+		case data := <-ch:
+			var message Message
+			json.Unmarshal(data, &message)
+			bodies = append(bodies, message.Body)
+		case <-time.After(timeout):
+			return bodies
+		}
+	}
+}
+
+func TestStores_RetainedMessages(t *testing.T) {
+	for name, store := range map[string]ConnectionStore{
+		"map":     newMapStore(),
+		"sharded": NewShardedStore(4),
+	} {
+		t.Run(name, func(t *testing.T) {
+			publish := func(body interface{}, retain bool, pairs ...LabelPair) {
+				store.SendMessage(Message{LabelPairs: pairs, Timestamp: time.Now(), Body: body, Retain: retain})
+			}
+			chart := LabelPair{Name: "chart", Value: "cpu"}
+
+			publish(1.0, true, chart, LabelPair{Name: "host", Value: "a"})
+			publish(2.0, true, LabelPair{Name: "host", Value: "a"}, chart)
+			publish(3.0, true, chart, LabelPair{Name: "host", Value: "b"})
+			publish(4.0, false, chart, LabelPair{Name: "host", Value: "c"})
+			publish("other", true, LabelPair{Name: "chart", Value: "memory"}, LabelPair{Name: "host", Value: "a"})
+
+			// the last value of each label set, in publish order
+			ch := make(chan []byte, 10)
+			criteria := []LabelAcceptanceCriterion{{LabelPair: chart, Operator: "=="}}
+			uuid, _ := store.AddConnection(NewConnection(ch, criteria))
+			if bodies := receive(ch, 50*time.Millisecond); len(bodies) != 2 || bodies[0] != 2.0 || bodies[1] != 3.0 {
+				t.Errorf("expected the retained 2 and 3, got %v", bodies)
+			}
+			store.RemoveConnection(uuid)
+
+			// an empty body clears the value, and is delivered like any message
+			publish(nil, true, chart, LabelPair{Name: "host", Value: "b"})
+			ch = make(chan []byte, 10)
+			store.AddConnection(NewConnection(ch, criteria))
+			if bodies := receive(ch, 50*time.Millisecond); len(bodies) != 1 || bodies[0] != 2.0 {
+				t.Errorf("expected only the retained 2, got %v", bodies)
+			}
+			publish(5.0, false, chart, LabelPair{Name: "host", Value: "a"})
+			if bodies := receive(ch, 50*time.Millisecond); len(bodies) != 1 || bodies[0] != 5.0 {
+				t.Errorf("expected the live 5, got %v", bodies)
+			}
+		})
+	}
+}
+
+func TestStores_ExpiredRetainedMessages(t *testing.T) {
+	store := NewShardedStore(2)
+	presence := LabelPair{Name: "presence", Value: "expiring"}
+	store.SendMessage(Message{LabelPairs: []LabelPair{presence}, Timestamp: time.Now(), Body: "online", Retain: true, TTL: 0.05})
+	time.Sleep(100 * time.Millisecond)
+
+	ch := make(chan []byte, 10)
+	store.AddConnection(NewConnection(ch, nil))
+	if bodies := receive(ch, 50*time.Millisecond); len(bodies) != 0 {
+		t.Errorf("expected the expired retained message to be dropped, got %v", bodies)
+	}
+}
+
+func TestStores_EvictRetainedMessages(t *testing.T) {
+	defer func(max int) {
+		MaxRetainedMessages = max
+	}(MaxRetainedMessages)
+	MaxRetainedMessages = 2
+
+	for name, store := range map[string]ConnectionStore{
+		"map":     newMapStore(),
+		"sharded": NewShardedStore(4),
+	} {
+		t.Run(name, func(t *testing.T) {
+			publish := func(body interface{}, host string) {
+				store.SendMessage(Message{LabelPairs: []LabelPair{{Name: "host", Value: host}}, Timestamp: time.Now(), Body: body, Retain: true})
+			}
+			publish(1.0, "a")
+			publish(2.0, "b")
+			publish(3.0, "a")
+			publish(4.0, "c")
+
+			// b was updated the longest ago, and the shards share the kept messages
+			ch := make(chan []byte, 10)
+			store.AddConnection(NewConnection(ch, nil))
+			if bodies := receive(ch, 50*time.Millisecond); len(bodies) != 2 || bodies[0] != 3.0 || bodies[1] != 4.0 {
+				t.Errorf("expected the retained 3 and 4, got %v", bodies)
+			}
+			if evicted := store.Stats().TotalRetainedEvicted; evicted != 1 {
+				t.Errorf("expected 1 eviction, got %v", evicted)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package connectionstore
+
+import (
+	"sync"
+)
+
+// Sequencer hands the turn to deliver a message from one sequence number to the
+// next. Stores number and keep messages under a short lock and deliver them
+// concurrently with the next ones being numbered, while subscribers still receive
+// them in sequence order.
+type Sequencer struct {
+	mtx  *sync.Mutex
+	next int64
+	// turns holds a channel for every sequence number waiting its turn, closed
+	// when the one before it is done
+	turns map[int64]chan struct{}
+}
+
+// NewSequencer returns a Sequencer whose first turn goes to the sequence number first
+func NewSequencer(first int64) *Sequencer {
+	return &Sequencer{
+		mtx:   &sync.Mutex{},
+		next:  first,
+		turns: map[int64]chan struct{}{},
+	}
+}
+
+// Wait blocks until every sequence number before seq is done. Every sequence number
+// must be waited for and then done exactly once.
+func (s *Sequencer) Wait(seq int64) {
+	s.mtx.Lock()
+	if seq == s.next {
+		s.mtx.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	s.turns[seq] = turn
+	s.mtx.Unlock()
+	<-turn
+}
+
+// Done passes the turn to the sequence number after seq
+func (s *Sequencer) Done(seq int64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.next = seq + 1
+	if turn, ok := s.turns[s.next]; ok {
+		delete(s.turns, s.next)
+		close(turn)
+	}
+}
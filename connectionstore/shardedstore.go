@@ -0,0 +1,103 @@
+package connectionstore
+
+import (
+	"encoding/json"
+	UuidLib "github.com/google/uuid"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ShardedStore spreads connections across independently locked MapStores so that
+// publishes and subscribes on different shards do not contend on a single lock.
+// A connection's shard is picked by hashing its uuid, and every publish fans out
+// to all shards in parallel.
+type ShardedStore struct {
+	shards   []*MapStore
+	retained *retainedMessages
+}
+
+func NewShardedStore(numOfShards int) *ShardedStore {
+	if numOfShards < 1 {
+		numOfShards = 1
+	}
+	retained := newRetainedMessages()
+	shards := make([]*MapStore, numOfShards)
+	for i := range shards {
+		shards[i] = newShard(retained)
+	}
+	return &ShardedStore{
+		shards:   shards,
+		retained: retained,
+	}
+}
+
+func (s *ShardedStore) shard(uuid string) *MapStore {
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *ShardedStore) AddConnection(connection *Connection) (string, error) {
+	// if no uuid is provided, generate one
+	u := UuidLib.New()
+	uuid := u.String()
+
+	s.retained.add(func() {
+		s.shard(uuid).addConnection(uuid, connection)
+	})
+	return uuid, nil
+}
+
+func (s *ShardedStore) RemoveConnection(uuid string) {
+	s.shard(uuid).RemoveConnection(uuid)
+}
+
+func (s *ShardedStore) GetConnection(uuid string) (connection *Connection, exists bool) {
+	return s.shard(uuid).GetConnection(uuid)
+}
+
+func (s *ShardedStore) SendMessage(message Message) (numOfSent int, numOfTimeouts int, err error) {
+	start := time.Now()
+
+	// convert message to json once for all the shards
+	jsonMsg, err := json.Marshal(message)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	numOfSent, numOfTimeouts, err = s.retained.publish(message, jsonMsg, func() (numOfSent int, numOfTimeouts int, err error) {
+		mtx := &sync.Mutex{}
+		wg := &sync.WaitGroup{}
+		for _, shard := range s.shards {
+			wg.Add(1)
+			go func(shard *MapStore) {
+				defer wg.Done()
+				shardSent, shardTimeouts, shardErr := shard.sendJsonMessage(message, jsonMsg)
+
+				mtx.Lock()
+				defer mtx.Unlock()
+				numOfSent += shardSent
+				numOfTimeouts += shardTimeouts
+				if shardErr != nil && err == nil {
+					err = shardErr
+				}
+			}(shard)
+		}
+		wg.Wait()
+		return numOfSent, numOfTimeouts, err
+	})
+
+	observePublish(start, numOfSent)
+	return numOfSent, numOfTimeouts, err
+}
+
+// Stats returns the sum of the statistics of every shard
+func (s *ShardedStore) Stats() *Statistics {
+	stats := NewStatistics()
+	for _, shard := range s.shards {
+		stats.Add(shard.stats)
+	}
+	stats.Add(s.retained.stats)
+	return stats
+}
@@ -0,0 +1,129 @@
+package connectionstore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShardedStore_AddAndRemoveConnection(t *testing.T) {
+	ss := NewShardedStore(4)
+	ch := make(chan []byte)
+	uuid, _ := ss.AddConnection(NewConnection(ch, []LabelAcceptanceCriterion{
+		{
+			LabelPair: LabelPair{
+				Name:  "channel",
+				Value: "da_boys",
+			},
+			Operator: "==",
+		},
+	}))
+
+	if connection, exists := ss.GetConnection(uuid); !exists || connection == nil {
+		t.Fatal("connection should exist")
+	}
+
+	ss.RemoveConnection(uuid)
+	if _, exists := ss.GetConnection(uuid); exists {
+		t.Error("connection should not exist")
+	}
+}
+
+func TestShardedStore_SendMessageToAllShards(t *testing.T) {
+	ss := NewShardedStore(4)
+	ch := make(chan []byte, 100)
+	for i := 0; i < 100; i++ {
+		ss.AddConnection(NewConnection(ch, []LabelAcceptanceCriterion{
+			{
+				LabelPair: LabelPair{
+					Name:  "channel",
+					Value: "channel_" + strconv.Itoa(i%2),
+				},
+				Operator: "==",
+			},
+		}))
+	}
+
+	numOfSent, numOfTimeouts, err := ss.SendMessage(Message{
+		LabelPairs: []LabelPair{
+			{
+				Name:  "channel",
+				Value: "channel_0",
+			},
+		},
+		Timestamp: time.Now(),
+		Body:      "hello there",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numOfSent != 50 || numOfTimeouts != 0 {
+		t.Errorf("expected 50 sent and 0 timeouts, got %v and %v", numOfSent, numOfTimeouts)
+	}
+
+	for i := 0; i < 50; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("only received %v messages", i)
+		}
+	}
+
+	// writers count a message as sent right after handing it over
+	time.Sleep(time.Millisecond * 10)
+
+	stats := ss.Stats()
+	if stats.TotalConnections != 100 {
+		t.Errorf("expected 100 connections across shards, got %v", stats.TotalConnections)
+	}
+	if stats.TotalMessagesSent != 50 {
+		t.Errorf("expected 50 messages sent across shards, got %v", stats.TotalMessagesSent)
+	}
+}
+
+func BenchmarkShardedStore_SendMessageParallel(b *testing.B) {
+	ss := NewShardedStore(8)
+	ch := make(chan []byte, 1024)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10000; i++ {
+		ss.AddConnection(NewConnection(ch, []LabelAcceptanceCriterion{
+			{
+				LabelPair: LabelPair{
+					Name:  "channel",
+					Value: "channel_" + strconv.Itoa(i%1000),
+				},
+				Operator: "==",
+			},
+		}))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ss.SendMessage(Message{
+				LabelPairs: []LabelPair{
+					{
+						Name:  "channel",
+						Value: "channel_" + strconv.Itoa(i%1000),
+					},
+				},
+				Timestamp: time.Now(),
+				Body:      "hello",
+			})
+			i++
+		}
+	})
+}
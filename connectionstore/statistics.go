@@ -0,0 +1,384 @@
+package connectionstore
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StatisticsSlotWidth is the granularity of windowed statistics. Windows are
+	// multiples of it.
+	StatisticsSlotWidth = 5 * time.Second
+
+	// MaxStatisticsWindow is the longest window statistics are kept for
+	MaxStatisticsWindow = 15 * time.Minute
+
+	// one more slot than the longest window, for the slot being filled
+	statisticsSlots = int(MaxStatisticsWindow/StatisticsSlotWidth) + 1
+
+	latencyBuckets = 64
+)
+
+var (
+	// DefaultStatisticsWindows are the windows of a snapshot when none are asked for
+	DefaultStatisticsWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+	InvalidStatisticsWindowErr = errors.New("statistics windows must be multiples of 5s up to 15m")
+
+	// latencyBounds are the upper bounds of the latency buckets, growing by a quarter
+	// from 50µs to about a minute
+	latencyBounds = func() (bounds [latencyBuckets]time.Duration) {
+		for i := range bounds {
+			bounds[i] = time.Duration(float64(50*time.Microsecond) * math.Pow(1.25, float64(i)))
+		}
+		return bounds
+	}()
+)
+
+type Statistics struct {
+	TotalConnections     int `json:"total_connections"`
+	TotalMessagesSent    int `json:"total_messages_sent"`
+	TotalMessagesTimeout int `json:"total_messages_timeout"`
+	// TotalMessagesExpired counts the messages dropped instead of delivered to a
+	// subscriber because they expired
+	TotalMessagesExpired int `json:"total_messages_expired"`
+
+	// TotalPublishesRejected counts the messages publishers were not allowed to send
+	TotalPublishesRejected int `json:"total_publishes_rejected"`
+	// PeakConnections is the most connections there were at once
+	PeakConnections int `json:"peak_connections"`
+	// TotalConnectionsReaped counts the connections closed for not answering pings
+	TotalConnectionsReaped int `json:"total_connections_reaped"`
+	// TotalRetainedEvicted counts the retained messages forgotten because the store
+	// kept MaxRetainedMessages
+	TotalRetainedEvicted int `json:"total_retained_evicted"`
+	// TotalConnectionsInvalid counts the connections dropped because their criteria
+	// could not be evaluated
+	TotalConnectionsInvalid int `json:"total_connections_invalid"`
+	mtx                     *sync.RWMutex
+	// slots holds the windowed statistics, allocated on first use
+	slots *[statisticsSlots]statisticsSlot
+}
+
+// statisticsSlot holds what happened during one StatisticsSlotWidth
+type statisticsSlot struct {
+	// index is the number of slot widths since the epoch, zero if the slot is unused
+	index           int64
+	sent            int
+	timeouts        int
+	expired         int
+	peakConnections int
+	// latencies counts the deliveries by latency bucket, the last one counting the
+	// latencies above every bound
+	latencies [latencyBuckets + 1]uint32
+}
+
+func NewStatistics() *Statistics {
+	return &Statistics{
+		TotalConnections:     0,
+		TotalMessagesSent:    0,
+		TotalMessagesTimeout: 0,
+		mtx:                  &sync.RWMutex{},
+	}
+}
+
+// slot returns the slot of the time, emptied if it still holds an older time. The
+// write lock must be held.
+func (s *Statistics) slot(now time.Time) *statisticsSlot {
+	if s.slots == nil {
+		s.slots = &[statisticsSlots]statisticsSlot{}
+	}
+	index := now.UnixNano() / int64(StatisticsSlotWidth)
+	slot := &s.slots[index%int64(statisticsSlots)]
+	if slot.index != index {
+		*slot = statisticsSlot{index: index, peakConnections: s.TotalConnections}
+	}
+	return slot
+}
+
+// Add adds the counters of other to s. Since the peak of a sum is at most the sum of
+// the peaks, summed peak connections are an upper bound.
+func (s *Statistics) Add(other *Statistics) {
+	other.mtx.RLock()
+	defer other.mtx.RUnlock()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalConnections += other.TotalConnections
+	s.TotalMessagesSent += other.TotalMessagesSent
+	s.TotalMessagesTimeout += other.TotalMessagesTimeout
+	s.TotalMessagesExpired += other.TotalMessagesExpired
+	s.TotalPublishesRejected += other.TotalPublishesRejected
+	s.PeakConnections += other.PeakConnections
+	s.TotalConnectionsReaped += other.TotalConnectionsReaped
+	s.TotalRetainedEvicted += other.TotalRetainedEvicted
+	s.TotalConnectionsInvalid += other.TotalConnectionsInvalid
+
+	if other.slots == nil {
+		return
+	}
+	if s.slots == nil {
+		s.slots = &[statisticsSlots]statisticsSlot{}
+	}
+	for i := range other.slots {
+		otherSlot := &other.slots[i]
+		slot := &s.slots[i]
+		if otherSlot.index == 0 || slot.index > otherSlot.index {
+			continue
+		}
+		if slot.index < otherSlot.index {
+			*slot = statisticsSlot{index: otherSlot.index}
+		}
+		slot.sent += otherSlot.sent
+		slot.timeouts += otherSlot.timeouts
+		slot.expired += otherSlot.expired
+		slot.peakConnections += otherSlot.peakConnections
+		for j, n := range otherSlot.latencies {
+			slot.latencies[j] += n
+		}
+	}
+}
+
+// Copy returns a copy of the statistics, which later updates do not change
+func (s *Statistics) Copy() *Statistics {
+	c := NewStatistics()
+	c.Add(s)
+	return c
+}
+
+func (s *Statistics) IncrementConnection() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalConnections++
+	if s.TotalConnections > s.PeakConnections {
+		s.PeakConnections = s.TotalConnections
+	}
+	if slot := s.slot(time.Now()); s.TotalConnections > slot.peakConnections {
+		slot.peakConnections = s.TotalConnections
+	}
+}
+
+func (s *Statistics) DecrementConnection() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalConnections--
+}
+
+func (s *Statistics) IncrementMessageSent() {
+	s.IncrementMessageDelivered(time.Time{})
+}
+
+// IncrementMessageDelivered counts a sent message and, unless published is zero,
+// the time it took to deliver since it was published
+func (s *Statistics) IncrementMessageDelivered(published time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	s.TotalMessagesSent++
+	slot := s.slot(now)
+	slot.sent++
+	if !published.IsZero() {
+		slot.latencies[latencyBucket(now.Sub(published))]++
+	}
+}
+
+func (s *Statistics) IncrementMessageTimeout() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalMessagesTimeout++
+	s.slot(time.Now()).timeouts++
+}
+
+func (s *Statistics) IncrementMessageExpired() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalMessagesExpired++
+	s.slot(time.Now()).expired++
+}
+
+func (s *Statistics) IncrementPublishRejected() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalPublishesRejected++
+}
+
+func (s *Statistics) IncrementConnectionReaped() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalConnectionsReaped++
+}
+
+func (s *Statistics) IncrementRetainedEvicted() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalRetainedEvicted++
+}
+
+func (s *Statistics) IncrementConnectionInvalid() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.TotalConnectionsInvalid++
+}
+
+// latencyBucket returns the index of the first bucket whose bound is not less than
+// the latency. Negative latencies, from clocks that disagree, count as zero.
+func latencyBucket(latency time.Duration) int {
+	return sort.Search(latencyBuckets, func(i int) bool {
+		return latencyBounds[i] >= latency
+	})
+}
+
+// StatisticsSnapshot is a consistent copy of the counters of Statistics along with
+// their windowed statistics
+type StatisticsSnapshot struct {
+	TotalConnections        int                `json:"total_connections"`
+	TotalMessagesSent       int                `json:"total_messages_sent"`
+	TotalMessagesTimeout    int                `json:"total_messages_timeout"`
+	TotalMessagesExpired    int                `json:"total_messages_expired"`
+	TotalPublishesRejected  int                `json:"total_publishes_rejected"`
+	PeakConnections         int                `json:"peak_connections"`
+	TotalConnectionsReaped  int                `json:"total_connections_reaped"`
+	TotalRetainedEvicted    int                `json:"total_retained_evicted"`
+	TotalConnectionsInvalid int                `json:"total_connections_invalid"`
+	Windows                 []WindowStatistics `json:"windows"`
+}
+
+// WindowStatistics describes the last Window of activity. Rates are averaged over
+// the whole window, including the slot being filled.
+type WindowStatistics struct {
+	Window            string  `json:"window"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	TimeoutsPerSecond float64 `json:"timeouts_per_second"`
+	ExpiredPerSecond  float64 `json:"expired_per_second"`
+	PeakConnections   int     `json:"peak_connections"`
+	// Latency is the time between the Timestamp of the messages sent and their
+	// delivery to a subscriber
+	Latency LatencyStatistics `json:"latency"`
+}
+
+// LatencyStatistics holds latency percentiles in milliseconds. A percentile is the
+// upper bound of the bucket it falls in, which overestimates it by at most a quarter.
+type LatencyStatistics struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+// Snapshot returns the counters and the statistics of each window, or of the
+// DefaultStatisticsWindows if none are given. Windows must be positive multiples of
+// StatisticsSlotWidth up to MaxStatisticsWindow.
+func (s *Statistics) Snapshot(windows ...time.Duration) (StatisticsSnapshot, error) {
+	if len(windows) == 0 {
+		windows = DefaultStatisticsWindows
+	}
+	for _, window := range windows {
+		if window <= 0 || window > MaxStatisticsWindow || window%StatisticsSlotWidth != 0 {
+			return StatisticsSnapshot{}, InvalidStatisticsWindowErr
+		}
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	snapshot := StatisticsSnapshot{
+		TotalConnections:        s.TotalConnections,
+		TotalMessagesSent:       s.TotalMessagesSent,
+		TotalMessagesTimeout:    s.TotalMessagesTimeout,
+		TotalMessagesExpired:    s.TotalMessagesExpired,
+		TotalPublishesRejected:  s.TotalPublishesRejected,
+		PeakConnections:         s.PeakConnections,
+		TotalConnectionsReaped:  s.TotalConnectionsReaped,
+		TotalRetainedEvicted:    s.TotalRetainedEvicted,
+		TotalConnectionsInvalid: s.TotalConnectionsInvalid,
+		Windows:                 make([]WindowStatistics, len(windows)),
+	}
+	now := time.Now()
+	for i, window := range windows {
+		snapshot.Windows[i] = s.window(now, window)
+	}
+	return snapshot, nil
+}
+
+// window sums the slots of the window ending now. The read lock must be held.
+func (s *Statistics) window(now time.Time, window time.Duration) WindowStatistics {
+	last := now.UnixNano() / int64(StatisticsSlotWidth)
+	first := last - int64(window/StatisticsSlotWidth) + 1
+
+	var sent, timeouts, expired int
+	// slots are only filled on activity, so connections open the whole window
+	// count too
+	peak := s.TotalConnections
+	var latencies [latencyBuckets + 1]uint64
+	if s.slots != nil {
+		for i := range s.slots {
+			slot := &s.slots[i]
+			if slot.index < first || slot.index > last {
+				continue
+			}
+			sent += slot.sent
+			timeouts += slot.timeouts
+			expired += slot.expired
+			if slot.peakConnections > peak {
+				peak = slot.peakConnections
+			}
+			for j, n := range slot.latencies {
+				latencies[j] += uint64(n)
+			}
+		}
+	}
+
+	return WindowStatistics{
+		Window:            formatWindow(window),
+		MessagesPerSecond: float64(sent) / window.Seconds(),
+		TimeoutsPerSecond: float64(timeouts) / window.Seconds(),
+		ExpiredPerSecond:  float64(expired) / window.Seconds(),
+		PeakConnections:   peak,
+		Latency:           latencyStatistics(&latencies),
+	}
+}
+
+func latencyStatistics(latencies *[latencyBuckets + 1]uint64) LatencyStatistics {
+	var count uint64
+	for _, n := range latencies {
+		count += n
+	}
+	if count == 0 {
+		return LatencyStatistics{}
+	}
+
+	percentile := func(p float64) float64 {
+		rank := uint64(math.Ceil(p * float64(count)))
+		var seen uint64
+		for i, n := range latencies {
+			seen += n
+			if seen >= rank {
+				// latencies above every bound are reported as the last bound
+				bound := latencyBounds[latencyBuckets-1]
+				if i < latencyBuckets {
+					bound = latencyBounds[i]
+				}
+				return float64(bound) / float64(time.Millisecond)
+			}
+		}
+		return 0
+	}
+
+	return LatencyStatistics{
+		Count: int(count),
+		P50:   percentile(0.5),
+		P90:   percentile(0.9),
+		P99:   percentile(0.99),
+	}
+}
+
+// formatWindow formats whole minutes without their seconds, 5m rather than 5m0s
+func formatWindow(window time.Duration) string {
+	formatted := window.String()
+	if strings.HasSuffix(formatted, "m0s") {
+		formatted = strings.TrimSuffix(formatted, "0s")
+	}
+	return formatted
+}
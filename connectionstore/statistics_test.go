@@ -0,0 +1,112 @@
+package connectionstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatistics_Snapshot(t *testing.T) {
+	stats := NewStatistics()
+	for i := 0; i < 3; i++ {
+		stats.IncrementConnection()
+	}
+	stats.DecrementConnection()
+	stats.DecrementConnection()
+
+	for i := 0; i < 60; i++ {
+		stats.IncrementMessageDelivered(time.Now().Add(-10 * time.Millisecond))
+	}
+	stats.IncrementMessageSent()
+	stats.IncrementMessageTimeout()
+	stats.IncrementMessageExpired()
+	stats.IncrementMessageExpired()
+
+	// activity from two minutes ago only shows in the longer windows
+	stats.mtx.Lock()
+	old := stats.slot(time.Now().Add(-2 * time.Minute))
+	old.sent = 240
+	old.peakConnections = 5
+	stats.mtx.Unlock()
+
+	snapshot, err := stats.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.TotalConnections != 1 || snapshot.PeakConnections != 3 || snapshot.TotalMessagesSent != 61 {
+		t.Errorf("unexpected counters %+v", snapshot)
+	}
+	if len(snapshot.Windows) != 3 || snapshot.Windows[0].Window != "1m" || snapshot.Windows[2].Window != "15m" {
+		t.Fatalf("unexpected windows %+v", snapshot.Windows)
+	}
+
+	minute := snapshot.Windows[0]
+	if minute.MessagesPerSecond != 61.0/60 || minute.TimeoutsPerSecond != 1.0/60 || minute.ExpiredPerSecond != 2.0/60 {
+		t.Errorf("unexpected rates %v, %v and %v", minute.MessagesPerSecond, minute.TimeoutsPerSecond, minute.ExpiredPerSecond)
+	}
+	if snapshot.TotalMessagesExpired != 2 {
+		t.Errorf("expected 2 expired messages, got %v", snapshot.TotalMessagesExpired)
+	}
+	if minute.PeakConnections != 3 {
+		t.Errorf("expected a peak of 3 connections, got %v", minute.PeakConnections)
+	}
+	if minute.Latency.Count != 60 {
+		t.Errorf("expected 60 latencies, the message without a timestamp left out, got %v", minute.Latency.Count)
+	}
+	for _, p := range []float64{minute.Latency.P50, minute.Latency.P90, minute.Latency.P99} {
+		if p < 10 || p > 12.5 {
+			t.Errorf("expected percentiles around 10ms, got %v", p)
+		}
+	}
+
+	fiveMinutes := snapshot.Windows[1]
+	if fiveMinutes.MessagesPerSecond != 301.0/300 || fiveMinutes.PeakConnections != 5 {
+		t.Errorf("unexpected five minute window %+v", fiveMinutes)
+	}
+}
+
+func TestStatistics_SnapshotWindows(t *testing.T) {
+	stats := NewStatistics()
+
+	snapshot, err := stats.Snapshot(30*time.Second, 90*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Windows[0].Window != "30s" || snapshot.Windows[1].Window != "1m30s" {
+		t.Errorf("unexpected windows %+v", snapshot.Windows)
+	}
+	if snapshot.Windows[0].Latency.Count != 0 || snapshot.Windows[0].Latency.P99 != 0 {
+		t.Errorf("expected no latencies, got %+v", snapshot.Windows[0].Latency)
+	}
+
+	for _, window := range []time.Duration{0, time.Second, 7 * time.Second, time.Hour} {
+		if _, err := stats.Snapshot(window); err != InvalidStatisticsWindowErr {
+			t.Errorf("expected InvalidStatisticsWindowErr for %v, got %v", window, err)
+		}
+	}
+}
+
+func TestStatistics_Add(t *testing.T) {
+	a := NewStatistics()
+	b := NewStatistics()
+	a.IncrementConnection()
+	b.IncrementConnection()
+	b.IncrementConnection()
+	a.IncrementMessageDelivered(time.Now())
+	b.IncrementMessageDelivered(time.Now())
+	b.IncrementMessageTimeout()
+
+	sum := NewStatistics()
+	sum.Add(a)
+	sum.Add(b)
+
+	// later updates do not change the sum
+	a.IncrementMessageSent()
+
+	snapshot, _ := sum.Snapshot(time.Minute)
+	if snapshot.TotalConnections != 3 || snapshot.PeakConnections != 3 || snapshot.TotalMessagesSent != 2 {
+		t.Errorf("unexpected counters %+v", snapshot)
+	}
+	if window := snapshot.Windows[0]; window.MessagesPerSecond != 2.0/60 || window.Latency.Count != 2 || window.PeakConnections != 3 {
+		t.Errorf("unexpected window %+v", window)
+	}
+}
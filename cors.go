@@ -0,0 +1,114 @@
+package Bithose
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CorsPolicy decides which origins may use the server from a browser and what the
+// CORS headers of the responses allow
+type CorsPolicy struct {
+	// AllowedOrigins holds the origins allowed to connect. An origin is either
+	// exact (https://example.com), a wildcard subdomain (https://*.example.com,
+	// which does not match example.com itself) or * for any origin. Origins
+	// without a scheme match any scheme. A port, if given, must match; a
+	// wildcard without a port matches subdomains on any port
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
+var (
+	// Cors is the policy applied by every handler. The default accepts every origin
+	Cors = &CorsPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"POST", "GET", "OPTIONS", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token",
+			"Authorization", "X-Api-Key", "Last-Event-ID"},
+	}
+)
+
+// AllowsOrigin returns true if the origin may use the server. Requests without an
+// origin do not come from a browser and are always allowed.
+func (p *CorsPolicy) AllowsOrigin(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(allowed), "/"))
+		if allowed == "*" {
+			return true
+		}
+
+		allowedHost := allowed
+		if i := strings.Index(allowed, "://"); i >= 0 {
+			if allowed[:i] != scheme {
+				continue
+			}
+			allowedHost = allowed[i+3:]
+		}
+
+		allowedUrl := &url.URL{Host: allowedHost}
+		allowedHost = allowedUrl.Hostname()
+		allowedPort := allowedUrl.Port()
+
+		if strings.HasPrefix(allowedHost, "*.") {
+			if allowedPort != "" && allowedPort != port {
+				continue
+			}
+			if strings.HasSuffix(host, allowedHost[1:]) && len(host) > len(allowedHost)-1 {
+				return true
+			}
+		} else if host == allowedHost && port == allowedPort {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CorsPolicy) allowsAnyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if strings.TrimSpace(allowed) == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCors sets the CORS headers of the response. If the request comes from an
+// origin that is not allowed, it replies with a 403 and returns false.
+func checkCors(writer http.ResponseWriter, request *http.Request) bool {
+	policy := Cors
+	origin := request.Header.Get("Origin")
+
+	if !policy.AllowsOrigin(origin) {
+		log.Printf("rejected request to %s from origin %q", request.URL.Path, origin)
+		http.Error(writer, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	header := writer.Header()
+	if policy.allowsAnyOrigin() && !policy.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else if origin != "" {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+	}
+	if policy.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	header.Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+	header.Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+	return true
+}
@@ -0,0 +1,85 @@
+package Bithose
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCorsPolicy_AllowsOrigin(t *testing.T) {
+	policy := &CorsPolicy{AllowedOrigins: []string{"https://example.com", "https://*.example.org", "*.example.net",
+		"https://example.io:8443", "https://*.example.io:9443"}}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"https://app.example.com", false},
+		{"https://app.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://app.example.org:8443", true},
+		{"https://example.org:8443", false},
+		{"https://example.io:8443", true},
+		{"https://example.io", false},
+		{"https://example.io:9443", false},
+		{"https://app.example.io:9443", true},
+		{"https://app.example.io:8443", false},
+		{"https://app.example.io", false},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://app.example.org", false},
+		{"http://app.example.net", true},
+		{"https://app.example.net", true},
+		{"null", false},
+	}
+	for _, test := range tests {
+		if allowed := policy.AllowsOrigin(test.origin); allowed != test.allowed {
+			t.Errorf("expected %v for %q, got %v", test.allowed, test.origin, allowed)
+		}
+	}
+}
+
+func TestCheckCors(t *testing.T) {
+	defaultCors := Cors
+	defer func() {
+		Cors = defaultCors
+	}()
+
+	request := httptest.NewRequest("GET", "/stats", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	recorder := httptest.NewRecorder()
+	StatsHandler(recorder, request)
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("default policy should allow any origin, got %q", recorder.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	Cors = &CorsPolicy{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedMethods:   []string{"GET"},
+		AllowCredentials: true,
+	}
+
+	recorder = httptest.NewRecorder()
+	StatsHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %v", recorder.Code)
+	}
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("credentialed requests should get the origin back, got %q", recorder.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if recorder.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("credentials should be allowed")
+	}
+
+	request.Header.Set("Origin", "https://evil.com")
+	recorder = httptest.NewRecorder()
+	StatsHandler(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %v", recorder.Code)
+	}
+}
@@ -4,14 +4,45 @@ import (
 	"encoding/json"
 	"github.com/JonathanRosado/Bithose/connectionstore"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// StatsHandler replies with a snapshot of the statistics. The windows of the rates,
+// peaks and latency percentiles can be given as ?window=1m, repeated or comma
+// separated, and default to 1m, 5m and 15m.
 func StatsHandler(writer http.ResponseWriter, request *http.Request) {
-	setCors(writer)
+	if !checkCors(writer, request) {
+		return
+	}
+
+	var windows []time.Duration
+	for _, value := range request.URL.Query()["window"] {
+		for _, part := range strings.Split(value, ",") {
+			window, err := time.ParseDuration(strings.TrimSpace(part))
+			if err != nil {
+				http.Error(writer, "invalid window: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			windows = append(windows, window)
+		}
+	}
+
+	connectionStore := connectionstore.GetStore()
 
-	connectionStore := connectionstore.GetMapStore()
+	stats := connectionstore.NewStatistics()
+	stats.Add(connectionStore.Stats())
+	stats.Add(publishStats)
+	stats.Add(websocketStats)
+	stats.Add(bufferStats)
 
-	jsonData, err := json.Marshal(connectionStore.Stats())
+	snapshot, err := stats.Snapshot(windows...)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jsonData, err := json.Marshal(snapshot)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
 		return
@@ -20,3 +51,78 @@ func StatsHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(jsonData)
 }
+
+// PublishHandler sends the message in the request body to every matching subscriber
+// and replies with a SendMessageResponse. When publisher keys are configured, the
+// X-Api-Key header (or api_key query parameter) must hold a key allowed to publish
+// the message's labels, otherwise the reply is a 403.
+func PublishHandler(writer http.ResponseWriter, request *http.Request) {
+	if !checkCors(writer, request) {
+		return
+	}
+
+	if request.Method == "OPTIONS" {
+		return
+	}
+	if request.Method != "POST" {
+		writeSendMessageResponse(writer, http.StatusMethodNotAllowed, SendMessageResponse{
+			Error: "method not allowed",
+		})
+		return
+	}
+
+	incomingPublish := IncomingPublishRequest{}
+	err := json.NewDecoder(request.Body).Decode(&incomingPublish)
+	if err != nil {
+		writeSendMessageResponse(writer, http.StatusBadRequest, SendMessageResponse{
+			Error: "malformed payload: " + err.Error(),
+		})
+		return
+	}
+
+	message, err := incomingPublish.Message()
+	if err != nil {
+		writeSendMessageResponse(writer, http.StatusBadRequest, SendMessageResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if err := authorizePublish(requestApiKey(request), message.LabelPairs); err != nil {
+		writeSendMessageResponse(writer, http.StatusForbidden, SendMessageResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	connectionStore := connectionstore.GetStore()
+
+	numOfSent, numOfTimeout, err := serverShutdown.publish(connectionStore, message)
+
+	messageResponse := SendMessageResponse{
+		NumberOfSents:    numOfSent,
+		NumberOfTimeouts: numOfTimeout,
+		Error:            "",
+	}
+	status := http.StatusOK
+	if err != nil {
+		messageResponse.Error = err.Error()
+		status = http.StatusInternalServerError
+		if err == ShuttingDownErr {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeSendMessageResponse(writer, status, messageResponse)
+}
+
+func writeSendMessageResponse(writer http.ResponseWriter, status int, response SendMessageResponse) {
+	jsonData, err := json.Marshal(&response)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsonData)
+}
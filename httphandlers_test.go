@@ -0,0 +1,195 @@
+package Bithose
+
+import (
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/auth"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func publish(t *testing.T, method, payload string) (*httptest.ResponseRecorder, SendMessageResponse) {
+	request := httptest.NewRequest(method, "/publish", strings.NewReader(payload))
+	recorder := httptest.NewRecorder()
+	PublishHandler(recorder, request)
+
+	var response SendMessageResponse
+	if recorder.Body.Len() > 0 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder, response
+}
+
+func TestPublishHandler_DocumentedPayload(t *testing.T) {
+	ch := make(chan []byte, 1)
+	connectionStore := connectionstore.GetStore()
+	uuid, _ := connectionStore.AddConnection(connectionstore.NewConnection(ch, []connectionstore.LabelAcceptanceCriterion{
+		{
+			LabelPair: connectionstore.LabelPair{Name: "channel", Value: "publish_handler_chats"},
+			Operator:  "==",
+		},
+	}))
+	defer connectionStore.RemoveConnection(uuid)
+
+	recorder, response := publish(t, "POST", `{"labels": {"channel": "publish_handler_chats", "uid": "SCDJCSDM"}, "data": "Encrypted Data"}`)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %v", recorder.Code)
+	}
+	if response.NumberOfSents != 1 {
+		t.Errorf("expected 1 sent message, got %v", response.NumberOfSents)
+	}
+
+	var message connectionstore.Message
+	json.Unmarshal(<-ch, &message)
+	if message.Body != "Encrypted Data" {
+		t.Errorf("unexpected body %v", message.Body)
+	}
+}
+
+func TestPublishHandler_MessagePayload(t *testing.T) {
+	ch := make(chan []byte, 1)
+	connectionStore := connectionstore.GetStore()
+	uuid, _ := connectionStore.AddConnection(connectionstore.NewConnection(ch, []connectionstore.LabelAcceptanceCriterion{
+		{
+			LabelPair: connectionstore.LabelPair{Name: "publish_handler_number", Value: 5},
+			Operator:  ">",
+		},
+	}))
+	defer connectionStore.RemoveConnection(uuid)
+
+	recorder, response := publish(t, "POST", `{"label_pairs": [{"name": "publish_handler_number", "value": 6}], "body": 6}`)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %v", recorder.Code)
+	}
+	if response.NumberOfSents != 1 {
+		t.Errorf("expected 1 sent message, got %v", response.NumberOfSents)
+	}
+}
+
+func TestPublishHandler_MalformedPayload(t *testing.T) {
+	recorder, response := publish(t, "POST", `{"labels": `)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %v", recorder.Code)
+	}
+	if response.Error == "" {
+		t.Error("expected an error in the response")
+	}
+}
+
+func TestPublishHandler_BadLabelType(t *testing.T) {
+	recorder, response := publish(t, "POST", `{"labels": {"channel": ["chats"]}, "data": "hello"}`)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %v", recorder.Code)
+	}
+	if response.Error != connectionstore.InvalidLabelValueErr.Error() {
+		t.Errorf("unexpected error %v", response.Error)
+	}
+}
+
+func TestPublishHandler_WrongMethod(t *testing.T) {
+	recorder, _ := publish(t, "GET", ``)
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %v", recorder.Code)
+	}
+}
+
+func TestPublishHandler_PublisherKeys(t *testing.T) {
+	keys, err := auth.NewPublisherKeys(map[string]map[string][]interface{}{
+		"backend": {"channel": {"publish_handler_keys"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	PublisherKeys = keys
+	defer func() {
+		PublisherKeys = nil
+	}()
+
+	rejected := publishStats.TotalPublishesRejected
+	payload := `{"labels": {"channel": "publish_handler_keys"}, "data": "hi"}`
+
+	recorder, response := publish(t, "POST", payload)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 without a key, got %v", recorder.Code)
+	}
+	if response.Error != auth.MissingApiKeyErr.Error() {
+		t.Errorf("unexpected error %v", response.Error)
+	}
+
+	request := httptest.NewRequest("POST", "/publish", strings.NewReader(`{"labels": {"channel": "other"}, "data": "hi"}`))
+	request.Header.Set("X-Api-Key", "backend")
+	recorder = httptest.NewRecorder()
+	PublishHandler(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a label outside the allowlist, got %v", recorder.Code)
+	}
+
+	request = httptest.NewRequest("POST", "/publish?api_key=backend", strings.NewReader(payload))
+	recorder = httptest.NewRecorder()
+	PublishHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status 200 for an allowed label, got %v", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	StatsHandler(recorder, httptest.NewRequest("GET", "/stats", nil))
+	var stats connectionstore.Statistics
+	json.Unmarshal(recorder.Body.Bytes(), &stats)
+	if stats.TotalPublishesRejected != rejected+2 {
+		t.Errorf("expected %v rejected publishes, got %v", rejected+2, stats.TotalPublishesRejected)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	publish(t, "POST", `{"labels": {"channel": "metrics_handler"}, "data": "data"}`)
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %v", recorder.Code)
+	}
+	for _, name := range []string{
+		"bithose_messages_published_total",
+		"bithose_publish_duration_seconds_bucket",
+		"bithose_websocket_connections",
+		"bithose_websocket_write_errors_total",
+	} {
+		if !strings.Contains(recorder.Body.String(), "\n"+name) {
+			t.Errorf("expected %v in\n%v", name, recorder.Body.String())
+		}
+	}
+}
+
+func TestStatsHandler_Windows(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	StatsHandler(recorder, httptest.NewRequest("GET", "/stats?window=30s,5m", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", recorder.Code)
+	}
+
+	var snapshot connectionstore.StatisticsSnapshot
+	if err := json.Unmarshal(recorder.Body.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Windows) != 2 || snapshot.Windows[0].Window != "30s" || snapshot.Windows[1].Window != "5m" {
+		t.Errorf("unexpected windows %+v", snapshot.Windows)
+	}
+
+	for _, window := range []string{"soon", "7s", "1h"} {
+		recorder = httptest.NewRecorder()
+		StatsHandler(recorder, httptest.NewRequest("GET", "/stats?window="+window, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for window %v, got %v", window, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,563 @@
+/*
+Package messagelog keeps an on-disk, append-only log of published messages so that
+they can be replayed after a restart. Every message gets an offset, starting at 1 and
+increasing by one with each append. The log is split in segment files named after the
+offset of their first message; old segments are removed once the log grows past its
+size or age limit. The log's epoch, a random id kept in its directory, tells its
+offsets apart from those of another log or of a log that was wiped.
+
+Records are checksummed. When the log is opened, a partial or corrupt record at the
+end of the last segment, left by a crash in the middle of a write, is truncated along
+with anything after it.
+*/
+package messagelog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	UuidLib "github.com/google/uuid"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy is when appended messages are flushed to disk with fsync
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes every message before Append returns
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval flushes every Options.SyncInterval, a crash may lose the
+	// messages of the last interval
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system
+	SyncNever SyncPolicy = "never"
+)
+
+var (
+	// SegmentSize is the size in bytes past which a new segment is started
+	SegmentSize int64 = 64 << 20
+
+	// DefaultSyncInterval is how often the log is flushed with SyncInterval
+	DefaultSyncInterval = time.Second
+
+	// RetentionCheckInterval is how often segments are checked against MaxAge
+	RetentionCheckInterval = time.Minute
+
+	// syncFile flushes a segment after every append with SyncAlways
+	syncFile = (*os.File).Sync
+
+	ClosedErr            = errors.New("message log is closed")
+	OffsetOutOfRangeErr  = errors.New("offset is no longer in the message log")
+	InvalidSyncPolicyErr = errors.New("sync policy must be always, interval or never")
+)
+
+type Options struct {
+	// SegmentSize defaults to the package SegmentSize
+	SegmentSize int64
+	// Sync defaults to SyncInterval
+	Sync SyncPolicy
+	// SyncInterval defaults to DefaultSyncInterval
+	SyncInterval time.Duration
+	// MaxBytes removes the oldest segments once the log is larger, 0 keeps them
+	MaxBytes int64
+	// MaxAge removes segments whose last message is older, 0 keeps them
+	MaxAge time.Duration
+}
+
+// Entry is a message read from the log
+type Entry struct {
+	Offset  int64
+	Message connectionstore.Message
+}
+
+// epochFile is the file in the log directory holding the epoch
+const epochFile = "epoch"
+
+type Log struct {
+	dir     string
+	options Options
+	epoch   string
+
+	mtx *sync.RWMutex
+	// segments are ordered by base offset, the last one is written to
+	segments []*segment
+	file     *os.File
+	next     int64
+	dirty    bool
+	closed   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the log in dir, creating the directory if needed, and recovers the end
+// of its last segment
+func Open(dir string, options Options) (*Log, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = SegmentSize
+	}
+	if options.Sync == "" {
+		options.Sync = SyncInterval
+	}
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = DefaultSyncInterval
+	}
+	if options.Sync != SyncAlways && options.Sync != SyncInterval && options.Sync != SyncNever {
+		return nil, InvalidSyncPolicyErr
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	epoch, err := loadEpoch(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:      dir,
+		options:  options,
+		epoch:    epoch,
+		mtx:      &sync.RWMutex{},
+		segments: segments,
+		next:     1,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if len(l.segments) == 0 {
+		if err := l.roll(); err != nil {
+			return nil, err
+		}
+	} else if err := l.recover(); err != nil {
+		return nil, err
+	}
+
+	l.mtx.Lock()
+	err = l.retain()
+	l.mtx.Unlock()
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+
+	go l.run()
+
+	return l, nil
+}
+
+// loadEpoch reads the epoch of the log in dir, creating one for a new log
+func loadEpoch(dir string) (string, error) {
+	path := filepath.Join(dir, epochFile)
+	data, err := os.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// written aside and renamed, so that a crash never leaves an empty epoch
+	epoch := UuidLib.New().String()
+	if err := os.WriteFile(path+".tmp", []byte(epoch+"\n"), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+	return epoch, nil
+}
+
+// Epoch returns the epoch of the log, which messages are stamped with along with
+// their offset
+func (l *Log) Epoch() string {
+	return l.epoch
+}
+
+// recover opens the last segment for appending, truncating it after its last intact
+// record
+func (l *Log) recover() error {
+	last := l.segments[len(l.segments)-1]
+	l.next = last.base
+
+	last.indexMtx.Lock()
+	valid, err := last.scan(last.size, func(r record, position int64) bool {
+		if r.offset != l.next {
+			return false
+		}
+		last.addToIndex(r.offset, position)
+		l.next++
+		return true
+	})
+	last.indexed = true
+	last.indexMtx.Unlock()
+	if err != nil && err != TornRecordErr {
+		return err
+	}
+
+	file, err := os.OpenFile(last.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if valid < last.size {
+		log.Printf("message log: truncating %s from %d to %d bytes after offset %d", last.path, last.size, valid, l.next-1)
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+		last.size = valid
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+// roll starts a new segment at the next offset. The lock must be held.
+func (l *Log) roll() error {
+	s := newSegment(l.dir, l.next)
+	s.indexed = true
+	s.modTime = time.Now()
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if l.file != nil {
+		// the previous segment is complete, whatever the sync policy
+		if err := l.file.Sync(); err != nil {
+			log.Println("message log:", err)
+		}
+		l.file.Close()
+		l.dirty = false
+	}
+	l.file = file
+	l.segments = append(l.segments, s)
+	return nil
+}
+
+// retain removes the oldest segments while the log is over MaxBytes or they are
+// older than MaxAge. The segment written to is always kept. The lock must be held.
+func (l *Log) retain() error {
+	var total int64
+	for _, s := range l.segments {
+		total += s.size
+	}
+
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		tooLarge := l.options.MaxBytes > 0 && total > l.options.MaxBytes
+		tooOld := l.options.MaxAge > 0 && time.Since(oldest.modTime) > l.options.MaxAge
+		if !tooLarge && !tooOld {
+			break
+		}
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= oldest.size
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// run flushes the log with SyncInterval and removes aged segments until Close
+func (l *Log) run() {
+	defer close(l.done)
+
+	var syncTick <-chan time.Time
+	if l.options.Sync == SyncInterval {
+		ticker := time.NewTicker(l.options.SyncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	retentionTicker := time.NewTicker(RetentionCheckInterval)
+	defer retentionTicker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-syncTick:
+			if err := l.Sync(); err != nil && err != ClosedErr {
+				log.Println("message log:", err)
+			}
+		case <-retentionTicker.C:
+			l.mtx.Lock()
+			err := l.retain()
+			l.mtx.Unlock()
+			if err != nil {
+				log.Println("message log:", err)
+			}
+		}
+	}
+}
+
+// Append writes the message to the log and returns its offset, which is also stored
+// as the sequence number of the message
+func (l *Log) Append(message connectionstore.Message) (int64, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return 0, ClosedErr
+	}
+
+	message.Seq = l.next
+	message.Epoch = l.epoch
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) > maxRecordSize {
+		return 0, fmt.Errorf("message of %d bytes is larger than the largest record of %d bytes", len(payload), maxRecordSize)
+	}
+
+	active := l.segments[len(l.segments)-1]
+	if active.size > 0 && active.size+headerSize+int64(len(payload)) > l.options.SegmentSize {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+		if err := l.retain(); err != nil {
+			log.Println("message log:", err)
+		}
+		active = l.segments[len(l.segments)-1]
+	}
+
+	offset := l.next
+	data := encodeRecord(offset, payload)
+	if n, err := l.file.Write(data); err != nil {
+		// drop the partial record so the next append starts on a boundary
+		if n > 0 {
+			l.discard(active)
+		}
+		return 0, err
+	}
+	if l.options.Sync == SyncAlways {
+		if err := syncFile(l.file); err != nil {
+			// the record was not appended, so the next one takes its offset
+			l.discard(active)
+			return 0, err
+		}
+	} else {
+		l.dirty = true
+	}
+
+	active.indexMtx.Lock()
+	active.addToIndex(offset, active.size)
+	active.indexMtx.Unlock()
+	active.size += int64(len(data))
+	active.modTime = time.Now()
+	l.next++
+
+	return offset, nil
+}
+
+// discard truncates the active segment back to its size, dropping what was written of
+// a record that was not appended. The mutex must be held.
+func (l *Log) discard(active *segment) {
+	if err := l.file.Truncate(active.size); err != nil {
+		log.Println("message log:", err)
+		return
+	}
+	l.file.Seek(active.size, io.SeekStart)
+}
+
+// Sync flushes the appended messages to disk
+func (l *Log) Sync() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return ClosedErr
+	}
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+// FirstOffset returns the offset of the oldest message kept, or NextOffset if the
+// log is empty
+func (l *Log) FirstOffset() int64 {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.segments[0].base
+}
+
+// NextOffset returns the offset the next message will get
+func (l *Log) NextOffset() int64 {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.next
+}
+
+// SearchTime returns the offset to read from for the first message published at or
+// after t: the base offset of the last segment whose first message was published
+// before t, found by binary search over the first messages of the segments. It
+// relies on messages being appended about in the order they were published.
+func (l *Log) SearchTime(t time.Time) (int64, error) {
+	type segmentRead struct {
+		segment *segment
+		size    int64
+	}
+
+	l.mtx.RLock()
+	if l.closed {
+		l.mtx.RUnlock()
+		return 0, ClosedErr
+	}
+	reads := make([]segmentRead, len(l.segments))
+	for i, s := range l.segments {
+		reads[i] = segmentRead{segment: s, size: s.size}
+	}
+	l.mtx.RUnlock()
+
+	var err error
+	i := sort.Search(len(reads), func(i int) bool {
+		first, ok, readErr := reads[i].segment.firstTimestamp(reads[i].size)
+		if readErr != nil && err == nil {
+			err = readErr
+		}
+		return !ok || !first.Before(t)
+	})
+	if os.IsNotExist(err) {
+		// removed by retention since the search started
+		return 0, OffsetOutOfRangeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if i > 0 {
+		i--
+	}
+	return reads[i].segment.base, nil
+}
+
+// ReadFrom calls fn with every message from offset on, in order, that the criteria
+// accept, until fn returns false or the messages appended before the call are
+// read. Empty criteria accept every message. It returns OffsetOutOfRangeErr if
+// messages from offset on were removed.
+func (l *Log) ReadFrom(offset int64, criteria []connectionstore.LabelAcceptanceCriterion, fn func(Entry) bool) error {
+	type segmentRead struct {
+		segment *segment
+		size    int64
+	}
+
+	l.mtx.RLock()
+	if l.closed {
+		l.mtx.RUnlock()
+		return ClosedErr
+	}
+	if offset < l.segments[0].base {
+		l.mtx.RUnlock()
+		return OffsetOutOfRangeErr
+	}
+	next := l.next
+	// the segment holding offset is the last one starting at or before it
+	first := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].base > offset
+	}) - 1
+	reads := make([]segmentRead, 0, len(l.segments)-first)
+	for _, s := range l.segments[first:] {
+		reads = append(reads, segmentRead{segment: s, size: s.size})
+	}
+	l.mtx.RUnlock()
+
+	if offset >= next {
+		return nil
+	}
+
+	filter := connectionstore.NewConnection(nil, criteria)
+	for _, read := range reads {
+		stopped, err := l.readSegment(read.segment, read.size, offset, filter, fn)
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment reads the segment up to size, returning true if fn stopped the read
+func (l *Log) readSegment(s *segment, size int64, offset int64, filter *connectionstore.Connection, fn func(Entry) bool) (bool, error) {
+	position, err := s.position(offset, size)
+	if err != nil {
+		return false, err
+	}
+
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		// removed by retention since the read started
+		return false, OffsetOutOfRangeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, position, size-position))
+	for {
+		r, err := readRecord(reader)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if r.offset < offset {
+			continue
+		}
+
+		var message connectionstore.Message
+		if err := json.Unmarshal(r.payload, &message); err != nil {
+			return false, err
+		}
+		if len(filter.LabelAcceptanceCriteria) > 0 {
+			accepts, err := filter.AcceptsLabels(message.LabelPairs)
+			if err != nil || !accepts {
+				continue
+			}
+		}
+		if !fn(Entry{Offset: r.offset, Message: message}) {
+			return true, nil
+		}
+	}
+}
+
+// Close flushes and closes the log
+func (l *Log) Close() error {
+	l.mtx.Lock()
+	if l.closed {
+		l.mtx.Unlock()
+		return ClosedErr
+	}
+	l.closed = true
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.mtx.Unlock()
+
+	close(l.stop)
+	<-l.done
+	return err
+}
@@ -0,0 +1,379 @@
+package messagelog
+
+import (
+	"errors"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"os"
+	"testing"
+	"time"
+)
+
+func channelMessage(channel string, body interface{}) connectionstore.Message {
+	return connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: channel}},
+		Timestamp:  time.Now(),
+		Body:       body,
+	}
+}
+
+func channelCriteria(channel string) []connectionstore.LabelAcceptanceCriterion {
+	return []connectionstore.LabelAcceptanceCriterion{
+		{
+			LabelPair: connectionstore.LabelPair{Name: "channel", Value: channel},
+			Operator:  "==",
+		},
+	}
+}
+
+// readAll returns the entries read from offset on
+func readAll(t *testing.T, l *Log, offset int64, criteria []connectionstore.LabelAcceptanceCriterion) []Entry {
+	var entries []Entry
+	if err := l.ReadFrom(offset, criteria, func(entry Entry) bool {
+		entries = append(entries, entry)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestLog_AppendAndReadFrom(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		channel := "chats"
+		if i%2 == 1 {
+			channel = "news"
+		}
+		offset, err := l.Append(channelMessage(channel, float64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != int64(i+1) {
+			t.Fatalf("expected offset %d, got %d", i+1, offset)
+		}
+	}
+
+	entries := readAll(t, l, 4, nil)
+	if len(entries) != 7 || entries[0].Offset != 4 || entries[0].Message.Seq != 4 || entries[0].Message.Body != float64(3) {
+		t.Fatalf("expected offsets 4 to 10, got %+v", entries)
+	}
+
+	entries = readAll(t, l, 4, channelCriteria("news"))
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 news messages, got %+v", entries)
+	}
+	for _, entry := range entries {
+		if entry.Offset%2 != 0 {
+			t.Fatalf("expected even offsets, got %v", entry.Offset)
+		}
+	}
+
+	// the read stops once fn returns false
+	var read int
+	l.ReadFrom(1, nil, func(entry Entry) bool {
+		read++
+		return read < 3
+	})
+	if read != 3 {
+		t.Fatalf("expected the read to stop after 3 entries, got %v", read)
+	}
+
+	if entries := readAll(t, l, 11, nil); len(entries) != 0 {
+		t.Fatalf("expected nothing past the end, got %+v", entries)
+	}
+}
+
+func TestLog_SegmentsAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	// every segment holds a couple of messages
+	l, err := Open(dir, Options{SegmentSize: 200, MaxBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 100; i++ {
+		if _, err := l.Append(channelMessage("chats", float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) < 2 || len(files) > 10 {
+		t.Fatalf("expected old segments to be removed, got %v files", len(files))
+	}
+
+	first := l.FirstOffset()
+	if first <= 1 || l.NextOffset() != 101 {
+		t.Fatalf("expected the oldest messages to be removed, got offsets %v to %v", first, l.NextOffset())
+	}
+	if err := l.ReadFrom(1, nil, func(Entry) bool { return true }); err != OffsetOutOfRangeErr {
+		t.Fatalf("expected OffsetOutOfRangeErr, got %v", err)
+	}
+
+	entries := readAll(t, l, first, nil)
+	if len(entries) != int(101-first) {
+		t.Fatalf("expected %v entries, got %v", 101-first, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Offset != first+int64(i) {
+			t.Fatalf("expected offset %v, got %v", first+int64(i), entry.Offset)
+		}
+	}
+}
+
+func TestLog_ReopenRecoversTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{SegmentSize: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := l.Append(channelMessage("chats", float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	epoch := l.Epoch()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of a write leaves part of a record
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := segments[len(segments)-1]
+	file, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(encodeRecord(11, []byte(`{"body":"torn"}`))[:20])
+	file.Close()
+
+	l, err = Open(dir, Options{SegmentSize: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.NextOffset() != 11 {
+		t.Fatalf("expected the torn record to be dropped, got next offset %v", l.NextOffset())
+	}
+	if l.Epoch() != epoch {
+		t.Fatalf("expected the epoch %v to survive the restart, got %v", epoch, l.Epoch())
+	}
+	if info, _ := os.Stat(last.path); info.Size() != last.size {
+		t.Fatalf("expected the segment to be truncated to %v bytes, got %v", last.size, info.Size())
+	}
+
+	offset, err := l.Append(channelMessage("chats", "after"))
+	if err != nil || offset != 11 {
+		t.Fatalf("expected offset 11, got %v %v", offset, err)
+	}
+	entries := readAll(t, l, 1, nil)
+	if len(entries) != 11 || entries[10].Message.Body != "after" {
+		t.Fatalf("expected 11 entries ending with the new one, got %+v", entries)
+	}
+}
+
+func TestLog_ReopenDropsCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		l.Append(channelMessage("chats", float64(i)))
+	}
+	l.Close()
+
+	segments, _ := listSegments(dir)
+	data, _ := os.ReadFile(segments[0].path)
+	// flip a byte of the last payload
+	data[len(data)-2] ^= 0xff
+	os.WriteFile(segments[0].path, data, 0644)
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if entries := readAll(t, l, 1, nil); len(entries) != 2 || l.NextOffset() != 3 {
+		t.Fatalf("expected the corrupt record to be dropped, got %+v", entries)
+	}
+}
+
+func TestLog_FailedSyncIsNotAppended(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(channelMessage("chats", "first"))
+
+	syncErr := errors.New("sync failed")
+	syncFile = func(*os.File) error { return syncErr }
+	_, err = l.Append(channelMessage("chats", "lost"))
+	syncFile = (*os.File).Sync
+	if err != syncErr {
+		t.Fatalf("expected the sync error, got %v", err)
+	}
+
+	if offset, err := l.Append(channelMessage("chats", "second")); err != nil || offset != 2 {
+		t.Fatalf("expected offset 2, got %v %v", offset, err)
+	}
+	l.Close()
+
+	// nothing after the failed append is lost on recovery
+	l, err = Open(dir, Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	entries := readAll(t, l, 1, nil)
+	if len(entries) != 2 || entries[1].Message.Body != "second" || l.NextOffset() != 3 {
+		t.Fatalf("expected first and second, got %+v", entries)
+	}
+}
+
+func TestOpen_InvalidSyncPolicy(t *testing.T) {
+	if _, err := Open(t.TempDir(), Options{Sync: "sometimes"}); err != InvalidSyncPolicyErr {
+		t.Fatalf("expected InvalidSyncPolicyErr, got %v", err)
+	}
+}
+
+func TestStore_LogsSentMessages(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	store := NewStore(connectionstore.NewShardedStore(1), l)
+	ch := make(chan []byte, 1)
+	if _, err := store.AddConnection(connectionstore.NewConnection(ch, channelCriteria("chats"))); err != nil {
+		t.Fatal(err)
+	}
+
+	numOfSent, _, err := store.SendMessage(channelMessage("chats", "hello"))
+	if err != nil || numOfSent != 1 {
+		t.Fatalf("expected the message to be delivered, got %v %v", numOfSent, err)
+	}
+	if entries := readAll(t, l, 1, nil); len(entries) != 1 || entries[0].Message.Body != "hello" {
+		t.Fatalf("expected the message to be logged, got %+v", entries)
+	}
+
+	// a message that can not be logged is not delivered
+	l.Close()
+	if numOfSent, _, err := store.SendMessage(channelMessage("chats", "lost")); err != ClosedErr || numOfSent != 0 {
+		t.Fatalf("expected ClosedErr, got %v %v", numOfSent, err)
+	}
+}
+
+func TestStore_Replay(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{SegmentSize: 300, MaxBytes: 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	store := NewStore(connectionstore.NewShardedStore(1), l)
+
+	start := time.Now()
+	for i := 1; i <= 20; i++ {
+		message := channelMessage("chats", float64(i))
+		message.Timestamp = start.Add(time.Duration(i) * time.Second)
+		store.SendMessage(message)
+	}
+	first := l.FirstOffset()
+	if first <= 1 {
+		t.Fatalf("expected old segments to be removed, got first offset %v", first)
+	}
+
+	replay := func(from connectionstore.ReplayPosition) ([]int64, error) {
+		var seqs []int64
+		err := store.Replay(from, channelCriteria("chats"), func(message connectionstore.Message) bool {
+			seqs = append(seqs, message.Seq)
+			return true
+		})
+		return seqs, err
+	}
+
+	if seqs, err := replay(connectionstore.ReplayPosition{Epoch: l.Epoch(), Seq: 17}); err != nil || len(seqs) != 3 || seqs[0] != 18 {
+		t.Errorf("expected 18 to 20, got %v %v", seqs, err)
+	}
+	if seqs, err := replay(connectionstore.ReplayPosition{Time: start.Add(19 * time.Second)}); err != nil || len(seqs) != 2 || seqs[0] != 19 {
+		t.Errorf("expected 19 and 20, got %v %v", seqs, err)
+	}
+	if _, err := replay(connectionstore.ReplayPosition{Epoch: l.Epoch(), Seq: 0}); err != connectionstore.HistoryExpiredErr {
+		t.Errorf("expected HistoryExpiredErr, got %v", err)
+	}
+	if _, err := replay(connectionstore.ReplayPosition{Time: start}); err != connectionstore.HistoryExpiredErr {
+		t.Errorf("expected HistoryExpiredErr, got %v", err)
+	}
+	if _, err := replay(connectionstore.ReplayPosition{Epoch: l.Epoch(), Seq: 20}); err != nil {
+		t.Errorf("expected nothing to replay after the last message, got %v", err)
+	}
+	if _, err := replay(connectionstore.ReplayPosition{Epoch: l.Epoch(), Seq: 21}); err != connectionstore.UnknownSequenceErr {
+		t.Errorf("expected UnknownSequenceErr, got %v", err)
+	}
+	if _, err := replay(connectionstore.ReplayPosition{Epoch: "another", Seq: 17}); err != connectionstore.UnknownSequenceErr {
+		t.Errorf("expected UnknownSequenceErr for another epoch, got %v", err)
+	}
+
+	// expired messages are kept in the log but not replayed
+	expired := channelMessage("chats", "expired")
+	expired.Timestamp = time.Now().Add(-time.Minute)
+	expired.TTL = 1
+	store.SendMessage(expired)
+	store.SendMessage(channelMessage("chats", "fresh"))
+	if seqs, err := replay(connectionstore.ReplayPosition{Epoch: l.Epoch(), Seq: 20}); err != nil || len(seqs) != 1 || seqs[0] != 22 {
+		t.Errorf("expected only 22, got %v %v", seqs, err)
+	}
+}
+
+func TestLog_SearchTime(t *testing.T) {
+	// every segment holds a couple of messages
+	l, err := Open(t.TempDir(), Options{SegmentSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	start := time.Now()
+	for i := 1; i <= 30; i++ {
+		message := channelMessage("chats", float64(i))
+		message.Timestamp = start.Add(time.Duration(i) * time.Second)
+		if _, err := l.Append(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, seconds := range []int{0, 1, 2, 9, 15, 29, 30, 31} {
+		at := start.Add(time.Duration(seconds) * time.Second)
+		from, err := l.SearchTime(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the search lands on a segment holding messages published before the time,
+		// and no more than one segment before the first at or after it
+		var skipped int
+		for _, entry := range readAll(t, l, from, nil) {
+			if !entry.Message.Timestamp.Before(at) {
+				break
+			}
+			skipped++
+		}
+		if seconds > 1 && skipped == 0 {
+			t.Errorf("expected %v to start before %vs", from, seconds)
+		}
+		if skipped > 3 {
+			t.Errorf("expected %v to be within a segment of %vs, skipped %v messages", from, seconds, skipped)
+		}
+	}
+}
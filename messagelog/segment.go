@@ -0,0 +1,245 @@
+package messagelog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a record is the payload length, the checksum of the offset and payload, the
+	// offset and then the payload
+	headerSize = 16
+
+	// maxRecordSize bounds the payload length read from a header, so that a torn
+	// header is not mistaken for a huge record
+	maxRecordSize = 64 << 20
+
+	// indexInterval is how many bytes of records may separate two index entries
+	indexInterval = 4096
+
+	segmentSuffix = ".log"
+)
+
+var (
+	TornRecordErr = errors.New("torn or corrupt record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type record struct {
+	offset  int64
+	payload []byte
+}
+
+func encodeRecord(offset int64, payload []byte) []byte {
+	data := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(data[8:16], uint64(offset))
+	copy(data[headerSize:], payload)
+	binary.BigEndian.PutUint32(data[4:8], crc32.Checksum(data[8:], crcTable))
+	return data
+}
+
+// readRecord reads the record at the reader's position. It returns io.EOF at the
+// end of the records and TornRecordErr for a partial or corrupt record.
+func readRecord(reader *bufio.Reader) (record, error) {
+	header := make([]byte, headerSize)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF {
+			return record{}, io.EOF
+		}
+		if n > 0 || err == io.ErrUnexpectedEOF {
+			return record{}, TornRecordErr
+		}
+		return record{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return record{}, TornRecordErr
+	}
+	data := make([]byte, 8+length)
+	copy(data, header[8:16])
+	if _, err := io.ReadFull(reader, data[8:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return record{}, TornRecordErr
+		}
+		return record{}, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return record{}, TornRecordErr
+	}
+
+	return record{
+		offset:  int64(binary.BigEndian.Uint64(data[0:8])),
+		payload: data[8:],
+	}, nil
+}
+
+type indexEntry struct {
+	offset   int64
+	position int64
+}
+
+// segment is a file of consecutive records, named after the offset of its first one
+type segment struct {
+	base int64
+	path string
+	// size and modTime are only changed with the log's lock held
+	size    int64
+	modTime time.Time
+
+	indexMtx *sync.Mutex
+	// index holds the position of a record every indexInterval bytes. It is built on
+	// the first read of segments the log did not write or recover itself
+	index   []indexEntry
+	indexed bool
+	// first is the timestamp of the first message, read once
+	first time.Time
+}
+
+func segmentPath(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentSuffix))
+}
+
+func newSegment(dir string, base int64) *segment {
+	return &segment{
+		base:     base,
+		path:     segmentPath(dir, base),
+		indexMtx: &sync.Mutex{},
+	}
+}
+
+// listSegments returns the segments in the directory, by base offset
+func listSegments(dir string) ([]*segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s := newSegment(dir, base)
+		s.size = info.Size()
+		s.modTime = info.ModTime()
+		segments = append(segments, s)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].base < segments[j].base
+	})
+	return segments, nil
+}
+
+// addToIndex records the position of the record if it is far enough from the last
+// entry. The index lock must be held.
+func (s *segment) addToIndex(offset int64, position int64) {
+	if n := len(s.index); n == 0 || position-s.index[n-1].position >= indexInterval {
+		s.index = append(s.index, indexEntry{offset: offset, position: position})
+	}
+}
+
+// scan reads the records of the segment up to size, calling fn with each record and
+// its position. It stops at the first torn record, returning TornRecordErr and the
+// position of the end of the last good record.
+func (s *segment) scan(size int64, fn func(r record, position int64) bool) (int64, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, size))
+	var position int64
+	for {
+		r, err := readRecord(reader)
+		if err == io.EOF {
+			return position, nil
+		}
+		if err != nil {
+			return position, err
+		}
+		if !fn(r, position) {
+			return position, nil
+		}
+		position += headerSize + int64(len(r.payload))
+	}
+}
+
+// firstTimestamp returns the timestamp of the first message of the segment, or false
+// if the segment holds no message yet
+func (s *segment) firstTimestamp(size int64) (time.Time, bool, error) {
+	s.indexMtx.Lock()
+	defer s.indexMtx.Unlock()
+
+	if !s.first.IsZero() {
+		return s.first, true, nil
+	}
+	if size == 0 {
+		return time.Time{}, false, nil
+	}
+	var stub struct {
+		Timestamp time.Time `json:"timestamp"`
+	}
+	var err error
+	if _, scanErr := s.scan(size, func(r record, position int64) bool {
+		err = json.Unmarshal(r.payload, &stub)
+		return false
+	}); scanErr != nil {
+		return time.Time{}, false, scanErr
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	s.first = stub.Timestamp
+	return s.first, true, nil
+}
+
+// position returns the position of a record at or before the offset, building the
+// index of the segment if needed
+func (s *segment) position(offset int64, size int64) (int64, error) {
+	s.indexMtx.Lock()
+	defer s.indexMtx.Unlock()
+
+	if !s.indexed {
+		s.index = nil
+		if _, err := s.scan(size, func(r record, position int64) bool {
+			s.addToIndex(r.offset, position)
+			return true
+		}); err != nil {
+			return 0, err
+		}
+		s.indexed = true
+	}
+
+	i := sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].offset > offset
+	})
+	if i == 0 {
+		return 0, nil
+	}
+	return s.index[i-1].position, nil
+}
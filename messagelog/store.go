@@ -0,0 +1,129 @@
+package messagelog
+
+import (
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"time"
+)
+
+// Store is a connectionstore.ConnectionStore that appends every message sent through
+// it to a Log before delivering it. The offset of a message is its sequence number,
+// and the epoch of the log its epoch. The log is replayed from sequence numbers of
+// its epoch or from times.
+type Store struct {
+	next connectionstore.ConnectionStore
+	log  *Log
+
+	// sequencer makes subscribers receive messages in offset order
+	sequencer *connectionstore.Sequencer
+}
+
+// NewStore wraps the store so that the messages sent through it are logged
+func NewStore(next connectionstore.ConnectionStore, log *Log) *Store {
+	return &Store{
+		next:      next,
+		log:       log,
+		sequencer: connectionstore.NewSequencer(log.NextOffset()),
+	}
+}
+
+// Log returns the log messages are appended to
+func (s *Store) Log() *Log {
+	return s.log
+}
+
+func (s *Store) AddConnection(connection *connectionstore.Connection) (string, error) {
+	return s.next.AddConnection(connection)
+}
+
+func (s *Store) RemoveConnection(uuid string) {
+	s.next.RemoveConnection(uuid)
+}
+
+func (s *Store) GetConnection(uuid string) (connection *connectionstore.Connection, exists bool) {
+	return s.next.GetConnection(uuid)
+}
+
+// SendMessage appends the message to the log and then delivers it with its offset as
+// sequence number, once the messages appended before it are delivered. A message that
+// can not be logged is not delivered, so that every delivered message can be replayed.
+func (s *Store) SendMessage(message connectionstore.Message) (numOfSent int, numOfTimeouts int, err error) {
+	offset, err := s.log.Append(message)
+	if err != nil {
+		return 0, 0, err
+	}
+	message.Seq = offset
+	message.Epoch = s.log.Epoch()
+
+	s.sequencer.Wait(offset)
+	defer s.sequencer.Done(offset)
+	return s.next.SendMessage(message)
+}
+
+func (s *Store) Stats() *connectionstore.Statistics {
+	return s.next.Stats()
+}
+
+// Replay reads the log from the position on, skipping expired messages
+func (s *Store) Replay(from connectionstore.ReplayPosition, criteria []connectionstore.LabelAcceptanceCriterion, fn func(connectionstore.Message) bool) error {
+	fn = skipExpired(fn)
+	if !from.Time.IsZero() {
+		return s.replaySince(from.Time, criteria, fn)
+	}
+
+	if from.Epoch != s.log.Epoch() || from.Seq >= s.log.NextOffset() {
+		return connectionstore.UnknownSequenceErr
+	}
+	err := s.log.ReadFrom(from.Seq+1, criteria, func(entry Entry) bool {
+		return fn(entry.Message)
+	})
+	if err == OffsetOutOfRangeErr {
+		return connectionstore.HistoryExpiredErr
+	}
+	return err
+}
+
+// replaySince replays the messages published at or after t. The segment holding the
+// first of them is found with SearchTime and scanned for it. It must not be the first
+// message kept if older ones were removed.
+func (s *Store) replaySince(t time.Time, criteria []connectionstore.LabelAcceptanceCriterion, fn func(connectionstore.Message) bool) error {
+	first := s.log.FirstOffset()
+	from, err := s.log.SearchTime(t)
+	if err == OffsetOutOfRangeErr {
+		return connectionstore.HistoryExpiredErr
+	}
+	if err != nil {
+		return err
+	}
+	start := int64(-1)
+	err = s.log.ReadFrom(from, nil, func(entry Entry) bool {
+		if entry.Message.Timestamp.Before(t) {
+			return true
+		}
+		start = entry.Offset
+		return false
+	})
+	if err == OffsetOutOfRangeErr || (err == nil && start == first && first > 1) {
+		return connectionstore.HistoryExpiredErr
+	}
+	if err != nil || start == -1 {
+		return err
+	}
+
+	err = s.log.ReadFrom(start, criteria, func(entry Entry) bool {
+		return fn(entry.Message)
+	})
+	if err == OffsetOutOfRangeErr {
+		return connectionstore.HistoryExpiredErr
+	}
+	return err
+}
+
+// skipExpired wraps fn so that it is only called with messages that have not expired
+func skipExpired(fn func(connectionstore.Message) bool) func(connectionstore.Message) bool {
+	return func(message connectionstore.Message) bool {
+		if message.Expired(time.Now()) {
+			return true
+		}
+		return fn(message)
+	}
+}
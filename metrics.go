@@ -0,0 +1,26 @@
+package Bithose
+
+import (
+	"github.com/JonathanRosado/Bithose/metrics"
+	"net/http"
+)
+
+var (
+	websocketConnections = metrics.NewGauge("bithose_websocket_connections",
+		"Open websocket connections.")
+	websocketReadErrors = metrics.NewCounter("bithose_websocket_read_errors_total",
+		"Websocket connections that ended with a read error other than a normal close.")
+	websocketWriteErrors = metrics.NewCounter("bithose_websocket_write_errors_total",
+		"Frames that could not be written to a websocket.")
+	websocketsReaped = metrics.NewCounter("bithose_websocket_connections_reaped_total",
+		"Websocket connections closed for not answering pings.")
+)
+
+// MetricsHandler serves the metrics in the Prometheus text exposition format
+func MetricsHandler(writer http.ResponseWriter, request *http.Request) {
+	if !checkCors(writer, request) {
+		return
+	}
+
+	metrics.Default.ServeHTTP(writer, request)
+}
@@ -0,0 +1,252 @@
+/*
+Package metrics exports counters, gauges and histograms in the Prometheus text
+exposition format. Updating a metric is a few atomic operations and never takes a
+lock, so metrics can be updated on the publish path; the registry's lock is only
+taken to register metrics and to write them out.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// Default is the registry the New functions register with and /metrics serves
+	Default = NewRegistry()
+
+	// LatencyBuckets are the upper bounds, in seconds, of latency histograms, from
+	// 10µs to about 2.6s
+	LatencyBuckets = ExponentialBuckets(0.00001, 4, 10)
+)
+
+// ExponentialBuckets returns count upper bounds, the first being start and each
+// following one factor times the previous
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(writer io.Writer, name string) error {
+	_, err := fmt.Fprintf(writer, "%s %d\n", name, c.Value())
+	return err
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	value int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.value, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) write(writer io.Writer, name string) error {
+	_, err := fmt.Fprintf(writer, "%s %d\n", name, g.Value())
+	return err
+}
+
+// Histogram counts observations in buckets of upper bounds
+type Histogram struct {
+	buckets []float64
+	// counts holds the observations of each bucket alone, the last one being the
+	// observations above every bound. They are only made cumulative when written.
+	counts  []uint64
+	sumBits uint64
+}
+
+// Observe adds the value to the first bucket whose bound is not less than it
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	atomic.AddUint64(&h.counts[i], 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	var count uint64
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+	}
+	return count
+}
+
+// Sum returns the sum of the observations
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+func (h *Histogram) write(writer io.Writer, name string) error {
+	// the count is the sum of the buckets, so that it always agrees with +Inf
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		if _, err := fmt.Fprintf(writer, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative); err != nil {
+			return err
+		}
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.buckets)])
+	_, err := fmt.Fprintf(writer, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n",
+		name, cumulative, name, formatFloat(h.Sum()), name, cumulative)
+	return err
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type metric interface {
+	write(writer io.Writer, name string) error
+}
+
+type entry struct {
+	name       string
+	help       string
+	metricType string
+	metric     metric
+}
+
+// Registry holds named metrics and writes them out in the order they were registered
+type Registry struct {
+	mtx     *sync.Mutex
+	entries []entry
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mtx:   &sync.Mutex{},
+		names: map[string]bool{},
+	}
+}
+
+// register panics if the name is taken, as registering a metric twice is a
+// programming error
+func (r *Registry) register(name string, help string, metricType string, m metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.names[name] {
+		panic("metrics: " + name + " is already registered")
+	}
+	r.names[name] = true
+	r.entries = append(r.entries, entry{name: name, help: help, metricType: metricType, metric: m})
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, help, "gauge", g)
+	return g
+}
+
+// NewHistogram returns a histogram with the given upper bounds, which must be sorted
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: buckets of " + name + " are not sorted")
+	}
+	h := &Histogram{
+		buckets: append([]float64{}, buckets...),
+		counts:  make([]uint64, len(buckets)+1),
+	}
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// Write writes every metric in the text exposition format
+func (r *Registry) Write(writer io.Writer) error {
+	r.mtx.Lock()
+	entries := r.entries
+	r.mtx.Unlock()
+
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", e.name, e.help, e.name, e.metricType); err != nil {
+			return err
+		}
+		if err := e.metric.write(writer, e.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape
+func (r *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", ContentType)
+	r.Write(writer)
+}
+
+// NewCounter registers a counter with the Default registry
+func NewCounter(name string, help string) *Counter {
+	return Default.NewCounter(name, help)
+}
+
+// NewGauge registers a gauge with the Default registry
+func NewGauge(name string, help string) *Gauge {
+	return Default.NewGauge(name, help)
+}
+
+// NewHistogram registers a histogram with the Default registry
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
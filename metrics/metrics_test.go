@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_total", "A counter.")
+	gauge := registry.NewGauge("test_gauge", "A gauge.")
+	histogram := registry.NewHistogram("test_seconds", "A histogram.", []float64{0.1, 1})
+
+	counter.Add(3)
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	for _, value := range []float64{0.05, 0.1, 0.5, 2} {
+		histogram.Observe(value)
+	}
+
+	var buf bytes.Buffer
+	if err := registry.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total 3
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 2.65
+test_seconds_count 4
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestRegistry_DuplicateName(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "A counter.")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice should panic")
+		}
+	}()
+	registry.NewGauge("test_total", "A gauge.")
+}
+
+func TestHistogram_ConcurrentObserve(t *testing.T) {
+	histogram := NewRegistry().NewHistogram("test", "", ExponentialBuckets(1, 2, 4))
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				histogram.Observe(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if histogram.Count() != 8000 || histogram.Sum() != 8000 {
+		t.Errorf("expected 8000 observations summing to 8000, got %v and %v", histogram.Count(), histogram.Sum())
+	}
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "A counter.").Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if recorder.Header().Get("Content-Type") != ContentType {
+		t.Errorf("unexpected content type %v", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "test_total 1\n") {
+		t.Errorf("unexpected body %v", recorder.Body.String())
+	}
+}
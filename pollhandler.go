@@ -0,0 +1,313 @@
+package Bithose
+
+import (
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/auth"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// PollSessionIdleTimeout is how long a long-poll session may go without
+	// being polled before its connection is removed from the store
+	PollSessionIdleTimeout = time.Minute
+
+	// PollTimeout is the longest a single poll may block waiting for messages
+	PollTimeout = 30 * time.Second
+
+	pollSessionsOnce     sync.Once
+	pollSessionsInstance *pollSessions
+)
+
+type pollSession struct {
+	uuid string
+	// claims are those of the subscriber, nil without authentication. Only a request
+	// with the same subject and labels may poll or end the session
+	claims   *auth.Claims
+	ch       chan []byte
+	mtx      *sync.Mutex
+	lastSeen time.Time
+	polling  int
+}
+
+func (p *pollSession) touch(polling int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.lastSeen = time.Now()
+	p.polling += polling
+}
+
+func (p *pollSession) ownedBy(claims *auth.Claims) bool {
+	if p.claims == nil || claims == nil {
+		return p.claims == claims
+	}
+	return p.claims.Subject == claims.Subject && reflect.DeepEqual(p.claims.Labels, claims.Labels)
+}
+
+func (p *pollSession) idle(now time.Time) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.polling == 0 && now.Sub(p.lastSeen) > PollSessionIdleTimeout
+}
+
+// pollSessions holds the long-poll sessions. Sessions are keyed by the uuid of
+// their connection in the connection store.
+type pollSessions struct {
+	mtx      *sync.RWMutex
+	sessions map[string]*pollSession
+}
+
+func getPollSessions() *pollSessions {
+	pollSessionsOnce.Do(func() {
+		pollSessionsInstance = &pollSessions{
+			mtx:      &sync.RWMutex{},
+			sessions: map[string]*pollSession{},
+		}
+		go pollSessionsInstance.expire()
+	})
+	return pollSessionsInstance
+}
+
+func (p *pollSessions) add(criteria []connectionstore.LabelAcceptanceCriterion, size int, claims *auth.Claims) (*pollSession, error) {
+	ch := make(chan []byte, size)
+	uuid, err := connectionstore.GetStore().AddConnection(connectionstore.NewConnection(ch, criteria))
+	if err != nil {
+		return nil, err
+	}
+
+	session := &pollSession{
+		uuid:     uuid,
+		claims:   claims,
+		ch:       ch,
+		mtx:      &sync.Mutex{},
+		lastSeen: time.Now(),
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.sessions[uuid] = session
+	return session, nil
+}
+
+// get returns the session if the claims are those it was created with. Sessions of
+// other subscribers are not found, so that their uuids can not be probed
+func (p *pollSessions) get(uuid string, claims *auth.Claims) (*pollSession, bool) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	session, ok := p.sessions[uuid]
+	if !ok || !session.ownedBy(claims) {
+		return nil, false
+	}
+	return session, true
+}
+
+func (p *pollSessions) remove(uuid string) bool {
+	p.mtx.Lock()
+	_, ok := p.sessions[uuid]
+	delete(p.sessions, uuid)
+	p.mtx.Unlock()
+
+	connectionstore.GetStore().RemoveConnection(uuid)
+	return ok
+}
+
+// expire periodically removes the idle sessions
+func (p *pollSessions) expire() {
+	for {
+		time.Sleep(PollSessionIdleTimeout / 2)
+		p.removeIdle(time.Now())
+	}
+}
+
+// removeIdle removes the sessions that have not been polled in PollSessionIdleTimeout,
+// since a vanished poller would otherwise keep its connection in the store forever
+func (p *pollSessions) removeIdle(now time.Time) {
+	var idle []string
+	p.mtx.RLock()
+	for uuid, session := range p.sessions {
+		if session.idle(now) {
+			idle = append(idle, uuid)
+		}
+	}
+	p.mtx.RUnlock()
+
+	for _, uuid := range idle {
+		p.remove(uuid)
+	}
+}
+
+// PollHandler implements the long-polling transport:
+//   - POST /poll creates a session subscribed with the criteria in the body
+//     ({"criteria": [...], "buffer_size": n}) and/or the query string filters and replies
+//     with a SubscribeResponse. The session buffers messages between polls
+//   - GET /poll?uuid=<uuid>&timeout=<duration> blocks until messages arrive or the timeout
+//     expires and replies with a json array of the messages
+//   - DELETE /poll?uuid=<uuid> ends the session
+//
+// With authentication, a session can only be polled or ended with a token of the
+// subject that created it.
+func PollHandler(writer http.ResponseWriter, request *http.Request) {
+	if !checkCors(writer, request) {
+		return
+	}
+
+	if request.Method == "OPTIONS" {
+		return
+	}
+
+	claims, err := authenticate(request)
+	if err != nil {
+		unauthorized(writer, err)
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		pollSubscribe(writer, request, claims)
+	case "GET":
+		poll(writer, request, claims)
+	case "DELETE":
+		sessions := getPollSessions()
+		session, ok := sessions.get(request.URL.Query().Get("uuid"), claims)
+		if !ok || !sessions.remove(session.uuid) {
+			http.Error(writer, "session not found", http.StatusNotFound)
+		}
+	default:
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func pollSubscribe(writer http.ResponseWriter, request *http.Request, claims *auth.Claims) {
+	criteria, err := connectionstore.ParseFilters(request.URL.Query()["filter"])
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	incomingSubscribe := IncomingSubscribeRequest{}
+	if request.ContentLength != 0 {
+		err := json.NewDecoder(request.Body).Decode(&incomingSubscribe)
+		if err != nil {
+			http.Error(writer, "malformed payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := incomingSubscribe.Validate(); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	criteria = claims.Constrain(append(criteria, incomingSubscribe.Criteria...))
+
+	if serverShutdown.isShuttingDown() {
+		http.Error(writer, ShuttingDownErr.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	subscribeResponse := SubscribeResponse{Type: "subscribe"}
+	status := http.StatusOK
+	session, err := getPollSessions().add(criteria, bufferSize(incomingSubscribe.BufferSize), claims)
+	if err != nil {
+		subscribeResponse.Error = err.Error()
+		status = http.StatusInternalServerError
+	} else {
+		subscribeResponse.Uuid = session.uuid
+	}
+
+	jsonResponse, err := json.Marshal(&subscribeResponse)
+	if err != nil {
+		log.Println(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsonResponse)
+}
+
+func poll(writer http.ResponseWriter, request *http.Request, claims *auth.Claims) {
+	sessions := getPollSessions()
+	session, ok := sessions.get(request.URL.Query().Get("uuid"), claims)
+	if !ok {
+		http.Error(writer, "session not found", http.StatusNotFound)
+		return
+	}
+
+	timeout := PollTimeout
+	if rawTimeout := request.URL.Query().Get("timeout"); rawTimeout != "" {
+		requested, err := time.ParseDuration(rawTimeout)
+		if err != nil || requested < 0 {
+			http.Error(writer, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		if requested < timeout {
+			timeout = requested
+		}
+	}
+
+	session.touch(1)
+	defer session.touch(-1)
+
+	messages := []json.RawMessage{}
+	closed := false
+
+	// block for the first message, then take whatever else is already queued
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case message, ok := <-session.ch:
+		if !ok {
+			closed = true
+			break
+		}
+		messages = append(messages, message)
+	case <-timer.C:
+	case <-serverShutdown.draining:
+	case <-request.Context().Done():
+		return
+	}
+
+drain:
+	for !closed && len(messages) < cap(session.ch) {
+		select {
+		case message, ok := <-session.ch:
+			if !ok {
+				closed = true
+				break drain
+			}
+			messages = append(messages, message)
+		default:
+			break drain
+		}
+	}
+
+	// messages may have expired while the session was not polled
+	unexpired := messages[:0]
+	for _, message := range messages {
+		if !dropExpired(message) {
+			unexpired = append(unexpired, message)
+		}
+	}
+	messages = unexpired
+
+	// the connection store closes the channel of connections it dropped
+	if closed {
+		sessions.remove(session.uuid)
+		if len(messages) == 0 {
+			http.Error(writer, "session was dropped", http.StatusGone)
+			return
+		}
+	}
+
+	jsonResponse, err := json.Marshal(messages)
+	if err != nil {
+		log.Println(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsonResponse)
+}
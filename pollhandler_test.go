@@ -0,0 +1,187 @@
+package Bithose
+
+import (
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pollSubscribeRequest(t *testing.T, query, body string) SubscribeResponse {
+	request := httptest.NewRequest("POST", "/poll?"+query, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	PollHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v: %v", recorder.Code, recorder.Body.String())
+	}
+	var subscribeResponse SubscribeResponse
+	json.Unmarshal(recorder.Body.Bytes(), &subscribeResponse)
+	return subscribeResponse
+}
+
+func pollRequest(uuid, timeout string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/poll?uuid="+uuid+"&timeout="+timeout, nil)
+	recorder := httptest.NewRecorder()
+	PollHandler(recorder, request)
+	return recorder
+}
+
+func TestPollHandler_ReceivesMessages(t *testing.T) {
+	subscribeResponse := pollSubscribeRequest(t, "filter=channel==poll_chats", "")
+	defer getPollSessions().remove(subscribeResponse.Uuid)
+
+	for _, body := range []string{"first", "second"} {
+		connectionstore.GetStore().SendMessage(connectionstore.Message{
+			LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "poll_chats"}},
+			Timestamp:  time.Now(),
+			Body:       body,
+		})
+	}
+
+	recorder := pollRequest(subscribeResponse.Uuid, "1s")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", recorder.Code)
+	}
+	var messages []connectionstore.Message
+	json.Unmarshal(recorder.Body.Bytes(), &messages)
+	if len(messages) != 2 || messages[0].Body != "first" || messages[1].Body != "second" {
+		t.Errorf("unexpected messages %v", messages)
+	}
+}
+
+func TestPollHandler_BlocksUntilMessage(t *testing.T) {
+	subscribeResponse := pollSubscribeRequest(t, "", `{"criteria": [{"operator": "==", "label_pair": {"name": "channel", "value": "poll_blocking"}}]}`)
+	defer getPollSessions().remove(subscribeResponse.Uuid)
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		connectionstore.GetStore().SendMessage(connectionstore.Message{
+			LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "poll_blocking"}},
+			Timestamp:  time.Now(),
+			Body:       "late",
+		})
+	}()
+
+	recorder := pollRequest(subscribeResponse.Uuid, "2s")
+	var messages []connectionstore.Message
+	json.Unmarshal(recorder.Body.Bytes(), &messages)
+	if len(messages) != 1 || messages[0].Body != "late" {
+		t.Errorf("unexpected messages %v", messages)
+	}
+}
+
+func TestPollHandler_Timeout(t *testing.T) {
+	subscribeResponse := pollSubscribeRequest(t, "filter=channel==poll_timeout", "")
+	defer getPollSessions().remove(subscribeResponse.Uuid)
+
+	recorder := pollRequest(subscribeResponse.Uuid, "10ms")
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != "[]" {
+		t.Errorf("expected an empty array, got %v %v", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestPollHandler_UnknownSession(t *testing.T) {
+	recorder := pollRequest("does-not-exist", "10ms")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %v", recorder.Code)
+	}
+}
+
+func TestPollHandler_InvalidCriteria(t *testing.T) {
+	request := httptest.NewRequest("POST", "/poll", strings.NewReader(`{"criteria": [{"operator": "!=", "label_pair": {"name": "channel", "value": "x"}}]}`))
+	recorder := httptest.NewRecorder()
+	PollHandler(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %v", recorder.Code)
+	}
+}
+
+func TestPollHandler_SessionOfAnotherSubject(t *testing.T) {
+	enableTestAuth(t)
+
+	withToken := func(method, target, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		PollHandler(recorder, request)
+		return recorder
+	}
+	owner := testToken(`{"sub":"poll_owner"}`)
+	intruder := testToken(`{"sub":"poll_intruder"}`)
+
+	recorder := withToken("POST", "/poll", owner)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v: %v", recorder.Code, recorder.Body.String())
+	}
+	var subscribeResponse SubscribeResponse
+	json.Unmarshal(recorder.Body.Bytes(), &subscribeResponse)
+	defer getPollSessions().remove(subscribeResponse.Uuid)
+
+	for _, method := range []string{"GET", "DELETE"} {
+		recorder = withToken(method, "/poll?timeout=10ms&uuid="+subscribeResponse.Uuid, intruder)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%v of another subject's session should get a 404, got %v", method, recorder.Code)
+		}
+	}
+	if _, ok := getPollSessions().get(subscribeResponse.Uuid, TokenVerifier.SubjectClaims("poll_owner")); !ok {
+		t.Fatal("session should survive another subject's DELETE")
+	}
+
+	recorder = withToken("GET", "/poll?timeout=10ms&uuid="+subscribeResponse.Uuid, owner)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("owner should poll its session, got %v", recorder.Code)
+	}
+	recorder = withToken("DELETE", "/poll?uuid="+subscribeResponse.Uuid, owner)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("owner should end its session, got %v", recorder.Code)
+	}
+}
+
+func TestPollSessions_RemoveIdle(t *testing.T) {
+	subscribeResponse := pollSubscribeRequest(t, "filter=channel==poll_idle", "")
+
+	sessions := getPollSessions()
+	sessions.removeIdle(time.Now())
+	if _, ok := sessions.get(subscribeResponse.Uuid, nil); !ok {
+		t.Fatal("a fresh session should not be removed")
+	}
+
+	sessions.removeIdle(time.Now().Add(PollSessionIdleTimeout * 2))
+	if _, ok := sessions.get(subscribeResponse.Uuid, nil); ok {
+		t.Error("an idle session should be removed")
+	}
+	if _, exists := connectionstore.GetStore().GetConnection(subscribeResponse.Uuid); exists {
+		t.Error("the connection of an idle session should be removed from the store")
+	}
+}
+
+func TestPollHandler_DropsExpiredMessages(t *testing.T) {
+	subscribeResponse := pollSubscribeRequest(t, "filter=channel==poll_expiring", "")
+	defer getPollSessions().remove(subscribeResponse.Uuid)
+
+	expiredBefore := bufferStats.Copy().TotalMessagesExpired
+	for _, ttl := range []float64{0.05, 0} {
+		connectionstore.GetStore().SendMessage(connectionstore.Message{
+			LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "poll_expiring"}},
+			Timestamp:  time.Now(),
+			Body:       ttl,
+			TTL:        ttl,
+		})
+	}
+	// the first message expires in the session's buffer
+	time.Sleep(100 * time.Millisecond)
+
+	recorder := pollRequest(subscribeResponse.Uuid, "1s")
+	var messages []connectionstore.Message
+	json.Unmarshal(recorder.Body.Bytes(), &messages)
+	if len(messages) != 1 || messages[0].Body != 0.0 {
+		t.Errorf("expected only the message without a ttl, got %v", messages)
+	}
+	if expired := bufferStats.Copy().TotalMessagesExpired - expiredBefore; expired != 1 {
+		t.Errorf("expected 1 expired message, got %v", expired)
+	}
+}
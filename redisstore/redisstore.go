@@ -0,0 +1,273 @@
+/*
+Package redisstore shares one message stream between any number of Bithose instances
+through a Redis channel. Every instance runs a Store wrapping its local connection
+store: messages sent through the Store are delivered locally and published to the
+channel, and messages other instances published to the channel are delivered to the
+local subscribers. Filtering stays local, every instance receives every message.
+
+Since every message goes through the local store, a local store keeping history numbers
+and keeps the messages of every instance, and the Store replays from it.
+*/
+package redisstore
+
+import (
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	UuidLib "github.com/google/uuid"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultChannel is the Redis channel messages are published to
+	DefaultChannel = "bithose"
+
+	// ReconnectInterval is how long to wait before connecting again after losing
+	// the connection to Redis
+	ReconnectInterval = time.Second
+
+	// PublishQueueSize is the number of messages queued for publishing while Redis
+	// is slow or unreachable. Messages sent while the queue is full are only
+	// delivered locally
+	PublishQueueSize = 1024
+
+	DialTimeout  = 5 * time.Second
+	ReadTimeout  = 5 * time.Second
+	WriteTimeout = 5 * time.Second
+)
+
+// envelope is what is published to the channel. The node id lets an instance skip
+// the messages it published itself, which were already delivered locally.
+type envelope struct {
+	NodeId  string                  `json:"node_id"`
+	Message connectionstore.Message `json:"message"`
+}
+
+// Store is a connectionstore.ConnectionStore that shares its messages with other
+// instances through a Redis channel.
+type Store struct {
+	local   connectionstore.ConnectionStore
+	address string
+	channel string
+	nodeId  string
+
+	messages chan []byte
+	// reconnectInterval is ReconnectInterval when the store was created
+	reconnectInterval time.Duration
+
+	mtx *sync.Mutex
+	// conns holds the open connections to Redis, which are closed by Close
+	conns map[*respConn]struct{}
+	stop  chan struct{}
+}
+
+// NewStore wraps the local store and starts publishing to and receiving from the
+// channel on the Redis server at address, a host:port pair. Connections to Redis
+// are retried every ReconnectInterval, as it is when the store is created, until
+// Close is called.
+func NewStore(local connectionstore.ConnectionStore, address string, channel string) *Store {
+	s := &Store{
+		local:             local,
+		address:           address,
+		channel:           channel,
+		nodeId:            UuidLib.New().String(),
+		messages:          make(chan []byte, PublishQueueSize),
+		reconnectInterval: ReconnectInterval,
+		mtx:               &sync.Mutex{},
+		conns:             map[*respConn]struct{}{},
+		stop:              make(chan struct{}),
+	}
+
+	go s.publish()
+	go s.subscribe()
+
+	return s
+}
+
+// Close stops publishing and receiving messages
+func (s *Store) Close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	close(s.stop)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = map[*respConn]struct{}{}
+}
+
+func (s *Store) AddConnection(connection *connectionstore.Connection) (string, error) {
+	return s.local.AddConnection(connection)
+}
+
+func (s *Store) RemoveConnection(uuid string) {
+	s.local.RemoveConnection(uuid)
+}
+
+func (s *Store) GetConnection(uuid string) (connection *connectionstore.Connection, exists bool) {
+	return s.local.GetConnection(uuid)
+}
+
+// SendMessage delivers the message to the local subscribers and queues it for
+// publishing to the channel. The returned counts are local.
+func (s *Store) SendMessage(message connectionstore.Message) (numOfSent int, numOfTimeouts int, err error) {
+	payload, err := json.Marshal(envelope{NodeId: s.nodeId, Message: message})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	numOfSent, numOfTimeouts, err = s.local.SendMessage(message)
+	if err != nil {
+		return numOfSent, numOfTimeouts, err
+	}
+
+	select {
+	case s.messages <- payload:
+	default:
+		log.Println("redisstore: publish queue is full, dropping message")
+	}
+
+	return numOfSent, numOfTimeouts, nil
+}
+
+func (s *Store) Stats() *connectionstore.Statistics {
+	return s.local.Stats()
+}
+
+// Replay replays the history of the local store, if it keeps one
+func (s *Store) Replay(from connectionstore.ReplayPosition, criteria []connectionstore.LabelAcceptanceCriterion, fn func(connectionstore.Message) bool) error {
+	replayer, ok := s.local.(connectionstore.Replayer)
+	if !ok {
+		return connectionstore.ReplayUnsupportedErr
+	}
+	return replayer.Replay(from, criteria, fn)
+}
+
+// publish publishes the queued messages in order. A message is published again after
+// reconnecting if the connection was lost while publishing it.
+func (s *Store) publish() {
+	var conn *respConn
+	for {
+		select {
+		case <-s.stop:
+			return
+		case payload := <-s.messages:
+			for {
+				if conn == nil {
+					if conn = s.connect(); conn == nil {
+						return
+					}
+				}
+				_, err := conn.do("PUBLISH", s.channel, string(payload))
+				if err == nil {
+					break
+				}
+				if _, ok := err.(respError); ok {
+					log.Println("redisstore:", err)
+					break
+				}
+				log.Println("redisstore:", err)
+				s.release(conn)
+				conn = nil
+			}
+		}
+	}
+}
+
+// subscribe delivers the messages received from the channel to the local subscribers,
+// subscribing again whenever the connection is lost
+func (s *Store) subscribe() {
+	for {
+		conn := s.connect()
+		if conn == nil {
+			return
+		}
+		err := s.receive(conn)
+		s.release(conn)
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		log.Println("redisstore:", err)
+	}
+}
+
+func (s *Store) receive(conn *respConn) error {
+	if err := conn.send("SUBSCRIBE", s.channel); err != nil {
+		return err
+	}
+
+	for {
+		reply, err := conn.receive()
+		if err != nil {
+			return err
+		}
+		// besides messages, the subscription confirmation is received
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		payload, ok := parts[2].(string)
+		if !ok {
+			continue
+		}
+		s.deliver([]byte(payload))
+	}
+}
+
+// deliver sends a message published by another instance to the local subscribers
+func (s *Store) deliver(payload []byte) {
+	var received envelope
+	if err := json.Unmarshal(payload, &received); err != nil {
+		log.Println("redisstore:", err)
+		return
+	}
+	if received.NodeId == s.nodeId {
+		return
+	}
+	// sequence numbers are per instance, the local store numbers the message again
+	received.Message.Seq = 0
+	received.Message.Epoch = ""
+
+	if _, _, err := s.local.SendMessage(received.Message); err != nil {
+		log.Println("redisstore:", err)
+	}
+}
+
+// connect dials Redis until it succeeds or the store is closed, in which case it
+// returns nil
+func (s *Store) connect() *respConn {
+	for {
+		conn, err := dialResp(s.address)
+		if err == nil {
+			s.mtx.Lock()
+			select {
+			case <-s.stop:
+				s.mtx.Unlock()
+				conn.Close()
+				return nil
+			default:
+			}
+			s.conns[conn] = struct{}{}
+			s.mtx.Unlock()
+			return conn
+		}
+		log.Println("redisstore:", err)
+
+		select {
+		case <-s.stop:
+			return nil
+		case <-time.After(s.reconnectInterval):
+		}
+	}
+}
+
+func (s *Store) release(conn *respConn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.conns, conn)
+	conn.Close()
+}
@@ -0,0 +1,273 @@
+package redisstore
+
+import (
+	"bufio"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for redis-server supporting PING, PUBLISH and
+// SUBSCRIBE
+type fakeRedis struct {
+	t        *testing.T
+	address  string
+	listener net.Listener
+
+	mtx         *sync.Mutex
+	conns       map[*fakeRedisConn]struct{}
+	subscribers map[string]map[*fakeRedisConn]struct{}
+}
+
+type fakeRedisConn struct {
+	*respConn
+	mtx *sync.Mutex
+}
+
+func (c *fakeRedisConn) write(reply string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.conn.Write([]byte(reply))
+}
+
+func bulkString(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func startFakeRedis(t *testing.T, address string) *fakeRedis {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{
+		t:           t,
+		address:     listener.Addr().String(),
+		listener:    listener,
+		mtx:         &sync.Mutex{},
+		conns:       map[*fakeRedisConn]struct{}{},
+		subscribers: map[string]map[*fakeRedisConn]struct{}{},
+	}
+	go r.accept()
+	return r
+}
+
+// stop closes the listener and every connection, like a restarting server
+func (r *fakeRedis) stop() {
+	r.listener.Close()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+func (r *fakeRedis) numOfSubscribers(channel string) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.subscribers[channel])
+}
+
+func (r *fakeRedis) accept() {
+	for {
+		netConn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := &fakeRedisConn{
+			respConn: &respConn{conn: netConn, reader: bufio.NewReader(netConn)},
+			mtx:      &sync.Mutex{},
+		}
+		r.mtx.Lock()
+		r.conns[conn] = struct{}{}
+		r.mtx.Unlock()
+		go r.serve(conn)
+	}
+}
+
+func (r *fakeRedis) serve(conn *fakeRedisConn) {
+	defer func() {
+		r.mtx.Lock()
+		delete(r.conns, conn)
+		for _, subscribers := range r.subscribers {
+			delete(subscribers, conn)
+		}
+		r.mtx.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		// commands are arrays of bulk strings, which the client's reply parser reads
+		command, err := conn.receive()
+		if err != nil {
+			return
+		}
+		args, _ := command.([]interface{})
+		if len(args) == 0 {
+			conn.write("-ERR invalid command\r\n")
+			continue
+		}
+
+		switch args[0] {
+		case "PING":
+			conn.write("+PONG\r\n")
+		case "SUBSCRIBE":
+			channel := args[1].(string)
+			r.mtx.Lock()
+			if _, ok := r.subscribers[channel]; !ok {
+				r.subscribers[channel] = map[*fakeRedisConn]struct{}{}
+			}
+			r.subscribers[channel][conn] = struct{}{}
+			r.mtx.Unlock()
+			conn.write("*3\r\n" + bulkString("subscribe") + bulkString(channel) + ":1\r\n")
+		case "PUBLISH":
+			channel, payload := args[1].(string), args[2].(string)
+			r.mtx.Lock()
+			for subscriber := range r.subscribers[channel] {
+				subscriber.write("*3\r\n" + bulkString("message") + bulkString(channel) + bulkString(payload))
+			}
+			numOfSubscribers := len(r.subscribers[channel])
+			r.mtx.Unlock()
+			conn.write(":" + strconv.Itoa(numOfSubscribers) + "\r\n")
+		default:
+			conn.write("-ERR unknown command\r\n")
+		}
+	}
+}
+
+// waitFor polls the condition until it holds or two seconds pass
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func channelConnection(ch chan []byte, channel string) *connectionstore.Connection {
+	return connectionstore.NewConnection(ch, []connectionstore.LabelAcceptanceCriterion{
+		{
+			LabelPair: connectionstore.LabelPair{Name: "channel", Value: channel},
+			Operator:  "==",
+		},
+	})
+}
+
+func channelMessage(channel string) connectionstore.Message {
+	return connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: channel}},
+		Timestamp:  time.Now(),
+		Body:       "hello there",
+	}
+}
+
+func expectMessage(t *testing.T, ch chan []byte, reason string) {
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Fatal(reason)
+	}
+}
+
+func expectNoMessage(t *testing.T, ch chan []byte, reason string) {
+	select {
+	case <-ch:
+		t.Error(reason)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStore_SharesMessagesBetweenInstances(t *testing.T) {
+	redis := startFakeRedis(t, "127.0.0.1:0")
+	defer redis.stop()
+
+	storeA := NewStore(connectionstore.NewShardedStore(1), redis.address, DefaultChannel)
+	defer storeA.Close()
+	storeB := NewStore(connectionstore.NewShardedStore(1), redis.address, DefaultChannel)
+	defer storeB.Close()
+	waitFor(t, func() bool { return redis.numOfSubscribers(DefaultChannel) == 2 })
+
+	chA := make(chan []byte, 10)
+	storeA.AddConnection(channelConnection(chA, "a"))
+	chB := make(chan []byte, 10)
+	storeB.AddConnection(channelConnection(chB, "a"))
+	chOther := make(chan []byte, 10)
+	storeB.AddConnection(channelConnection(chOther, "b"))
+
+	numOfSent, _, err := storeA.SendMessage(channelMessage("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numOfSent != 1 {
+		t.Errorf("numOfSent should be 1 but got %d", numOfSent)
+	}
+
+	expectMessage(t, chA, "message should be delivered locally")
+	expectMessage(t, chB, "message should be delivered by the other instance")
+	expectNoMessage(t, chOther, "message should be filtered by the other instance")
+	expectNoMessage(t, chA, "message published by an instance should not be delivered to it twice")
+}
+
+func TestStore_ReplaysMessagesOfEveryInstance(t *testing.T) {
+	redis := startFakeRedis(t, "127.0.0.1:0")
+	defer redis.stop()
+
+	storeA := NewStore(connectionstore.NewShardedStore(1), redis.address, DefaultChannel)
+	defer storeA.Close()
+	history := connectionstore.NewHistoryStore(connectionstore.NewShardedStore(1), 10)
+	storeB := NewStore(history, redis.address, DefaultChannel)
+	defer storeB.Close()
+	waitFor(t, func() bool { return redis.numOfSubscribers(DefaultChannel) == 2 })
+
+	ch := make(chan []byte, 10)
+	storeB.AddConnection(channelConnection(ch, "a"))
+	storeB.SendMessage(channelMessage("a"))
+	expectMessage(t, ch, "message should be delivered locally")
+	storeA.SendMessage(channelMessage("a"))
+	expectMessage(t, ch, "message should be delivered by the other instance")
+
+	var seqs []int64
+	err := storeB.Replay(connectionstore.ReplayPosition{Epoch: history.Epoch()}, nil, func(message connectionstore.Message) bool {
+		seqs = append(seqs, message.Seq)
+		return true
+	})
+	if err != nil || len(seqs) != 2 || seqs[1] != 2 {
+		t.Errorf("expected the messages of both instances to be replayed, got %v %v", seqs, err)
+	}
+	if err := storeA.Replay(connectionstore.ReplayPosition{}, nil, nil); err != connectionstore.ReplayUnsupportedErr {
+		t.Errorf("expected ReplayUnsupportedErr without history, got %v", err)
+	}
+}
+
+func TestStore_Reconnects(t *testing.T) {
+	interval := ReconnectInterval
+	ReconnectInterval = 10 * time.Millisecond
+	t.Cleanup(func() { ReconnectInterval = interval })
+
+	redis := startFakeRedis(t, "127.0.0.1:0")
+	address := redis.address
+
+	storeA := NewStore(connectionstore.NewShardedStore(1), address, DefaultChannel)
+	defer storeA.Close()
+	storeB := NewStore(connectionstore.NewShardedStore(1), address, DefaultChannel)
+	defer storeB.Close()
+	waitFor(t, func() bool { return redis.numOfSubscribers(DefaultChannel) == 2 })
+
+	ch := make(chan []byte, 10)
+	storeB.AddConnection(channelConnection(ch, "a"))
+
+	storeA.SendMessage(channelMessage("a"))
+	expectMessage(t, ch, "message should be delivered before the restart")
+
+	redis.stop()
+	redis = startFakeRedis(t, address)
+	defer redis.stop()
+	waitFor(t, func() bool { return redis.numOfSubscribers(DefaultChannel) == 2 })
+
+	storeA.SendMessage(channelMessage("a"))
+	expectMessage(t, ch, "message should be delivered after the restart")
+}
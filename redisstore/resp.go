@@ -0,0 +1,128 @@
+package redisstore
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	InvalidReplyErr = errors.New("invalid reply from redis")
+)
+
+// respError is an error reply sent by redis
+type respError string
+
+func (e respError) Error() string {
+	return "redis: " + string(e)
+}
+
+// respConn is a minimal client for the Redis serialization protocol, covering the
+// commands the store needs
+type respConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialResp(address string) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", address, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+func (c *respConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends the command and reads its reply
+func (c *respConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	return c.receive()
+}
+
+// send writes the command as an array of bulk strings
+func (c *respConn) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// receive reads a reply. Simple strings and bulk strings are returned as strings,
+// integers as int64, arrays as []interface{} and a nil bulk string as nil. Error
+// replies are returned as errors.
+func (c *respConn) receive() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, InvalidReplyErr
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, InvalidReplyErr
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, InvalidReplyErr
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		reply := make([]interface{}, size)
+		for i := range reply {
+			if reply[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return reply, nil
+	}
+	return nil, InvalidReplyErr
+}
+
+func (c *respConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", InvalidReplyErr
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,104 @@
+package Bithose
+
+import (
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"log"
+)
+
+// replay sends a subscription the kept messages from the position on that the
+// criteria accept, calling respond before the first of them, or once there are none.
+// It runs while the connection of the subscription is added, so the live messages
+// arriving on ch meanwhile are drained for the store not to drop a subscription that
+// falls behind. A store keeps a message before delivering it, so the replay is
+// repeated from the last message replayed until none of the drained ones were
+// missed. It returns the sequence number of the last message replayed, for the live
+// messages up to it to be skipped, whether respond was called, and the error of the
+// replay or of send. It returns early once stop is closed.
+func replay(replayer connectionstore.Replayer, from connectionstore.ReplayPosition, criteria []connectionstore.LabelAcceptanceCriterion,
+	ch <-chan []byte, stop <-chan struct{}, send func([]byte) error, respond func()) (lastReplayed int64, responded bool, err error) {
+
+	stopped := false
+	var sendErr error
+	fn := func(message connectionstore.Message) bool {
+		select {
+		case <-stop:
+			stopped = true
+			return false
+		default:
+		}
+		if !responded {
+			responded = true
+			respond()
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			log.Println(err)
+			return true
+		}
+		if sendErr = send(data); sendErr != nil {
+			return false
+		}
+		lastReplayed = message.Seq
+		from = connectionstore.ReplayPosition{Epoch: message.Epoch, Seq: message.Seq}
+		return true
+	}
+
+	for {
+		halt := make(chan struct{})
+		missed := make(chan int64, 1)
+		go func() {
+			var maxSeq int64
+			defer func() { missed <- maxSeq }()
+			for {
+				select {
+				case message, ok := <-ch:
+					if !ok {
+						return
+					}
+					if seq := messageSeq(message); seq > maxSeq {
+						maxSeq = seq
+					}
+				case <-halt:
+					return
+				}
+			}
+		}()
+
+		err = replayer.Replay(from, criteria, fn)
+		close(halt)
+		maxSeq := <-missed
+		if err == nil {
+			err = sendErr
+		}
+		if err != nil || stopped {
+			return lastReplayed, responded, err
+		}
+		if maxSeq <= lastReplayed {
+			break
+		}
+		select {
+		case <-stop:
+			return lastReplayed, responded, nil
+		default:
+		}
+	}
+
+	if !responded {
+		responded = true
+		respond()
+	}
+	return lastReplayed, responded, nil
+}
+
+// messageSeq returns the sequence number of the json encoded message, or 0 if it
+// has none
+func messageSeq(message []byte) int64 {
+	var stub = struct {
+		Seq int64 `json:"seq"`
+	}{}
+	if err := json.Unmarshal(message, &stub); err != nil {
+		return 0
+	}
+	return stub.Seq
+}
@@ -1,12 +1,47 @@
 package Bithose
 
 import (
+	"fmt"
 	"github.com/JonathanRosado/Bithose/connectionstore"
+	"sort"
+	"time"
 )
 
 type IncomingSubscribeRequest struct {
 	Type     string                                     `json:"type"`
 	Criteria []connectionstore.LabelAcceptanceCriterion `json:"criteria"`
+	// BufferSize is the number of messages the server may buffer for the
+	// subscription. 0 uses the server default
+	BufferSize int `json:"buffer_size,omitempty"`
+	// SinceSeq replays the kept messages published after the sequence number before
+	// live delivery starts. SinceEpoch is the epoch of the message it is from, and
+	// the replay is refused if the server numbers messages in another epoch
+	SinceSeq   *int64 `json:"since_seq,omitempty"`
+	SinceEpoch string `json:"since_epoch,omitempty"`
+	// SinceTime replays the kept messages published at or after the time
+	SinceTime *time.Time `json:"since_time,omitempty"`
+}
+
+// Validate returns an error if one of the criteria can never be evaluated
+func (i *IncomingSubscribeRequest) Validate() error {
+	for _, criterion := range i.Criteria {
+		if err := criterion.Validate(); err != nil {
+			return fmt.Errorf("criterion on %v: %w", criterion.LabelPair.Name, err)
+		}
+	}
+	return nil
+}
+
+// ReplayPosition returns where the subscription's replay starts, or nil if it asked
+// for none
+func (i *IncomingSubscribeRequest) ReplayPosition() *connectionstore.ReplayPosition {
+	switch {
+	case i.SinceTime != nil:
+		return &connectionstore.ReplayPosition{Time: *i.SinceTime}
+	case i.SinceSeq != nil:
+		return &connectionstore.ReplayPosition{Epoch: i.SinceEpoch, Seq: *i.SinceSeq}
+	}
+	return nil
 }
 
 type IncomingUnsubscribeRequest struct {
@@ -17,4 +52,59 @@ type IncomingUnsubscribeRequest struct {
 type IncomingMessage struct {
 	Type    string                  `json:"type"`
 	Message connectionstore.Message `json:"message"`
+	// ApiKey authorizes the publish when publisher keys are configured. Without it,
+	// the key the websocket was opened with is used
+	ApiKey string `json:"api_key,omitempty"`
+}
+
+// IncomingPublishRequest is the payload of POST /publish. It accepts both the documented
+// shape ({"labels": {...}, "data": ...}) and the connectionstore.Message shape
+// ({"label_pairs": [...], "body": ...}).
+type IncomingPublishRequest struct {
+	Labels     map[string]interface{}      `json:"labels"`
+	Data       interface{}                 `json:"data"`
+	LabelPairs []connectionstore.LabelPair `json:"label_pairs"`
+	Body       interface{}                 `json:"body"`
+	// Retain keeps the message as the last value of its labels for new subscribers
+	Retain bool `json:"retain"`
+	// Ttl is the number of seconds after which the message is dropped instead of
+	// delivered, ExpiresAt the time
+	Ttl       float64    `json:"ttl"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Message converts the request into a connectionstore.Message. Labels given as an object
+// are appended after label_pairs, sorted by name so the resulting message is deterministic.
+func (i *IncomingPublishRequest) Message() (connectionstore.Message, error) {
+	labelPairs := append([]connectionstore.LabelPair{}, i.LabelPairs...)
+
+	names := make([]string, 0, len(i.Labels))
+	for name := range i.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		labelPairs = append(labelPairs, connectionstore.LabelPair{
+			Name:  name,
+			Value: i.Labels[name],
+		})
+	}
+
+	body := i.Body
+	if body == nil {
+		body = i.Data
+	}
+
+	message := connectionstore.Message{
+		LabelPairs: labelPairs,
+		Timestamp:  time.Now(),
+		Body:       body,
+		Retain:     i.Retain,
+		TTL:        i.Ttl,
+		ExpiresAt:  i.ExpiresAt,
+	}
+	if err := message.Validate(); err != nil {
+		return connectionstore.Message{}, err
+	}
+	return message, nil
 }
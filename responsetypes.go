@@ -1,12 +1,24 @@
 package Bithose
 
+// SendMessageResponse carries the type "message" when it answers a message frame on a
+// websocket, so that clients can tell it apart from the messages they receive
 type SendMessageResponse struct {
+	Type             string `json:"type,omitempty"`
 	NumberOfSents    int    `json:"number_of_sents"`
 	NumberOfTimeouts int    `json:"number_of_timeouts"`
 	Error            string `json:"error"`
 }
 
+// SubscribeResponse and UnsubscribeResponse carry the type of the request they
+// answer, since both have the same fields otherwise
 type SubscribeResponse struct {
+	Type  string `json:"type"`
+	Uuid  string `json:"uuid"`
+	Error string `json:"error"`
+}
+
+type UnsubscribeResponse struct {
+	Type  string `json:"type"`
 	Uuid  string `json:"uuid"`
 	Error string `json:"error"`
 }
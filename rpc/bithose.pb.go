@@ -0,0 +1,650 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: bithose.proto
+
+package rpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// LabelValue is a string, a number or a boolean.
+type LabelValue struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Value:
+	//
+	//	*LabelValue_StringValue
+	//	*LabelValue_NumberValue
+	//	*LabelValue_BoolValue
+	Value         isLabelValue_Value `protobuf_oneof:"value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LabelValue) Reset() {
+	*x = LabelValue{}
+	mi := &file_bithose_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LabelValue) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LabelValue) ProtoMessage() {}
+
+func (x *LabelValue) ProtoReflect() protoreflect.Message {
+	mi := &file_bithose_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LabelValue.ProtoReflect.Descriptor instead.
+func (*LabelValue) Descriptor() ([]byte, []int) {
+	return file_bithose_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LabelValue) GetValue() isLabelValue_Value {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+func (x *LabelValue) GetStringValue() string {
+	if x != nil {
+		if x, ok := x.Value.(*LabelValue_StringValue); ok {
+			return x.StringValue
+		}
+	}
+	return ""
+}
+
+func (x *LabelValue) GetNumberValue() float64 {
+	if x != nil {
+		if x, ok := x.Value.(*LabelValue_NumberValue); ok {
+			return x.NumberValue
+		}
+	}
+	return 0
+}
+
+func (x *LabelValue) GetBoolValue() bool {
+	if x != nil {
+		if x, ok := x.Value.(*LabelValue_BoolValue); ok {
+			return x.BoolValue
+		}
+	}
+	return false
+}
+
+type isLabelValue_Value interface {
+	isLabelValue_Value()
+}
+
+type LabelValue_StringValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,json=stringValue,proto3,oneof"`
+}
+
+type LabelValue_NumberValue struct {
+	NumberValue float64 `protobuf:"fixed64,2,opt,name=number_value,json=numberValue,proto3,oneof"`
+}
+
+type LabelValue_BoolValue struct {
+	BoolValue bool `protobuf:"varint,3,opt,name=bool_value,json=boolValue,proto3,oneof"`
+}
+
+func (*LabelValue_StringValue) isLabelValue_Value() {}
+
+func (*LabelValue_NumberValue) isLabelValue_Value() {}
+
+func (*LabelValue_BoolValue) isLabelValue_Value() {}
+
+type LabelPair struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value         *LabelValue            `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LabelPair) Reset() {
+	*x = LabelPair{}
+	mi := &file_bithose_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LabelPair) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LabelPair) ProtoMessage() {}
+
+func (x *LabelPair) ProtoReflect() protoreflect.Message {
+	mi := &file_bithose_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LabelPair.ProtoReflect.Descriptor instead.
+func (*LabelPair) Descriptor() ([]byte, []int) {
+	return file_bithose_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LabelPair) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *LabelPair) GetValue() *LabelValue {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+type LabelAcceptanceCriterion struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	LabelPair *LabelPair             `protobuf:"bytes,1,opt,name=label_pair,json=labelPair,proto3" json:"label_pair,omitempty"`
+	// One of ==, >, <, >= or <=. Only numbers may use the range operators.
+	Operator      string `protobuf:"bytes,2,opt,name=operator,proto3" json:"operator,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LabelAcceptanceCriterion) Reset() {
+	*x = LabelAcceptanceCriterion{}
+	mi := &file_bithose_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LabelAcceptanceCriterion) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LabelAcceptanceCriterion) ProtoMessage() {}
+
+func (x *LabelAcceptanceCriterion) ProtoReflect() protoreflect.Message {
+	mi := &file_bithose_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LabelAcceptanceCriterion.ProtoReflect.Descriptor instead.
+func (*LabelAcceptanceCriterion) Descriptor() ([]byte, []int) {
+	return file_bithose_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *LabelAcceptanceCriterion) GetLabelPair() *LabelPair {
+	if x != nil {
+		return x.LabelPair
+	}
+	return nil
+}
+
+func (x *LabelAcceptanceCriterion) GetOperator() string {
+	if x != nil {
+		return x.Operator
+	}
+	return ""
+}
+
+type Message struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	LabelPairs []*LabelPair           `protobuf:"bytes,1,rep,name=label_pairs,json=labelPairs,proto3" json:"label_pairs,omitempty"`
+	Timestamp  *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Any json value.
+	Body *structpb.Value `protobuf:"bytes,3,opt,name=body,proto3" json:"body,omitempty"`
+	// Sequence number of the message in epoch, 0 if the server keeps no history.
+	// Subscribing with both resumes after the message.
+	Seq           int64  `protobuf:"varint,4,opt,name=seq,proto3" json:"seq,omitempty"`
+	Epoch         string `protobuf:"bytes,5,opt,name=epoch,proto3" json:"epoch,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_bithose_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_bithose_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_bithose_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Message) GetLabelPairs() []*LabelPair {
+	if x != nil {
+		return x.LabelPairs
+	}
+	return nil
+}
+
+func (x *Message) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Message) GetBody() *structpb.Value {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+func (x *Message) GetSeq() int64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Message) GetEpoch() string {
+	if x != nil {
+		return x.Epoch
+	}
+	return ""
+}
+
+type PublishRequest struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	LabelPairs []*LabelPair           `protobuf:"bytes,1,rep,name=label_pairs,json=labelPairs,proto3" json:"label_pairs,omitempty"`
+	Body       *structpb.Value        `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	// Keeps the message as the last value of its label set, delivered to every
+	// new subscription that accepts it. Retaining an empty body clears the value.
+	Retain bool `protobuf:"varint,3,opt,name=retain,proto3" json:"retain,omitempty"`
+	// Seconds after publishing at which the message expires, 0 if it does not.
+	Ttl float64 `protobuf:"fixed64,4,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	// When the message expires, overriding ttl.
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PublishRequest) Reset() {
+	*x = PublishRequest{}
+	mi := &file_bithose_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublishRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishRequest) ProtoMessage() {}
+
+func (x *PublishRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bithose_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishRequest.ProtoReflect.Descriptor instead.
+func (*PublishRequest) Descriptor() ([]byte, []int) {
+	return file_bithose_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PublishRequest) GetLabelPairs() []*LabelPair {
+	if x != nil {
+		return x.LabelPairs
+	}
+	return nil
+}
+
+func (x *PublishRequest) GetBody() *structpb.Value {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+func (x *PublishRequest) GetRetain() bool {
+	if x != nil {
+		return x.Retain
+	}
+	return false
+}
+
+func (x *PublishRequest) GetTtl() float64 {
+	if x != nil {
+		return x.Ttl
+	}
+	return 0
+}
+
+func (x *PublishRequest) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+type PublishResponse struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	NumberOfSents    int32                  `protobuf:"varint,1,opt,name=number_of_sents,json=numberOfSents,proto3" json:"number_of_sents,omitempty"`
+	NumberOfTimeouts int32                  `protobuf:"varint,2,opt,name=number_of_timeouts,json=numberOfTimeouts,proto3" json:"number_of_timeouts,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *PublishResponse) Reset() {
+	*x = PublishResponse{}
+	mi := &file_bithose_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublishResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishResponse) ProtoMessage() {}
+
+func (x *PublishResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bithose_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishResponse.ProtoReflect.Descriptor instead.
+func (*PublishResponse) Descriptor() ([]byte, []int) {
+	return file_bithose_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PublishResponse) GetNumberOfSents() int32 {
+	if x != nil {
+		return x.NumberOfSents
+	}
+	return 0
+}
+
+func (x *PublishResponse) GetNumberOfTimeouts() int32 {
+	if x != nil {
+		return x.NumberOfTimeouts
+	}
+	return 0
+}
+
+type SubscribeRequest struct {
+	state    protoimpl.MessageState      `protogen:"open.v1"`
+	Criteria []*LabelAcceptanceCriterion `protobuf:"bytes,1,rep,name=criteria,proto3" json:"criteria,omitempty"`
+	// Number of messages the server may buffer for the subscription. 0 uses the
+	// server default.
+	BufferSize int32 `protobuf:"varint,2,opt,name=buffer_size,json=bufferSize,proto3" json:"buffer_size,omitempty"`
+	// Replays the kept messages published after the message with this seq of
+	// since_epoch before live delivery starts. A replay that can not be made fails
+	// the call with FailedPrecondition.
+	SinceSeq   *int64 `protobuf:"varint,3,opt,name=since_seq,json=sinceSeq,proto3,oneof" json:"since_seq,omitempty"`
+	SinceEpoch string `protobuf:"bytes,4,opt,name=since_epoch,json=sinceEpoch,proto3" json:"since_epoch,omitempty"`
+	// Replays the kept messages published at or after the time instead.
+	SinceTime     *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=since_time,json=sinceTime,proto3" json:"since_time,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	mi := &file_bithose_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bithose_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_bithose_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *SubscribeRequest) GetCriteria() []*LabelAcceptanceCriterion {
+	if x != nil {
+		return x.Criteria
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetBufferSize() int32 {
+	if x != nil {
+		return x.BufferSize
+	}
+	return 0
+}
+
+func (x *SubscribeRequest) GetSinceSeq() int64 {
+	if x != nil && x.SinceSeq != nil {
+		return *x.SinceSeq
+	}
+	return 0
+}
+
+func (x *SubscribeRequest) GetSinceEpoch() string {
+	if x != nil {
+		return x.SinceEpoch
+	}
+	return ""
+}
+
+func (x *SubscribeRequest) GetSinceTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.SinceTime
+	}
+	return nil
+}
+
+var File_bithose_proto protoreflect.FileDescriptor
+
+const file_bithose_proto_rawDesc = "" +
+	"\n" +
+	"\rbithose.proto\x12\abithose\x1a\x1cgoogle/protobuf/struct.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\x80\x01\n" +
+	"\n" +
+	"LabelValue\x12#\n" +
+	"\fstring_value\x18\x01 \x01(\tH\x00R\vstringValue\x12#\n" +
+	"\fnumber_value\x18\x02 \x01(\x01H\x00R\vnumberValue\x12\x1f\n" +
+	"\n" +
+	"bool_value\x18\x03 \x01(\bH\x00R\tboolValueB\a\n" +
+	"\x05value\"J\n" +
+	"\tLabelPair\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12)\n" +
+	"\x05value\x18\x02 \x01(\v2\x13.bithose.LabelValueR\x05value\"i\n" +
+	"\x18LabelAcceptanceCriterion\x121\n" +
+	"\n" +
+	"label_pair\x18\x01 \x01(\v2\x12.bithose.LabelPairR\tlabelPair\x12\x1a\n" +
+	"\boperator\x18\x02 \x01(\tR\boperator\"\xcc\x01\n" +
+	"\aMessage\x123\n" +
+	"\vlabel_pairs\x18\x01 \x03(\v2\x12.bithose.LabelPairR\n" +
+	"labelPairs\x128\n" +
+	"\ttimestamp\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12*\n" +
+	"\x04body\x18\x03 \x01(\v2\x16.google.protobuf.ValueR\x04body\x12\x10\n" +
+	"\x03seq\x18\x04 \x01(\x03R\x03seq\x12\x14\n" +
+	"\x05epoch\x18\x05 \x01(\tR\x05epoch\"\xd6\x01\n" +
+	"\x0ePublishRequest\x123\n" +
+	"\vlabel_pairs\x18\x01 \x03(\v2\x12.bithose.LabelPairR\n" +
+	"labelPairs\x12*\n" +
+	"\x04body\x18\x02 \x01(\v2\x16.google.protobuf.ValueR\x04body\x12\x16\n" +
+	"\x06retain\x18\x03 \x01(\bR\x06retain\x12\x10\n" +
+	"\x03ttl\x18\x04 \x01(\x01R\x03ttl\x129\n" +
+	"\n" +
+	"expires_at\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\"g\n" +
+	"\x0fPublishResponse\x12&\n" +
+	"\x0fnumber_of_sents\x18\x01 \x01(\x05R\rnumberOfSents\x12,\n" +
+	"\x12number_of_timeouts\x18\x02 \x01(\x05R\x10numberOfTimeouts\"\xfe\x01\n" +
+	"\x10SubscribeRequest\x12=\n" +
+	"\bcriteria\x18\x01 \x03(\v2!.bithose.LabelAcceptanceCriterionR\bcriteria\x12\x1f\n" +
+	"\vbuffer_size\x18\x02 \x01(\x05R\n" +
+	"bufferSize\x12 \n" +
+	"\tsince_seq\x18\x03 \x01(\x03H\x00R\bsinceSeq\x88\x01\x01\x12\x1f\n" +
+	"\vsince_epoch\x18\x04 \x01(\tR\n" +
+	"sinceEpoch\x129\n" +
+	"\n" +
+	"since_time\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\tsinceTimeB\f\n" +
+	"\n" +
+	"_since_seq2\x83\x01\n" +
+	"\aBithose\x12<\n" +
+	"\aPublish\x12\x17.bithose.PublishRequest\x1a\x18.bithose.PublishResponse\x12:\n" +
+	"\tSubscribe\x12\x19.bithose.SubscribeRequest\x1a\x10.bithose.Message0\x01BL\n" +
+	"!com.github.jonathanrosado.bithoseP\x01Z%github.com/JonathanRosado/Bithose/rpcb\x06proto3"
+
+var (
+	file_bithose_proto_rawDescOnce sync.Once
+	file_bithose_proto_rawDescData []byte
+)
+
+func file_bithose_proto_rawDescGZIP() []byte {
+	file_bithose_proto_rawDescOnce.Do(func() {
+		file_bithose_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_bithose_proto_rawDesc), len(file_bithose_proto_rawDesc)))
+	})
+	return file_bithose_proto_rawDescData
+}
+
+var file_bithose_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_bithose_proto_goTypes = []any{
+	(*LabelValue)(nil),               // 0: bithose.LabelValue
+	(*LabelPair)(nil),                // 1: bithose.LabelPair
+	(*LabelAcceptanceCriterion)(nil), // 2: bithose.LabelAcceptanceCriterion
+	(*Message)(nil),                  // 3: bithose.Message
+	(*PublishRequest)(nil),           // 4: bithose.PublishRequest
+	(*PublishResponse)(nil),          // 5: bithose.PublishResponse
+	(*SubscribeRequest)(nil),         // 6: bithose.SubscribeRequest
+	(*timestamppb.Timestamp)(nil),    // 7: google.protobuf.Timestamp
+	(*structpb.Value)(nil),           // 8: google.protobuf.Value
+}
+var file_bithose_proto_depIdxs = []int32{
+	0,  // 0: bithose.LabelPair.value:type_name -> bithose.LabelValue
+	1,  // 1: bithose.LabelAcceptanceCriterion.label_pair:type_name -> bithose.LabelPair
+	1,  // 2: bithose.Message.label_pairs:type_name -> bithose.LabelPair
+	7,  // 3: bithose.Message.timestamp:type_name -> google.protobuf.Timestamp
+	8,  // 4: bithose.Message.body:type_name -> google.protobuf.Value
+	1,  // 5: bithose.PublishRequest.label_pairs:type_name -> bithose.LabelPair
+	8,  // 6: bithose.PublishRequest.body:type_name -> google.protobuf.Value
+	7,  // 7: bithose.PublishRequest.expires_at:type_name -> google.protobuf.Timestamp
+	2,  // 8: bithose.SubscribeRequest.criteria:type_name -> bithose.LabelAcceptanceCriterion
+	7,  // 9: bithose.SubscribeRequest.since_time:type_name -> google.protobuf.Timestamp
+	4,  // 10: bithose.Bithose.Publish:input_type -> bithose.PublishRequest
+	6,  // 11: bithose.Bithose.Subscribe:input_type -> bithose.SubscribeRequest
+	5,  // 12: bithose.Bithose.Publish:output_type -> bithose.PublishResponse
+	3,  // 13: bithose.Bithose.Subscribe:output_type -> bithose.Message
+	12, // [12:14] is the sub-list for method output_type
+	10, // [10:12] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_bithose_proto_init() }
+func file_bithose_proto_init() {
+	if File_bithose_proto != nil {
+		return
+	}
+	file_bithose_proto_msgTypes[0].OneofWrappers = []any{
+		(*LabelValue_StringValue)(nil),
+		(*LabelValue_NumberValue)(nil),
+		(*LabelValue_BoolValue)(nil),
+	}
+	file_bithose_proto_msgTypes[6].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_bithose_proto_rawDesc), len(file_bithose_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   7,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_bithose_proto_goTypes,
+		DependencyIndexes: file_bithose_proto_depIdxs,
+		MessageInfos:      file_bithose_proto_msgTypes,
+	}.Build()
+	File_bithose_proto = out.File
+	file_bithose_proto_goTypes = nil
+	file_bithose_proto_depIdxs = nil
+}
@@ -0,0 +1,175 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.0
+// - protoc             (unknown)
+// source: bithose.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Bithose_Publish_FullMethodName   = "/bithose.Bithose/Publish"
+	Bithose_Subscribe_FullMethodName = "/bithose.Bithose/Subscribe"
+)
+
+// BithoseClient is the client API for Bithose service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Bithose publishes messages to, and streams messages from, the same connection
+// store used by the websocket and HTTP endpoints.
+type BithoseClient interface {
+	// Publish sends the message to every matching subscriber.
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error)
+	// Subscribe streams every message matching all of the criteria until the
+	// call is cancelled.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Message], error)
+}
+
+type bithoseClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBithoseClient(cc grpc.ClientConnInterface) BithoseClient {
+	return &bithoseClient{cc}
+}
+
+func (c *bithoseClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, Bithose_Publish_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bithoseClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Message], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Bithose_ServiceDesc.Streams[0], Bithose_Subscribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeRequest, Message]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Bithose_SubscribeClient = grpc.ServerStreamingClient[Message]
+
+// BithoseServer is the server API for Bithose service.
+// All implementations must embed UnimplementedBithoseServer
+// for forward compatibility.
+//
+// Bithose publishes messages to, and streams messages from, the same connection
+// store used by the websocket and HTTP endpoints.
+type BithoseServer interface {
+	// Publish sends the message to every matching subscriber.
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	// Subscribe streams every message matching all of the criteria until the
+	// call is cancelled.
+	Subscribe(*SubscribeRequest, grpc.ServerStreamingServer[Message]) error
+	mustEmbedUnimplementedBithoseServer()
+}
+
+// UnimplementedBithoseServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedBithoseServer struct{}
+
+func (UnimplementedBithoseServer) Publish(context.Context, *PublishRequest) (*PublishResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedBithoseServer) Subscribe(*SubscribeRequest, grpc.ServerStreamingServer[Message]) error {
+	return status.Error(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedBithoseServer) mustEmbedUnimplementedBithoseServer() {}
+func (UnimplementedBithoseServer) testEmbeddedByValue()                 {}
+
+// UnsafeBithoseServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BithoseServer will
+// result in compilation errors.
+type UnsafeBithoseServer interface {
+	mustEmbedUnimplementedBithoseServer()
+}
+
+func RegisterBithoseServer(s grpc.ServiceRegistrar, srv BithoseServer) {
+	// If the following call panics, it indicates UnimplementedBithoseServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Bithose_ServiceDesc, srv)
+}
+
+func _Bithose_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BithoseServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Bithose_Publish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BithoseServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Bithose_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BithoseServer).Subscribe(m, &grpc.GenericServerStream[SubscribeRequest, Message]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Bithose_SubscribeServer = grpc.ServerStreamingServer[Message]
+
+// Bithose_ServiceDesc is the grpc.ServiceDesc for Bithose service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Bithose_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "bithose.Bithose",
+	HandlerType: (*BithoseServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _Bithose_Publish_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Bithose_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "bithose.proto",
+}
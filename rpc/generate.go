@@ -0,0 +1,5 @@
+// Package rpc holds the generated gRPC service for Bithose. The server
+// implementation lives in the Bithose package next to the other transports.
+package rpc
+
+//go:generate buf generate --template buf.gen.yaml
@@ -0,0 +1,294 @@
+package Bithose
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/auth"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"github.com/JonathanRosado/Bithose/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log"
+	"time"
+)
+
+// RpcServer implements the gRPC Bithose service on top of the connection store.
+// Register it with rpc.RegisterBithoseServer.
+type RpcServer struct {
+	rpc.UnimplementedBithoseServer
+}
+
+func NewRpcServer() *RpcServer {
+	return &RpcServer{}
+}
+
+func (r *RpcServer) Publish(ctx context.Context, request *rpc.PublishRequest) (*rpc.PublishResponse, error) {
+	labelPairs, err := labelPairsFromRpc(request.LabelPairs)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	message := connectionstore.Message{
+		LabelPairs: labelPairs,
+		Timestamp:  time.Now(),
+		Body:       request.Body.AsInterface(),
+		Retain:     request.Retain,
+		TTL:        request.Ttl,
+	}
+	if request.ExpiresAt != nil {
+		expiresAt := request.ExpiresAt.AsTime()
+		message.ExpiresAt = &expiresAt
+	}
+	if err := message.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := authorizePublish(rpcApiKey(ctx), labelPairs); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	connectionStore := connectionstore.GetStore()
+
+	numOfSent, numOfTimeout, err := serverShutdown.publish(connectionStore, message)
+	if err == ShuttingDownErr {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &rpc.PublishResponse{
+		NumberOfSents:    int32(numOfSent),
+		NumberOfTimeouts: int32(numOfTimeout),
+	}, nil
+}
+
+// Subscribe streams the matching messages until the call is cancelled. The uuid of the
+// subscription is sent in the bithose-uuid header. A subscription resuming with
+// since_seq or since_time is first replayed what it missed; a replay that can not be
+// made fails the call with FailedPrecondition before the header is sent, and one that
+// fails midway ends the stream with Unavailable for the client to resume again.
+func (r *RpcServer) Subscribe(request *rpc.SubscribeRequest, stream rpc.Bithose_SubscribeServer) error {
+	claims, err := authenticateRpc(stream.Context())
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	criteria := make([]connectionstore.LabelAcceptanceCriterion, 0, len(request.Criteria))
+	for _, rpcCriterion := range request.Criteria {
+		labelPairs, err := labelPairsFromRpc([]*rpc.LabelPair{rpcCriterion.LabelPair})
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		criterion := connectionstore.LabelAcceptanceCriterion{
+			LabelPair: labelPairs[0],
+			Operator:  rpcCriterion.Operator,
+		}
+		if err := criterion.Validate(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "criterion on %v: %v", criterion.LabelPair.Name, err)
+		}
+		criteria = append(criteria, criterion)
+	}
+	criteria = claims.Constrain(criteria)
+
+	var from *connectionstore.ReplayPosition
+	switch {
+	case request.SinceTime != nil:
+		from = &connectionstore.ReplayPosition{Time: request.SinceTime.AsTime()}
+	case request.SinceSeq != nil:
+		from = &connectionstore.ReplayPosition{Epoch: request.SinceEpoch, Seq: *request.SinceSeq}
+	}
+
+	shutdown := serverShutdown
+	if shutdown.isShuttingDown() {
+		return status.Error(codes.Unavailable, ShuttingDownErr.Error())
+	}
+
+	connectionStore := connectionstore.GetStore()
+
+	ch := make(chan []byte, bufferSize(int(request.BufferSize)))
+	uuid, err := connectionStore.AddConnection(connectionstore.NewConnection(ch, criteria))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer connectionStore.RemoveConnection(uuid)
+
+	respond := func() error {
+		return stream.SendHeader(metadata.Pairs("bithose-uuid", uuid))
+	}
+
+	send := func(data []byte) error {
+		if dropExpired(data) {
+			return nil
+		}
+		var message connectionstore.Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			log.Println(err)
+			return nil
+		}
+		rpcMessage, err := messageToRpc(message)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		return stream.Send(rpcMessage)
+	}
+
+	// live messages up to the last one replayed are skipped
+	var lastReplayed int64
+	if from == nil {
+		if err := respond(); err != nil {
+			return err
+		}
+	} else {
+		replayer, ok := connectionStore.(connectionstore.Replayer)
+		if !ok {
+			return status.Error(codes.FailedPrecondition, connectionstore.ReplayUnsupportedErr.Error())
+		}
+		var respondErr error
+		var responded bool
+		lastReplayed, responded, err = replay(replayer, *from, criteria, ch, stream.Context().Done(), send, func() {
+			respondErr = respond()
+		})
+		if respondErr != nil {
+			return respondErr
+		}
+		if err != nil && !responded {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case data, ok := <-ch:
+			// the connection store closes the channel of connections it dropped
+			if !ok {
+				return status.Error(codes.Unavailable, "subscription was dropped")
+			}
+			if lastReplayed > 0 {
+				if seq := messageSeq(data); seq != 0 && seq <= lastReplayed {
+					continue
+				}
+				lastReplayed = 0
+			}
+			if err := send(data); err != nil {
+				return err
+			}
+		case <-shutdown.draining:
+			// the store has flushed its queues, send what is left and end the stream
+			for {
+				select {
+				case data, ok := <-ch:
+					if !ok {
+						return status.Error(codes.Unavailable, ShuttingDownErr.Error())
+					}
+					if err := send(data); err != nil {
+						return err
+					}
+				default:
+					return status.Error(codes.Unavailable, ShuttingDownErr.Error())
+				}
+			}
+		}
+	}
+}
+
+// authenticateRpc returns the claims of the token in the authorization metadata of the
+// call, or of its verified client certificate. The claims are nil if authentication is
+// disabled.
+func authenticateRpc(ctx context.Context) (*auth.Claims, error) {
+	if TokenVerifier == nil {
+		return nil, nil
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = bearerToken(values[0])
+		}
+	}
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &tlsInfo.State
+		}
+	}
+	return authenticateToken(token, state)
+}
+
+// rpcApiKey returns the api key in the x-api-key metadata of the call
+func rpcApiKey(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-api-key"); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+func labelPairsFromRpc(rpcPairs []*rpc.LabelPair) ([]connectionstore.LabelPair, error) {
+	labelPairs := make([]connectionstore.LabelPair, 0, len(rpcPairs))
+	for _, rpcPair := range rpcPairs {
+		if rpcPair == nil {
+			return nil, connectionstore.InvalidLabelValueErr
+		}
+		labelPair := connectionstore.LabelPair{
+			Name: rpcPair.Name,
+		}
+		switch value := rpcPair.GetValue().GetValue().(type) {
+		case *rpc.LabelValue_StringValue:
+			labelPair.Value = value.StringValue
+		case *rpc.LabelValue_NumberValue:
+			labelPair.Value = value.NumberValue
+		case *rpc.LabelValue_BoolValue:
+			labelPair.Value = value.BoolValue
+		default:
+			return nil, connectionstore.InvalidLabelValueErr
+		}
+		labelPairs = append(labelPairs, labelPair)
+	}
+	return labelPairs, nil
+}
+
+func messageToRpc(message connectionstore.Message) (*rpc.Message, error) {
+	rpcMessage := &rpc.Message{
+		LabelPairs: make([]*rpc.LabelPair, 0, len(message.LabelPairs)),
+		Timestamp:  timestamppb.New(message.Timestamp),
+		Seq:        message.Seq,
+		Epoch:      message.Epoch,
+	}
+
+	for _, labelPair := range message.LabelPairs {
+		rpcValue := &rpc.LabelValue{}
+		switch value := labelPair.Value.(type) {
+		case string:
+			rpcValue.Value = &rpc.LabelValue_StringValue{StringValue: value}
+		case float64:
+			rpcValue.Value = &rpc.LabelValue_NumberValue{NumberValue: value}
+		case bool:
+			rpcValue.Value = &rpc.LabelValue_BoolValue{BoolValue: value}
+		default:
+			return nil, connectionstore.InvalidLabelValueErr
+		}
+		rpcMessage.LabelPairs = append(rpcMessage.LabelPairs, &rpc.LabelPair{
+			Name:  labelPair.Name,
+			Value: rpcValue,
+		})
+	}
+
+	body, err := structpb.NewValue(message.Body)
+	if err != nil {
+		return nil, err
+	}
+	rpcMessage.Body = body
+
+	return rpcMessage, nil
+}
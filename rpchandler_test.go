@@ -0,0 +1,277 @@
+package Bithose
+
+import (
+	"context"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"github.com/JonathanRosado/Bithose/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+	"testing"
+	"time"
+)
+
+func dialRpcServer(t *testing.T) (rpc.BithoseClient, func()) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	rpc.RegisterBithoseServer(server, NewRpcServer())
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rpc.NewBithoseClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func stringLabel(name, value string) *rpc.LabelPair {
+	return &rpc.LabelPair{
+		Name:  name,
+		Value: &rpc.LabelValue{Value: &rpc.LabelValue_StringValue{StringValue: value}},
+	}
+}
+
+func TestRpcServer_PublishAndSubscribe(t *testing.T) {
+	client, closeClient := dialRpcServer(t)
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	stream, err := client.Subscribe(ctx, &rpc.SubscribeRequest{
+		Criteria: []*rpc.LabelAcceptanceCriterion{
+			{LabelPair: stringLabel("channel", "rpc_chats"), Operator: "=="},
+			{
+				LabelPair: &rpc.LabelPair{
+					Name:  "number",
+					Value: &rpc.LabelValue{Value: &rpc.LabelValue_NumberValue{NumberValue: 5}},
+				},
+				Operator: ">",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Get("bithose-uuid")) != 1 {
+		t.Fatal("the subscription uuid should be sent in the header")
+	}
+
+	body, _ := structpb.NewValue(map[string]interface{}{"text": "hello there"})
+	response, err := client.Publish(ctx, &rpc.PublishRequest{
+		LabelPairs: []*rpc.LabelPair{
+			stringLabel("channel", "rpc_chats"),
+			{
+				Name:  "number",
+				Value: &rpc.LabelValue{Value: &rpc.LabelValue_NumberValue{NumberValue: 6}},
+			},
+		},
+		Body: body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.NumberOfSents != 1 {
+		t.Errorf("expected 1 sent message, got %v", response.NumberOfSents)
+	}
+
+	message, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Body.GetStructValue().Fields["text"].GetStringValue() != "hello there" {
+		t.Errorf("unexpected body %v", message.Body)
+	}
+	if len(message.LabelPairs) != 2 || message.LabelPairs[1].Value.GetNumberValue() != 6 {
+		t.Errorf("unexpected label pairs %v", message.LabelPairs)
+	}
+}
+
+func TestRpcServer_PublishRetainedAndExpiring(t *testing.T) {
+	client, closeClient := dialRpcServer(t)
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	labels := []*rpc.LabelPair{stringLabel("channel", "rpc_retained")}
+	if _, err := client.Publish(ctx, &rpc.PublishRequest{
+		LabelPairs: labels,
+		Body:       structpb.NewStringValue("online"),
+		Retain:     true,
+		Ttl:        60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Publish(context.Background(), &rpc.PublishRequest{LabelPairs: labels, Retain: true})
+
+	// the retained message is delivered to a subscription made after it
+	stream, err := client.Subscribe(ctx, &rpc.SubscribeRequest{
+		Criteria: []*rpc.LabelAcceptanceCriterion{
+			{LabelPair: stringLabel("channel", "rpc_retained"), Operator: "=="},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Body.GetStringValue() != "online" {
+		t.Errorf("expected the retained message, got %v", message.Body)
+	}
+
+	// a message that already expired is not delivered
+	response, err := client.Publish(ctx, &rpc.PublishRequest{
+		LabelPairs: labels,
+		Body:       structpb.NewStringValue("stale"),
+		ExpiresAt:  timestamppb.New(time.Now().Add(-time.Minute)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.NumberOfSents != 0 {
+		t.Errorf("expected the expired message not to be sent, got %v", response.NumberOfSents)
+	}
+
+	_, err = client.Publish(ctx, &rpc.PublishRequest{LabelPairs: labels, Ttl: -1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("a negative ttl should be rejected, got %v", err)
+	}
+}
+
+func TestRpcServer_SubscribeResumes(t *testing.T) {
+	previous := connectionstore.GetStore()
+	defer connectionstore.SetStore(previous)
+	history := connectionstore.NewHistoryStore(connectionstore.NewShardedStore(1), 16)
+	connectionstore.SetStore(history)
+
+	client, closeClient := dialRpcServer(t)
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	labels := []*rpc.LabelPair{stringLabel("channel", "rpc_resumes")}
+	criteria := []*rpc.LabelAcceptanceCriterion{
+		{LabelPair: stringLabel("channel", "rpc_resumes"), Operator: "=="},
+	}
+	publish := func(body string) {
+		if _, err := client.Publish(ctx, &rpc.PublishRequest{LabelPairs: labels, Body: structpb.NewStringValue(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream, err := client.Subscribe(ctx, &rpc.SubscribeRequest{Criteria: criteria})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	publish("first")
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Seq != 1 || first.Epoch != history.Epoch() {
+		t.Fatalf("expected seq 1 of epoch %v, got %v of %v", history.Epoch(), first.Seq, first.Epoch)
+	}
+
+	publish("second")
+	publish("third")
+
+	// resuming from the first message replays the missed ones, then live ones follow
+	stream, err = client.Subscribe(ctx, &rpc.SubscribeRequest{
+		Criteria:   criteria,
+		SinceSeq:   &first.Seq,
+		SinceEpoch: first.Epoch,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header, err := stream.Header(); err != nil || len(header.Get("bithose-uuid")) != 1 {
+		t.Fatalf("the subscription uuid should be sent in the header, got %v %v", header, err)
+	}
+	publish("fourth")
+	for seq, expected := range []string{"second", "third", "fourth"} {
+		message, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Body.GetStringValue() != expected || message.Seq != int64(seq+2) {
+			t.Errorf("expected %v with seq %v, got %v with seq %v", expected, seq+2, message.Body, message.Seq)
+		}
+	}
+
+	// a replay that can not be made fails the call
+	stream, err = client.Subscribe(ctx, &rpc.SubscribeRequest{
+		Criteria:   criteria,
+		SinceSeq:   &first.Seq,
+		SinceEpoch: "another epoch",
+	})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for an unknown epoch, got %v", err)
+	}
+
+	connectionstore.SetStore(connectionstore.NewShardedStore(1))
+	stream, err = client.Subscribe(ctx, &rpc.SubscribeRequest{
+		Criteria:  criteria,
+		SinceTime: timestamppb.New(time.Now()),
+	})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition from a store without history, got %v", err)
+	}
+}
+
+func TestRpcServer_InvalidArguments(t *testing.T) {
+	client, closeClient := dialRpcServer(t)
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	_, err := client.Publish(ctx, &rpc.PublishRequest{
+		LabelPairs: []*rpc.LabelPair{{Name: "channel"}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("a label without a value should be rejected, got %v", err)
+	}
+
+	stream, err := client.Subscribe(ctx, &rpc.SubscribeRequest{
+		Criteria: []*rpc.LabelAcceptanceCriterion{
+			{LabelPair: stringLabel("channel", "rpc_chats"), Operator: ">"},
+		},
+	})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("a range operator on a string should be rejected, got %v", err)
+	}
+}
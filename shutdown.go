@@ -0,0 +1,150 @@
+package Bithose
+
+import (
+	"context"
+	"errors"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"sync"
+	"time"
+)
+
+var (
+	// ShutdownCloseReason is the reason in the close frame websockets get when the
+	// server shuts down
+	ShutdownCloseReason = "server is going away, reconnect"
+
+	// CloseHandshakeTimeout is how long a websocket has to answer a close frame
+	// before its connection is closed
+	CloseHandshakeTimeout = time.Second
+
+	ShuttingDownErr = errors.New("server is shutting down")
+
+	// queueFlushInterval is how often Shutdown checks whether the queues of the
+	// connection store are empty
+	queueFlushInterval = 10 * time.Millisecond
+
+	serverShutdown = newShutdownState()
+)
+
+// shutdownState tracks the publishes and websockets Shutdown has to wait for
+type shutdownState struct {
+	// mtx is held for reading by publishes and while websockets register, and for
+	// writing to start the shutdown, which so waits for in-flight publishes
+	mtx          *sync.RWMutex
+	shuttingDown bool
+	deadline     time.Time
+
+	websocketsMtx *sync.Mutex
+	websockets    map[*Websocket]struct{}
+	websocketsWg  *sync.WaitGroup
+
+	// draining is closed once the queues of the connection store are flushed, for
+	// subscriptions to deliver what they hold and end
+	draining chan struct{}
+}
+
+func newShutdownState() *shutdownState {
+	return &shutdownState{
+		mtx:           &sync.RWMutex{},
+		websocketsMtx: &sync.Mutex{},
+		websockets:    map[*Websocket]struct{}{},
+		websocketsWg:  &sync.WaitGroup{},
+		draining:      make(chan struct{}),
+	}
+}
+
+func (s *shutdownState) isShuttingDown() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.shuttingDown
+}
+
+// publish sends the message unless the server is shutting down
+func (s *shutdownState) publish(store connectionstore.ConnectionStore, message connectionstore.Message) (numOfSent int, numOfTimeouts int, err error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.shuttingDown {
+		return 0, 0, ShuttingDownErr
+	}
+	return store.SendMessage(message)
+}
+
+// addWebsocket returns false if the server is shutting down. Otherwise Shutdown waits
+// for the websocket until it is removed.
+func (s *shutdownState) addWebsocket(ws *Websocket) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.shuttingDown {
+		return false
+	}
+
+	s.websocketsMtx.Lock()
+	defer s.websocketsMtx.Unlock()
+	s.websockets[ws] = struct{}{}
+	s.websocketsWg.Add(1)
+	return true
+}
+
+func (s *shutdownState) removeWebsocket(ws *Websocket) {
+	s.websocketsMtx.Lock()
+	defer s.websocketsMtx.Unlock()
+	if _, ok := s.websockets[ws]; ok {
+		delete(s.websockets, ws)
+		s.websocketsWg.Done()
+	}
+}
+
+// closeWebsockets closes the connections of the websockets without a close frame
+func (s *shutdownState) closeWebsockets() {
+	s.websocketsMtx.Lock()
+	defer s.websocketsMtx.Unlock()
+	for ws := range s.websockets {
+		ws.conn.Close()
+	}
+}
+
+// Shutdown drains the server. Publishes are refused and the ones in flight are waited
+// for, the queues of the connection store are flushed, and then every subscription
+// delivers what it holds: websockets get a close frame with ShutdownCloseReason and
+// event streams, polls and gRPC streams end. If ctx is done first, the remaining
+// websockets are closed abruptly and ctx's error is returned.
+//
+// Shutdown does not stop the listeners, which is left to the http.Server.
+func Shutdown(ctx context.Context) error {
+	s := serverShutdown
+
+	s.mtx.Lock()
+	if s.shuttingDown {
+		s.mtx.Unlock()
+		return ShuttingDownErr
+	}
+	s.shuttingDown = true
+	s.deadline, _ = ctx.Deadline()
+	s.mtx.Unlock()
+
+	ticker := time.NewTicker(queueFlushInterval)
+	defer ticker.Stop()
+	for connectionstore.QueuedMessages() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			close(s.draining)
+			s.closeWebsockets()
+			return ctx.Err()
+		}
+	}
+	close(s.draining)
+
+	closed := make(chan struct{})
+	go func() {
+		s.websocketsWg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		s.closeWebsockets()
+		return ctx.Err()
+	}
+}
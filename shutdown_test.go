@@ -0,0 +1,114 @@
+package Bithose
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	defer func() {
+		serverShutdown = newShutdownState()
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	conn, _, err := dialWsHandler(t, server, "/subscribe?filter=channel==shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var subscribeResponse SubscribeResponse
+	if err := conn.ReadJSON(&subscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages published before the shutdown are all delivered before the close frame
+	for i := 0; i < 20; i++ {
+		_, response := publish(t, "POST", `{"labels": {"channel": "shutdown"}, "data": "before"}`)
+		if response.NumberOfSents != 1 {
+			t.Fatalf("expected 1 sent message, got %+v", response)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- Shutdown(ctx)
+	}()
+
+	for i := 0; i < 20; i++ {
+		var message connectionstore.Message
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected message %v, got %v", i, err)
+		}
+		json.Unmarshal(p, &message)
+		if message.Body != "before" {
+			t.Errorf("unexpected body %v", message.Body)
+		}
+	}
+
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != ShutdownCloseReason {
+		t.Errorf("expected a going away close frame, got %v", err)
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("shutdown should finish before its deadline, got %v", err)
+	}
+
+	recorder, response := publish(t, "POST", `{"labels": {"channel": "shutdown"}, "data": "after"}`)
+	if recorder.Code != http.StatusServiceUnavailable || response.Error != ShuttingDownErr.Error() {
+		t.Errorf("expected publishes to be refused, got %v %+v", recorder.Code, response)
+	}
+
+	_, response2, err := dialWsHandler(t, server, "/subscribe")
+	if err == nil || response2 == nil || response2.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected upgrades to be refused with a 503, got %v", response2)
+	}
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	defer func() {
+		serverShutdown = newShutdownState()
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	conn, _, err := dialWsHandler(t, server, "/subscribe?filter=channel==shutdown_deadline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var subscribeResponse SubscribeResponse
+	if err := conn.ReadJSON(&subscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	// a socket that never answers the close frame is closed at the deadline
+	// at the latest
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+
+	if err := Shutdown(context.Background()); err != ShuttingDownErr {
+		t.Errorf("expected ShuttingDownErr for a second shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package Bithose
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// SseHeartbeatInterval is how often a comment line is sent to keep idle
+	// streams from being closed by proxies
+	SseHeartbeatInterval = 15 * time.Second
+
+	InvalidLastEventIdErr = errors.New("invalid Last-Event-ID")
+)
+
+// SseHandler streams every message matching the query string filters as
+// text/event-stream events. The optional buffer_size query parameter sets how
+// many messages may be buffered for the stream. The id of each event is the
+// epoch and sequence number of the message, so a client reconnecting with a
+// Last-Event-ID header (or last_event_id query parameter) is replayed what it
+// missed from the message history before live delivery resumes. A replay that
+// can not be made is reported in the subscribe event and the stream goes on live.
+func SseHandler(writer http.ResponseWriter, request *http.Request) {
+	if !checkCors(writer, request) {
+		return
+	}
+
+	if request.Method == "OPTIONS" {
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	claims, err := authenticate(request)
+	if err != nil {
+		unauthorized(writer, err)
+		return
+	}
+
+	criteria, err := connectionstore.ParseFilters(request.URL.Query()["filter"])
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	criteria = claims.Constrain(criteria)
+	size, err := queryBufferSize(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lastEventId := request.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = request.URL.Query().Get("last_event_id")
+	}
+	var from *connectionstore.ReplayPosition
+	if lastEventId != "" {
+		position, err := parseSseEventId(lastEventId)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = &position
+	}
+
+	shutdown := serverShutdown
+	if shutdown.isShuttingDown() {
+		http.Error(writer, ShuttingDownErr.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	connectionStore := connectionstore.GetStore()
+
+	// the connection is added before replaying so nothing published in between is
+	// lost. Live messages up to the last one replayed are skipped
+	ch := make(chan []byte, size)
+	uuid, err := connectionStore.AddConnection(connectionstore.NewConnection(ch, criteria))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer connectionStore.RemoveConnection(uuid)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+
+	// send confirmation
+	respond := func(replayErr error) error {
+		subscribeResponse := SubscribeResponse{
+			Type: "subscribe",
+			Uuid: uuid,
+		}
+		if replayErr != nil {
+			subscribeResponse.Error = replayErr.Error()
+		}
+		jsonResponse, err := json.Marshal(&subscribeResponse)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(writer, "event: subscribe\ndata: %s\n\n", jsonResponse); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	send := func(message []byte) error {
+		if dropExpired(message) {
+			return nil
+		}
+		if err := writeSseEvent(writer, sseEventId(message), message); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	var lastReplayed int64
+	if from == nil {
+		if err := respond(nil); err != nil {
+			log.Println(err)
+			return
+		}
+	} else {
+		responded := false
+		err := connectionstore.ReplayUnsupportedErr
+		if replayer, ok := connectionStore.(connectionstore.Replayer); ok {
+			var respondErr error
+			lastReplayed, responded, err = replay(replayer, *from, criteria, ch, request.Context().Done(), send, func() {
+				respondErr = respond(nil)
+			})
+			if respondErr != nil {
+				log.Println(respondErr)
+				return
+			}
+		}
+		if err != nil && responded {
+			// live messages were drained meanwhile, the client reconnects with its
+			// Last-Event-ID
+			log.Println(err)
+			return
+		}
+		if err != nil {
+			if err := respond(err); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(SseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case message, ok := <-ch:
+			// the connection store closes the channel of connections it dropped
+			if !ok {
+				return
+			}
+			if lastReplayed > 0 {
+				if seq := messageSeq(message); seq != 0 && seq <= lastReplayed {
+					continue
+				}
+				lastReplayed = 0
+			}
+			if err := send(message); err != nil {
+				log.Println(err)
+				return
+			}
+		case <-shutdown.draining:
+			// the store has flushed its queues, send what is left and end the
+			// stream. The client reconnects with its Last-Event-ID
+			for {
+				select {
+				case message, ok := <-ch:
+					if !ok || send(message) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeSseEvent(writer http.ResponseWriter, id string, data []byte) error {
+	if id != "" {
+		if _, err := fmt.Fprintf(writer, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(writer, "data: %s\n\n", data)
+	return err
+}
+
+// sseEventId returns the event id of the json encoded message, its epoch and
+// sequence number separated by a colon, or "" if the message has no sequence number
+func sseEventId(message []byte) string {
+	var stub = struct {
+		Epoch string `json:"epoch"`
+		Seq   int64  `json:"seq"`
+	}{}
+	if err := json.Unmarshal(message, &stub); err != nil || stub.Seq == 0 {
+		return ""
+	}
+	return stub.Epoch + ":" + strconv.FormatInt(stub.Seq, 10)
+}
+
+// parseSseEventId returns the position after the message with the event id
+func parseSseEventId(id string) (connectionstore.ReplayPosition, error) {
+	separator := strings.LastIndex(id, ":")
+	if separator == -1 {
+		return connectionstore.ReplayPosition{}, InvalidLastEventIdErr
+	}
+	seq, err := strconv.ParseInt(id[separator+1:], 10, 64)
+	if err != nil || seq < 0 {
+		return connectionstore.ReplayPosition{}, InvalidLastEventIdErr
+	}
+	return connectionstore.ReplayPosition{Epoch: id[:separator], Seq: seq}, nil
+}
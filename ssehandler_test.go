@@ -0,0 +1,222 @@
+package Bithose
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSseEvent reads lines up to the next blank line, skipping comments
+func readSseEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	event := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(event) == 0 {
+				continue
+			}
+			return event
+		}
+		if strings.HasPrefix(line, ":") {
+			event["comment"] = line
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		event[parts[0]] = parts[1]
+	}
+}
+
+func sseSubscribe(t *testing.T, server *httptest.Server, query string, lastEventId string) (*http.Response, *bufio.Reader) {
+	request, _ := http.NewRequest("GET", server.URL+"/events?"+query, nil)
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, bufio.NewReader(response.Body)
+}
+
+func publishSse(body string) {
+	connectionstore.GetStore().SendMessage(connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{
+			{Name: "channel", Value: "sse_chats"},
+		},
+		Timestamp: time.Now(),
+		Body:      body,
+	})
+}
+
+func TestSseHandler_StreamsAndResumes(t *testing.T) {
+	previous := connectionstore.GetStore()
+	defer connectionstore.SetStore(previous)
+	history := connectionstore.NewHistoryStore(connectionstore.NewShardedStore(1), 16)
+	connectionstore.SetStore(history)
+
+	server := httptest.NewServer(http.HandlerFunc(SseHandler))
+	defer server.Close()
+
+	response, reader := sseSubscribe(t, server, "filter=channel==sse_chats", "")
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %v", response.Header.Get("Content-Type"))
+	}
+	if event := readSseEvent(t, reader); event["event"] != "subscribe" {
+		t.Fatalf("expected subscribe event, got %v", event)
+	}
+
+	publishSse("first")
+	event := readSseEvent(t, reader)
+	var message connectionstore.Message
+	json.Unmarshal([]byte(event["data"]), &message)
+	if message.Body != "first" {
+		t.Fatalf("unexpected body %v", message.Body)
+	}
+	firstId := event["id"]
+	if firstId != history.Epoch()+":1" {
+		t.Fatalf("expected the event id %v:1, got %q", history.Epoch(), firstId)
+	}
+	response.Body.Close()
+
+	publishSse("second")
+	publishSse("third")
+
+	response, reader = sseSubscribe(t, server, "filter=channel==sse_chats", firstId)
+	defer response.Body.Close()
+	var subscribeResponse SubscribeResponse
+	json.Unmarshal([]byte(readSseEvent(t, reader)["data"]), &subscribeResponse)
+	if subscribeResponse.Uuid == "" || subscribeResponse.Error != "" {
+		t.Fatalf("unexpected subscribe response %+v", subscribeResponse)
+	}
+	for _, expected := range []string{"second", "third"} {
+		event = readSseEvent(t, reader)
+		json.Unmarshal([]byte(event["data"]), &message)
+		if message.Body != expected {
+			t.Errorf("expected the missed message %v to be replayed, got %v", expected, message.Body)
+		}
+	}
+
+	// live messages follow the replay
+	publishSse("fourth")
+	event = readSseEvent(t, reader)
+	json.Unmarshal([]byte(event["data"]), &message)
+	if message.Body != "fourth" || event["id"] != history.Epoch()+":4" {
+		t.Errorf("expected the fourth message, got %v", event)
+	}
+}
+
+func TestSseHandler_ReplayErrors(t *testing.T) {
+	previous := connectionstore.GetStore()
+	defer connectionstore.SetStore(previous)
+	history := connectionstore.NewHistoryStore(connectionstore.NewShardedStore(1), 16)
+	connectionstore.SetStore(history)
+
+	server := httptest.NewServer(http.HandlerFunc(SseHandler))
+	defer server.Close()
+
+	response, _ := sseSubscribe(t, server, "filter=channel==sse_chats", "1602998400000000000")
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an id without epoch, got %v", response.StatusCode)
+	}
+
+	// the stream goes on live with the error in the subscribe event
+	subscribeError := func(lastEventId string) string {
+		response, reader := sseSubscribe(t, server, "filter=channel==sse_chats", lastEventId)
+		defer response.Body.Close()
+		var subscribeResponse SubscribeResponse
+		json.Unmarshal([]byte(readSseEvent(t, reader)["data"]), &subscribeResponse)
+		if subscribeResponse.Uuid == "" {
+			t.Errorf("expected the stream to be subscribed, got %+v", subscribeResponse)
+		}
+		return subscribeResponse.Error
+	}
+	if err := subscribeError("restarted:5"); err != connectionstore.UnknownSequenceErr.Error() {
+		t.Errorf("expected UnknownSequenceErr, got %q", err)
+	}
+	connectionstore.SetStore(connectionstore.NewShardedStore(1))
+	if err := subscribeError(history.Epoch() + ":0"); err != connectionstore.ReplayUnsupportedErr.Error() {
+		t.Errorf("expected ReplayUnsupportedErr, got %q", err)
+	}
+}
+
+func TestSseHandler_Heartbeat(t *testing.T) {
+	interval := SseHeartbeatInterval
+	SseHeartbeatInterval = time.Millisecond * 20
+	defer func() { SseHeartbeatInterval = interval }()
+
+	server := httptest.NewServer(http.HandlerFunc(SseHandler))
+	defer server.Close()
+
+	response, reader := sseSubscribe(t, server, "filter=channel==sse_heartbeat", "")
+	defer response.Body.Close()
+	readSseEvent(t, reader) // subscribe
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, ":") {
+		t.Errorf("expected a heartbeat comment, got %q", line)
+	}
+}
+
+func TestSseHandler_RemovesConnectionWhenClientLeaves(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(SseHandler))
+	defer server.Close()
+
+	response, reader := sseSubscribe(t, server, "filter=channel==sse_leaving", "")
+	event := readSseEvent(t, reader)
+	var subscribeResponse SubscribeResponse
+	json.Unmarshal([]byte(event["data"]), &subscribeResponse)
+	response.Body.Close()
+
+	time.Sleep(time.Millisecond * 100)
+	if _, exists := connectionstore.GetStore().GetConnection(subscribeResponse.Uuid); exists {
+		t.Error("connection should be removed once the request ends")
+	}
+}
+
+func TestSseHandler_InvalidFilter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(SseHandler))
+	defer server.Close()
+
+	response, _ := sseSubscribe(t, server, "filter=channel>chats", "")
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %v", response.StatusCode)
+	}
+}
+
+func TestSseHandler_TokenQueryParameter(t *testing.T) {
+	enableTestAuth(t)
+	server := httptest.NewServer(http.HandlerFunc(SseHandler))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %v", response.StatusCode)
+	}
+
+	response, err = http.Get(server.URL + "/events?token=" + testToken(`{"sub":"42"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %v", response.StatusCode)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Package tlsconfig builds the TLS configuration of the server. The certificate is
+reloaded when its files change on disk, so rotated certificates are picked up without
+a restart, and client certificates can be verified against a CA for mutual TLS.
+*/
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ReloadCheckInterval is the least time between two checks of the certificate
+	// files for changes
+	ReloadCheckInterval = time.Second
+
+	InvalidClientCAErr = errors.New("no certificates found in client CA file")
+)
+
+// CertReloader serves the certificate in its files and loads it again once either of
+// them changes
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mtx         *sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+// NewCertReloader loads the PEM encoded certificate and key
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		mtx:      &sync.Mutex{},
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) load() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// changed returns true if either file was modified since it was loaded
+func (r *CertReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the files changed but can
+// not be loaded, for instance because only one of them was replaced so far, the
+// previous certificate keeps being served.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if now := time.Now(); now.Sub(r.lastCheck) >= ReloadCheckInterval {
+		r.lastCheck = now
+		if r.changed() {
+			if err := r.load(); err != nil {
+				log.Println("tlsconfig: keeping the previous certificate:", err)
+			} else {
+				log.Println("tlsconfig: reloaded certificate", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// ServerConfig returns the TLS configuration serving the reloader's certificate. If
+// clientCAFile is set, client certificates are verified against the CAs in it and,
+// if requireClientCert is set, clients without one are refused.
+func ServerConfig(reloader *CertReloader, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		data, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, InvalidClientCAErr
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
@@ -2,25 +2,57 @@ package Bithose
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/JonathanRosado/Bithose/connectionstore"
 	"github.com/gorilla/websocket"
 	"log"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 )
 
+var (
+	SubscriptionNotFoundErr = errors.New("subscription not found")
+
+	// WsPingInterval is how often websockets are pinged
+	WsPingInterval = 30 * time.Second
+
+	// WsPongTimeout is how long a websocket may go without answering a ping or
+	// sending anything before it is considered dead. Its subscriptions are then
+	// removed and the connection is counted as reaped. It must be longer than
+	// WsPingInterval
+	WsPongTimeout = 60 * time.Second
+
+	// wsPingWriteTimeout bounds the write of a ping
+	wsPingWriteTimeout = 10 * time.Second
+
+	// websocketStats counts the reaped websockets, which are not known to the
+	// connection store
+	websocketStats = connectionstore.NewStatistics()
+)
+
 var Upgrader websocket.Upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		return Cors.AllowsOrigin(r.Header.Get("Origin"))
 	},
 }
 
 type Websocket struct {
 	conn *websocket.Conn
 	mu   sync.Mutex
+
+	// pingInterval and pongTimeout are WsPingInterval and WsPongTimeout when the
+	// socket was opened
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+
+	// deadlineMu orders the read deadlines set by pongs and by Close, so that a
+	// late pong does not extend the close handshake
+	deadlineMu sync.Mutex
+	closing    bool
 }
 
 func NewWebsocket(w http.ResponseWriter, r *http.Request) (*Websocket, error) {
@@ -29,8 +61,10 @@ func NewWebsocket(w http.ResponseWriter, r *http.Request) (*Websocket, error) {
 		return nil, err
 	}
 	return &Websocket{
-		conn: conn,
-		mu:   sync.Mutex{},
+		conn:         conn,
+		mu:           sync.Mutex{},
+		pingInterval: WsPingInterval,
+		pongTimeout:  WsPongTimeout,
 	}, nil
 }
 
@@ -38,56 +72,347 @@ func (w *Websocket) Send(message []byte) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	err := w.conn.WriteMessage(websocket.TextMessage, message)
+	if err != nil {
+		websocketWriteErrors.Inc()
+	}
 	return err
 }
 
+// Close sends a close frame with the code and reason and gives the client
+// CloseHandshakeTimeout to answer it, after which reads fail
+func (w *Websocket) Close(code int, reason string) error {
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	w.closing = true
+
+	deadline := time.Now().Add(CloseHandshakeTimeout)
+	err := w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	if err != nil {
+		w.conn.Close()
+		return err
+	}
+	return w.conn.SetReadDeadline(deadline)
+}
+
+// isClosing returns true once Close was called
+func (w *Websocket) isClosing() bool {
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	return w.closing
+}
+
+// extendReadDeadline gives the peer another pong timeout to show it is alive,
+// unless the socket is closing
+func (w *Websocket) extendReadDeadline() {
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	if !w.closing {
+		w.conn.SetReadDeadline(time.Now().Add(w.pongTimeout))
+	}
+}
+
+// ping pings the peer every ping interval until done is closed or a ping fails
+func (w *Websocket) ping(done chan struct{}) {
+	ticker := time.NewTicker(w.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsPingWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// setWriteDeadline bounds the writes to the socket, waiting for a write in
+// progress to finish
+func (w *Websocket) setWriteDeadline(deadline time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(deadline)
+}
+
 func WsHandler(writer http.ResponseWriter, request *http.Request) {
-	setCors(writer)
+	if !checkCors(writer, request) {
+		return
+	}
 
 	if request.Method == "OPTIONS" {
 		return
 	}
 
+	claims, err := authenticate(request)
+	if err != nil {
+		unauthorized(writer, err)
+		return
+	}
+
+	// filters given in the query string are parsed before upgrading so that
+	// a bad filter can be reported with a plain 400
+	filters := request.URL.Query()["filter"]
+	queryCriteria, err := connectionstore.ParseFilters(filters)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	queryBufferSize, err := queryBufferSize(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// publishes made on the socket without an api key of their own use the one the
+	// socket was opened with
+	connectionApiKey := requestApiKey(request)
+
+	shutdown := serverShutdown
+	if shutdown.isShuttingDown() {
+		http.Error(writer, ShuttingDownErr.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	ws, err := NewWebsocket(writer, request)
 	if err != nil {
 		log.Println(err)
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer ws.conn.Close()
+
+	if !shutdown.addWebsocket(ws) {
+		ws.Close(websocket.CloseGoingAway, ShutdownCloseReason)
+		return
+	}
+	defer shutdown.removeWebsocket(ws)
 
-	connectionStore := connectionstore.GetMapStore()
+	websocketConnections.Inc()
+	defer websocketConnections.Dec()
 
-	// all connections will use this channel
-	ch := make(chan []byte)
+	connectionStore := connectionstore.GetStore()
 
-	// all uuids for the connections
-	uuids := []string{}
+	// the uuids of the socket's subscriptions, each with a channel that is closed
+	// to stop the goroutine forwarding its messages. Once closing is set, no more
+	// forwarders are started
+	subscriptionsMtx := &sync.Mutex{}
+	subscriptions := map[string]chan struct{}{}
+	forwarders := &sync.WaitGroup{}
+	closing := false
+	removeConnection := func(uuid string) bool {
+		subscriptionsMtx.Lock()
+		defer subscriptionsMtx.Unlock()
+		stop, ok := subscriptions[uuid]
+		if !ok {
+			return false
+		}
+		connectionStore.RemoveConnection(uuid)
+		close(stop)
+		delete(subscriptions, uuid)
+		return true
+	}
 	removeConnections := func() {
-		for _, uuid := range uuids {
+		subscriptionsMtx.Lock()
+		defer subscriptionsMtx.Unlock()
+		for uuid, stop := range subscriptions {
 			connectionStore.RemoveConnection(uuid)
+			close(stop)
 		}
+		subscriptions = map[string]chan struct{}{}
 	}
+	defer removeConnections()
+
+	handlerDone := make(chan struct{})
+	defer close(handlerDone)
 
-	// goroutine listens for sent messages
+	// a peer that stops answering pings is reaped by the read below failing
+	ws.extendReadDeadline()
+	ws.conn.SetPongHandler(func(string) error {
+		ws.extendReadDeadline()
+		return nil
+	})
+	go ws.ping(handlerDone)
+
+	// on shutdown, the socket is closed once its subscriptions delivered what they hold
 	go func() {
-		for {
-			message := <-ch
-			err := ws.Send(message)
-			if err != nil {
-				log.Println("Error while writing")
-				log.Println(err)
-				removeConnections()
-				return
-			}
+		select {
+		case <-shutdown.draining:
+		case <-handlerDone:
+			return
+		}
+		subscriptionsMtx.Lock()
+		closing = true
+		subscriptionsMtx.Unlock()
+
+		if !shutdown.deadline.IsZero() {
+			ws.setWriteDeadline(shutdown.deadline)
 		}
+		forwarders.Wait()
+		ws.Close(websocket.CloseGoingAway, ShutdownCloseReason)
 	}()
 
+	// sends the confirmation of a subscription, without its uuid if it failed
+	sendSubscribeResponse := func(uuid string, err error) bool {
+		subscribeResponse := SubscribeResponse{
+			Type: "subscribe",
+			Uuid: uuid,
+		}
+		if err != nil {
+			subscribeResponse.Uuid = ""
+			subscribeResponse.Error = err.Error()
+		}
+		jsonResponse, err := json.Marshal(&subscribeResponse)
+		if err != nil {
+			log.Println(err)
+		}
+		err = ws.Send(jsonResponse)
+		if err != nil {
+			log.Println(err)
+		}
+		return subscribeResponse.Error == ""
+	}
+
+	// registers a connection for the criteria and sends the confirmation. Every
+	// subscription gets its own buffered channel so that a slow socket can absorb
+	// bursts without the connection store dropping it. With a replay position, the
+	// kept messages from there on are sent by the forwarder after the confirmation
+	// and before the live messages
+	subscribe := func(criteria []connectionstore.LabelAcceptanceCriterion, size int, from *connectionstore.ReplayPosition) {
+		// labels pinned by the token always apply
+		criteria = claims.Constrain(criteria)
+
+		ch := make(chan []byte, size)
+		var uuid string
+		replayer, canReplay := connectionStore.(connectionstore.Replayer)
+		err := ShuttingDownErr
+		if from != nil && !canReplay {
+			err = connectionstore.ReplayUnsupportedErr
+		} else if !shutdown.isShuttingDown() {
+			uuid, err = connectionStore.AddConnection(&connectionstore.Connection{
+				Ch:                      ch,
+				LabelAcceptanceCriteria: criteria,
+			})
+		}
+
+		// send confirmation
+		sendResponse := func(err error) bool {
+			return sendSubscribeResponse(uuid, err)
+		}
+		if err != nil {
+			sendResponse(err)
+			return
+		}
+
+		if from == nil && !sendResponse(nil) {
+			return
+		}
+
+		stop := make(chan struct{})
+		subscriptionsMtx.Lock()
+		if closing {
+			subscriptionsMtx.Unlock()
+			connectionStore.RemoveConnection(uuid)
+			if from != nil {
+				sendResponse(ShuttingDownErr)
+			}
+			return
+		}
+		subscriptions[uuid] = stop
+		forwarders.Add(1)
+		subscriptionsMtx.Unlock()
+
+		// goroutine listens for sent messages. The connection is added before
+		// replaying so nothing published in between is lost; live messages up to the
+		// last one replayed are skipped
+		go func() {
+			defer forwarders.Done()
+			var lastReplayed int64
+			if from != nil {
+				var responded bool
+				var err error
+				lastReplayed, responded, err = replay(replayer, *from, criteria, ch, stop, ws.Send, func() { sendResponse(nil) })
+				if err != nil && !responded {
+					removeConnection(uuid)
+					sendResponse(err)
+					return
+				}
+				if err != nil {
+					// live messages were drained meanwhile, the client has to resume
+					log.Println(err)
+					removeConnections()
+					ws.Close(websocket.CloseTryAgainLater, err.Error())
+					return
+				}
+			}
+			for {
+				select {
+				case message, ok := <-ch:
+					// the connection store closes the channel of connections it dropped
+					if !ok {
+						return
+					}
+					if lastReplayed > 0 {
+						if seq := messageSeq(message); seq != 0 && seq <= lastReplayed {
+							continue
+						}
+						lastReplayed = 0
+					}
+					if dropExpired(message) {
+						continue
+					}
+					err := ws.Send(message)
+					if err != nil {
+						log.Println("Error while writing")
+						log.Println(err)
+						removeConnections()
+						return
+					}
+				case <-stop:
+					return
+				case <-shutdown.draining:
+					// the store has flushed its queues, send what is left and stop
+					for {
+						select {
+						case message, ok := <-ch:
+							if !ok {
+								return
+							}
+							if !dropExpired(message) && ws.Send(message) != nil {
+								return
+							}
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	// WS /subscribe?filter=... subscribes without the client having to send a frame.
+	// WS /subscribe without filters subscribes to all messages
+	if len(filters) > 0 || request.URL.Path == "/subscribe" {
+		subscribe(queryCriteria, queryBufferSize, nil)
+	}
+
 	for {
 		// read incoming payload
 		messageType, p, err := ws.conn.ReadMessage()
+		if err == nil {
+			ws.extendReadDeadline()
+		}
 		// TODO: find a way to close. first value messageType may help
 		log.Println("read message")
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				websocketReadErrors.Inc()
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !ws.isClosing() {
+				log.Println("reaping websocket that stopped answering pings")
+				websocketStats.IncrementConnectionReaped()
+				websocketsReaped.Inc()
+			}
 			log.Println("messageType: ", messageType)
 			log.Println("p: ", p)
 			log.Println(err)
@@ -114,22 +439,32 @@ func WsHandler(writer http.ResponseWriter, request *http.Request) {
 				log.Println(err)
 				continue
 			}
+			if err := incomingSubscribe.Validate(); err != nil {
+				sendSubscribeResponse("", err)
+				continue
+			}
 
-			uuid, err := connectionStore.AddConnection(&connectionstore.Connection{
-				Ch:                      ch,
-				LabelAcceptanceCriteria: incomingSubscribe.Criteria,
-			})
+			subscribe(incomingSubscribe.Criteria, bufferSize(incomingSubscribe.BufferSize), incomingSubscribe.ReplayPosition())
 
-			uuids = append(uuids, uuid)
+		case "unsubscribe":
+			incomingUnsubscribe := IncomingUnsubscribeRequest{}
+			err := json.Unmarshal(p, &incomingUnsubscribe)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
 
-			// send confirmation
-			subscribeResponse := SubscribeResponse{
-				Uuid: uuid,
+			// only subscriptions made on this socket can be removed
+			unsubscribeResponse := UnsubscribeResponse{
+				Type: "unsubscribe",
+				Uuid: incomingUnsubscribe.Uuid,
 			}
-			if err != nil {
-				subscribeResponse.Error = err.Error()
+			if !removeConnection(incomingUnsubscribe.Uuid) {
+				unsubscribeResponse.Error = SubscriptionNotFoundErr.Error()
 			}
-			jsonResponse, err := json.Marshal(&subscribeResponse)
+
+			// send confirmation
+			jsonResponse, err := json.Marshal(&unsubscribeResponse)
 			if err != nil {
 				log.Println(err)
 			}
@@ -138,7 +473,6 @@ func WsHandler(writer http.ResponseWriter, request *http.Request) {
 				log.Println(err)
 			}
 
-		case "unsubscribe":
 		case "message":
 			incomingMessage := IncomingMessage{}
 			err := json.Unmarshal(p, &incomingMessage)
@@ -149,10 +483,23 @@ func WsHandler(writer http.ResponseWriter, request *http.Request) {
 				continue
 			}
 
-			numOfSent, numOfTimeout, err := connectionStore.SendMessage(incomingMessage.Message)
+			apiKey := incomingMessage.ApiKey
+			if apiKey == "" {
+				apiKey = connectionApiKey
+			}
+
+			var numOfSent, numOfTimeout int
+			err = incomingMessage.Message.Validate()
+			if err == nil {
+				err = authorizePublish(apiKey, incomingMessage.Message.LabelPairs)
+			}
+			if err == nil {
+				numOfSent, numOfTimeout, err = shutdown.publish(connectionStore, incomingMessage.Message)
+			}
 
 			// send confirmation
 			messageResponse := SendMessageResponse{
+				Type:             "message",
 				NumberOfSents:    numOfSent,
 				NumberOfTimeouts: numOfTimeout,
 				Error:            "",
@@ -174,9 +521,3 @@ func WsHandler(writer http.ResponseWriter, request *http.Request) {
 		}
 	}
 }
-
-func setCors(writer http.ResponseWriter) {
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-}
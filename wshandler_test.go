@@ -0,0 +1,671 @@
+package Bithose
+
+import (
+	"encoding/json"
+	"github.com/JonathanRosado/Bithose/auth"
+	"github.com/JonathanRosado/Bithose/connectionstore"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func dialWsHandler(t *testing.T, server *httptest.Server, path string) (*websocket.Conn, *http.Response, error) {
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + path
+	return websocket.DefaultDialer.Dial(u, nil)
+}
+
+func TestWsHandler_QueryFilterSubscription(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	conn, _, err := dialWsHandler(t, server, "/subscribe?filter=channel==ws_query_chats&filter=number>5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var subscribeResponse SubscribeResponse
+	if err := conn.ReadJSON(&subscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+	if subscribeResponse.Uuid == "" || subscribeResponse.Error != "" {
+		t.Fatalf("unexpected subscribe response %+v", subscribeResponse)
+	}
+
+	connectionStore := connectionstore.GetStore()
+	connection, exists := connectionStore.GetConnection(subscribeResponse.Uuid)
+	if !exists {
+		t.Fatal("subscription should be registered at upgrade time")
+	}
+	if len(connection.LabelAcceptanceCriteria) != 2 {
+		t.Errorf("expected 2 criteria, got %v", len(connection.LabelAcceptanceCriteria))
+	}
+
+	go connectionStore.SendMessage(connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{
+			{Name: "channel", Value: "ws_query_chats"},
+			{Name: "number", Value: 6.0},
+		},
+		Timestamp: time.Now(),
+		Body:      "hello there",
+	})
+
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message connectionstore.Message
+	json.Unmarshal(p, &message)
+	if message.Body != "hello there" {
+		t.Errorf("unexpected body %v", message.Body)
+	}
+}
+
+func TestWsHandler_InvalidQueryFilter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	_, response, err := dialWsHandler(t, server, "/subscribe?filter=channel>chats")
+	if err == nil {
+		t.Fatal("upgrade should fail for an invalid filter")
+	}
+	if response == nil || response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %v", response)
+	}
+}
+
+func TestWsHandler_BufferedSubscriptionSurvivesBurst(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	conn, _, err := dialWsHandler(t, server, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	conn.WriteJSON(IncomingSubscribeRequest{
+		Type: "subscribe",
+		Criteria: []connectionstore.LabelAcceptanceCriterion{
+			{
+				LabelPair: connectionstore.LabelPair{Name: "channel", Value: "ws_burst"},
+				Operator:  "==",
+			},
+		},
+		BufferSize: 100,
+	})
+	var subscribeResponse SubscribeResponse
+	if err := conn.ReadJSON(&subscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	connection, _ := connectionstore.GetStore().GetConnection(subscribeResponse.Uuid)
+	if cap(connection.Ch) != 100 {
+		t.Errorf("expected a buffer of 100, got %v", cap(connection.Ch))
+	}
+
+	// nothing is read from the socket while publishing
+	for i := 0; i < 100; i++ {
+		_, numOfTimeouts, _ := connectionstore.GetStore().SendMessage(connectionstore.Message{
+			LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "ws_burst"}},
+			Timestamp:  time.Now(),
+			Body:       float64(i),
+		})
+		if numOfTimeouts != 0 {
+			t.Fatalf("message %v timed out", i)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		var message connectionstore.Message
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Body != float64(i) {
+			t.Fatalf("expected message %v, got %v", i, message.Body)
+		}
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	if bufferSize(0) != MessageBufferSize {
+		t.Error("no preference should use the default buffer size")
+	}
+	if bufferSize(10) != 10 {
+		t.Error("requested sizes should be honoured")
+	}
+	if bufferSize(MaxMessageBufferSize+1) != MaxMessageBufferSize {
+		t.Error("requested sizes should be capped")
+	}
+}
+
+func TestWsHandler_UnsubscribeOnlyOwnSubscriptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	owner, _, err := dialWsHandler(t, server, "/subscribe?filter=channel==ws_unsubscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	other, _, err := dialWsHandler(t, server, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	owner.SetReadDeadline(time.Now().Add(time.Second))
+	other.SetReadDeadline(time.Now().Add(time.Second))
+
+	var subscribeResponse SubscribeResponse
+	if err := owner.ReadJSON(&subscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+	if subscribeResponse.Type != "subscribe" {
+		t.Errorf("unexpected subscribe response %+v", subscribeResponse)
+	}
+
+	var unsubscribeResponse UnsubscribeResponse
+	other.WriteJSON(IncomingUnsubscribeRequest{Type: "unsubscribe", Uuid: subscribeResponse.Uuid})
+	if err := other.ReadJSON(&unsubscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+	if unsubscribeResponse.Type != "unsubscribe" || unsubscribeResponse.Error != SubscriptionNotFoundErr.Error() {
+		t.Errorf("another socket should not be able to unsubscribe, got %+v", unsubscribeResponse)
+	}
+	if _, exists := connectionstore.GetStore().GetConnection(subscribeResponse.Uuid); !exists {
+		t.Fatal("subscription should still exist")
+	}
+
+	owner.WriteJSON(IncomingUnsubscribeRequest{Type: "unsubscribe", Uuid: subscribeResponse.Uuid})
+	if err := owner.ReadJSON(&unsubscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+	if unsubscribeResponse.Error != "" {
+		t.Errorf("unexpected error %v", unsubscribeResponse.Error)
+	}
+	if _, exists := connectionstore.GetStore().GetConnection(subscribeResponse.Uuid); exists {
+		t.Error("subscription should be removed")
+	}
+}
+
+func TestWsHandler_RequiresToken(t *testing.T) {
+	enableTestAuth(t)
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	_, response, err := dialWsHandler(t, server, "/subscribe")
+	if err == nil {
+		t.Fatal("upgrade should fail without a token")
+	}
+	if response == nil || response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %v", response)
+	}
+
+	_, response, err = dialWsHandler(t, server, "/subscribe?token="+testToken(`{"sub":"42","exp":1}`))
+	if err == nil {
+		t.Fatal("upgrade should fail with an expired token")
+	}
+	if response == nil || response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %v", response)
+	}
+}
+
+func TestWsHandler_TokenPinsLabels(t *testing.T) {
+	enableTestAuth(t)
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+testToken(`{"sub":"ws_auth_42"}`))
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/subscribe?filter=uid==ws_auth_7"
+	conn, _, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var subscribeResponse SubscribeResponse
+	if err := conn.ReadJSON(&subscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client asked for another user's channel, but the token pins its own
+	connectionStore := connectionstore.GetStore()
+	for _, uid := range []string{"ws_auth_7", "ws_auth_42"} {
+		connectionStore.SendMessage(connectionstore.Message{
+			LabelPairs: []connectionstore.LabelPair{{Name: "uid", Value: uid}},
+			Timestamp:  time.Now(),
+			Body:       uid,
+		})
+	}
+
+	var message connectionstore.Message
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Body != "ws_auth_42" {
+		t.Errorf("expected only the messages of the token's subject, got %v", message.Body)
+	}
+}
+
+func TestWsHandler_PublishRequiresApiKey(t *testing.T) {
+	keys, err := auth.NewPublisherKeys(map[string]map[string][]interface{}{
+		"backend": {"channel": {"ws_keys"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	PublisherKeys = keys
+	defer func() {
+		PublisherKeys = nil
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	conn, _, err := dialWsHandler(t, server, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	message := connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "ws_keys"}},
+		Body:       "hello there",
+	}
+	for _, test := range []struct {
+		apiKey string
+		err    string
+	}{
+		{"", auth.MissingApiKeyErr.Error()},
+		{"browser", auth.InvalidApiKeyErr.Error()},
+		{"backend", ""},
+	} {
+		if err := conn.WriteJSON(IncomingMessage{Type: "message", Message: message, ApiKey: test.apiKey}); err != nil {
+			t.Fatal(err)
+		}
+		var response SendMessageResponse
+		if err := conn.ReadJSON(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Error != test.err {
+			t.Errorf("expected error %q for key %q, got %q", test.err, test.apiKey, response.Error)
+		}
+	}
+}
+
+func TestWsHandler_ValidatesPublishedMessages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	subscriber, _, err := dialWsHandler(t, server, "/?filter=channel==ws_validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	publisher, _, err := dialWsHandler(t, server, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	subscriber.SetReadDeadline(time.Now().Add(time.Second))
+	publisher.SetReadDeadline(time.Now().Add(time.Second))
+
+	var subscribeResponse SubscribeResponse
+	if err := subscriber.ReadJSON(&subscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	labelPairs := []connectionstore.LabelPair{{Name: "channel", Value: "ws_validate"}}
+	for _, test := range []struct {
+		message connectionstore.Message
+		err     string
+	}{
+		{connectionstore.Message{LabelPairs: labelPairs, Body: "negative", TTL: -1}, connectionstore.InvalidTtlErr.Error()},
+		{connectionstore.Message{LabelPairs: labelPairs, Body: "forever", TTL: 1e12}, connectionstore.TtlTooLongErr.Error()},
+		{connectionstore.Message{LabelPairs: labelPairs, Body: "numbered", Seq: 42}, ""},
+	} {
+		if err := publisher.WriteJSON(IncomingMessage{Type: "message", Message: test.message}); err != nil {
+			t.Fatal(err)
+		}
+		var response SendMessageResponse
+		if err := publisher.ReadJSON(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Error != test.err {
+			t.Errorf("expected error %q for %v, got %q", test.err, test.message.Body, response.Error)
+		}
+	}
+
+	var message connectionstore.Message
+	if err := subscriber.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Body != "numbered" || message.Seq != 0 {
+		t.Errorf("only the valid message should be delivered, without the publisher's seq, got %+v", message)
+	}
+}
+
+func TestWsHandler_RejectsInvalidCriteria(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	conn, _, err := dialWsHandler(t, server, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","criteria":[{"label_pair":{"name":"channel","value":"x"},"operator":"!="}]}`))
+	var subscribeResponse SubscribeResponse
+	if err := conn.ReadJSON(&subscribeResponse); err != nil {
+		t.Fatal(err)
+	}
+	if subscribeResponse.Uuid != "" || !strings.Contains(subscribeResponse.Error, connectionstore.OperatorNotFound.Error()) {
+		t.Errorf("expected the subscription to be refused, got %+v", subscribeResponse)
+	}
+}
+
+func TestWsHandler_RejectsOrigin(t *testing.T) {
+	defaultCors := Cors
+	Cors = &CorsPolicy{AllowedOrigins: []string{"https://example.com"}}
+	defer func() {
+		Cors = defaultCors
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Origin", "https://evil.com")
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/subscribe"
+	_, response, err := websocket.DefaultDialer.Dial(u, header)
+	if err == nil {
+		t.Fatal("upgrade should fail for an origin that is not allowed")
+	}
+	if response == nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403, got %v", response)
+	}
+
+	header.Set("Origin", "https://example.com")
+	conn, _, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestWsHandler_ReapsUnresponsiveConnections(t *testing.T) {
+	pingInterval, pongTimeout := WsPingInterval, WsPongTimeout
+	WsPingInterval, WsPongTimeout = 20*time.Millisecond, 100*time.Millisecond
+	defer func() {
+		WsPingInterval, WsPongTimeout = pingInterval, pongTimeout
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	// a client that keeps reading answers the pings
+	live, _, err := dialWsHandler(t, server, "/subscribe?filter=channel==ws_reap_live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	var liveResponse SubscribeResponse
+	if err := live.ReadJSON(&liveResponse); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, _, err := live.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// a client that stops reading never answers them, like a half-open connection
+	dead, _, err := dialWsHandler(t, server, "/subscribe?filter=channel==ws_reap_dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	var deadResponse SubscribeResponse
+	if err := dead.ReadJSON(&deadResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	reaped := websocketStats.Copy().TotalConnectionsReaped
+
+	time.Sleep(300 * time.Millisecond)
+
+	connectionStore := connectionstore.GetStore()
+	if _, exists := connectionStore.GetConnection(deadResponse.Uuid); exists {
+		t.Error("the subscriptions of an unresponsive socket should be removed")
+	}
+	if _, exists := connectionStore.GetConnection(liveResponse.Uuid); !exists {
+		t.Error("the subscriptions of a responsive socket should be kept")
+	}
+
+	recorder := httptest.NewRecorder()
+	StatsHandler(recorder, httptest.NewRequest("GET", "/stats", nil))
+	var snapshot connectionstore.StatisticsSnapshot
+	json.Unmarshal(recorder.Body.Bytes(), &snapshot)
+	if snapshot.TotalConnectionsReaped != reaped+1 {
+		t.Errorf("expected %v reaped connections, got %v", reaped+1, snapshot.TotalConnectionsReaped)
+	}
+}
+
+func TestWsHandler_ReplaysSinceSeq(t *testing.T) {
+	previous := connectionstore.GetStore()
+	defer connectionstore.SetStore(previous)
+	history := connectionstore.NewHistoryStore(connectionstore.NewShardedStore(1), 4)
+	connectionstore.SetStore(history)
+
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	// 1, 2 and 3 are dropped from the history, 4 is on another channel
+	start := time.Now()
+	for i := 1; i <= 7; i++ {
+		channel := "ws_resume"
+		if i == 4 {
+			channel = "ws_resume_other"
+		}
+		history.SendMessage(connectionstore.Message{
+			LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: channel}},
+			Timestamp:  start.Add(time.Duration(i) * time.Millisecond),
+			Body:       float64(i),
+		})
+	}
+
+	subscribe := func(frame string) (*websocket.Conn, SubscribeResponse) {
+		conn, _, err := dialWsHandler(t, server, "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.WriteMessage(websocket.TextMessage, []byte(frame))
+		var subscribeResponse SubscribeResponse
+		if err := conn.ReadJSON(&subscribeResponse); err != nil {
+			t.Fatal(err)
+		}
+		return conn, subscribeResponse
+	}
+	criteria := `"criteria":[{"label_pair":{"name":"channel","value":"ws_resume"},"operator":"=="}]`
+	epoch := `"since_epoch":"` + history.Epoch() + `"`
+
+	conn, subscribeResponse := subscribe(`{"type":"subscribe",` + criteria + `,` + epoch + `,"since_seq":4}`)
+	defer conn.Close()
+	if subscribeResponse.Uuid == "" || subscribeResponse.Error != "" {
+		t.Fatalf("unexpected subscribe response %+v", subscribeResponse)
+	}
+	go history.SendMessage(connectionstore.Message{
+		LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "ws_resume"}},
+		Timestamp:  time.Now(),
+		Body:       float64(8),
+	})
+	for _, expected := range []int64{5, 6, 7, 8} {
+		var message connectionstore.Message
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Seq != expected || message.Epoch != history.Epoch() || message.Body != float64(expected) {
+			t.Fatalf("expected message %v, got %+v", expected, message)
+		}
+	}
+
+	since := start.Add(6 * time.Millisecond).Format(time.RFC3339Nano)
+	timeConn, subscribeResponse := subscribe(`{"type":"subscribe",` + criteria + `,"since_time":"` + since + `"}`)
+	defer timeConn.Close()
+	var message connectionstore.Message
+	if err := timeConn.ReadJSON(&message); err != nil || message.Seq != 6 {
+		t.Fatalf("expected message 6 first, got %+v %v", message, err)
+	}
+
+	for frame, expected := range map[string]error{
+		`{"type":"subscribe",` + epoch + `,"since_seq":1}`:                           connectionstore.HistoryExpiredErr,
+		`{"type":"subscribe",` + epoch + `,"since_seq":100}`:                         connectionstore.UnknownSequenceErr,
+		`{"type":"subscribe","since_epoch":"restarted","since_seq":5}`:               connectionstore.UnknownSequenceErr,
+		`{"type":"subscribe","since_time":"` + start.Format(time.RFC3339Nano) + `"}`: connectionstore.HistoryExpiredErr,
+	} {
+		conn, subscribeResponse := subscribe(frame)
+		conn.Close()
+		if subscribeResponse.Uuid != "" || subscribeResponse.Error != expected.Error() {
+			t.Errorf("expected %v for %v, got %+v", expected, frame, subscribeResponse)
+		}
+	}
+
+	// stores without history can not replay
+	connectionstore.SetStore(connectionstore.NewShardedStore(1))
+	conn, subscribeResponse = subscribe(`{"type":"subscribe","since_seq":0}`)
+	conn.Close()
+	if subscribeResponse.Error != connectionstore.ReplayUnsupportedErr.Error() {
+		t.Errorf("expected ReplayUnsupportedErr, got %+v", subscribeResponse)
+	}
+}
+
+// slowReplayer holds its first replay until release is closed
+type slowReplayer struct {
+	*connectionstore.HistoryStore
+	once    *sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s slowReplayer) Replay(from connectionstore.ReplayPosition, criteria []connectionstore.LabelAcceptanceCriterion, fn func(connectionstore.Message) bool) error {
+	s.once.Do(func() {
+		close(s.started)
+		<-s.release
+	})
+	return s.HistoryStore.Replay(from, criteria, fn)
+}
+
+func TestWsHandler_PublishesDuringReplay(t *testing.T) {
+	previous := connectionstore.GetStore()
+	defer connectionstore.SetStore(previous)
+	published := connectionstore.QueueSize * 3
+	store := slowReplayer{
+		HistoryStore: connectionstore.NewHistoryStore(connectionstore.NewShardedStore(1), published+10),
+		once:         &sync.Once{},
+		started:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	connectionstore.SetStore(store)
+
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	message := func(i int) connectionstore.Message {
+		return connectionstore.Message{
+			LabelPairs: []connectionstore.LabelPair{{Name: "channel", Value: "ws_replaying"}},
+			Timestamp:  time.Now(),
+			Body:       float64(i),
+		}
+	}
+	store.SendMessage(message(1))
+
+	conn, _, err := dialWsHandler(t, server, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","criteria":[{"label_pair":{"name":"channel","value":"ws_replaying"},"operator":"=="}],"since_epoch":"`+store.Epoch()+`","since_seq":0}`))
+
+	// the queue of the subscription would overflow if nothing drained it while
+	// the replay is held. Messages are published in batches a live subscriber
+	// keeps up with
+	<-store.started
+	for i := 2; i <= published; i++ {
+		if _, numOfTimeouts, _ := store.SendMessage(message(i)); numOfTimeouts != 0 {
+			t.Fatalf("message %v timed out", i)
+		}
+		if i%(connectionstore.QueueSize/8) == 0 {
+			time.Sleep(time.Millisecond * 20)
+		}
+	}
+	time.Sleep(connectionstore.SendTimeout * 2)
+	close(store.release)
+
+	var subscribeResponse SubscribeResponse
+	if err := conn.ReadJSON(&subscribeResponse); err != nil || subscribeResponse.Uuid == "" {
+		t.Fatalf("unexpected subscribe response %+v %v", subscribeResponse, err)
+	}
+	for i := 1; i <= published; i++ {
+		var message connectionstore.Message
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Seq != int64(i) || message.Body != float64(i) {
+			t.Fatalf("expected message %v, got %+v", i, message)
+		}
+	}
+
+	// live messages follow the replay
+	store.SendMessage(message(published + 1))
+	var live connectionstore.Message
+	if err := conn.ReadJSON(&live); err != nil || live.Seq != int64(published+1) {
+		t.Fatalf("expected message %v, got %+v %v", published+1, live, err)
+	}
+}
+
+func TestWsHandler_DeliversRetainedMessages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(WsHandler))
+	defer server.Close()
+
+	recorder, _ := publish(t, "POST", `{"labels": {"chart": "ws_retained", "host": "a"}, "data": 42, "retain": true}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", recorder.Code)
+	}
+	// cleared right away, so later subscriptions get nothing
+	defer publish(t, "POST", `{"labels": {"chart": "ws_retained", "host": "a"}, "retain": true}`)
+
+	conn, _, err := dialWsHandler(t, server, "/subscribe?filter=chart==ws_retained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	// the confirmation comes first
+	var subscribeResponse SubscribeResponse
+	if err := conn.ReadJSON(&subscribeResponse); err != nil || subscribeResponse.Uuid == "" {
+		t.Fatalf("expected the subscribe response, got %+v %v", subscribeResponse, err)
+	}
+	var message connectionstore.Message
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Body != 42.0 || !message.Retain {
+		t.Errorf("expected the retained message, got %+v", message)
+	}
+}